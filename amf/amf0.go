@@ -4,12 +4,107 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"reflect"
+	"sort"
+	"time"
 )
 
+// AMF0 type markers
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0MovieClip   = 0x04 // reserved, not supported
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0Reference   = 0x07
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+	amf0Unsupported = 0x0D
+	amf0RecordSet   = 0x0E // reserved, not supported
+	amf0XMLDocument = 0x0F
+	amf0TypedObject = 0x10
+	amf0AVMPlus     = 0x11
+)
+
+// AMF0Msg is a sequence of AMF0 values, such as the command name, transaction
+// id, command object and arguments of an RTMP command message, keyed by their
+// position.
+//
+// Values are decoded to and encoded from the following Go types:
+//
+//	number         float64
+//	boolean        bool
+//	string         string, long strings too
+//	object         AMF0Object; AMF0OrderedObject when encoding, or decoding
+//	               with a Decoder set to keep order
+//	null           nil
+//	undefined      AMF0Undefined
+//	reference      the referenced value; AMF0Reference when encoding
+//	ECMA array     AMF0ECMAArray; likewise AMF0OrderedECMAArray
+//	strict array   AMF0StrictArray, or []interface{} when encoding
+//	date           time.Time
+//	XML document   AMF0XMLDocument
+//	typed object   AMF0TypedObject
+//	AVM+           AMF0AVMPlus
 type AMF0Msg map[int]interface{}
+
+// AMF0Object is an anonymous AMF0 object.
 type AMF0Object map[string]interface{}
 
+// AMF0OrderedObject is an anonymous AMF0 object which keeps its properties in
+// order, for peers expecting them in a given order, such as the level, code
+// and description of an onStatus info object. Maps such as AMF0Object encode
+// their keys in sorted order.
+type AMF0OrderedObject []AMF0Property
+
+// AMF0Property is a key value pair of an AMF0OrderedObject or
+// AMF0OrderedECMAArray.
+type AMF0Property struct {
+	Key   string
+	Value interface{}
+}
+
+// AMF0Undefined is the AMF0 undefined value.
+type AMF0Undefined struct{}
+
+// AMF0Reference refers to the complex value, that is object, typed object,
+// ECMA array or strict array, at this index among those already encoded in
+// the same message. Decoding resolves references to the value referred to.
+type AMF0Reference uint16
+
+// AMF0ECMAArray is an AMF0 ECMA array, an associative array which
+// ActionScript treats like an object. Stream metadata is usually sent as one.
+type AMF0ECMAArray map[string]interface{}
+
+// AMF0OrderedECMAArray is an AMF0 ECMA array which keeps its properties in
+// order, as AMF0OrderedObject does for objects.
+type AMF0OrderedECMAArray []AMF0Property
+
+// AMF0StrictArray is an AMF0 strict array, an array with ordinal indices only.
+type AMF0StrictArray []interface{}
+
+// AMF0XMLDocument is an AMF0 XML document, held as its XML text.
+type AMF0XMLDocument string
+
+// AMF0TypedObject is an AMF0 object registered under an ActionScript class
+// name.
+type AMF0TypedObject struct {
+	ClassName string
+	Object    AMF0Object
+}
+
+// AMF0AVMPlus switches to AMF3 for a single value.
+type AMF0AVMPlus struct {
+	Value interface{}
+}
+
 // MarshalBinary allows AMF0Msg to adhere to the BinaryMarshaler interface.
 // It serializes the existing AMF0Msg to the Network Order byte slice expected
 // by AMF0 clients.
@@ -19,49 +114,13 @@ func (m *AMF0Msg) MarshalBinary() ([]byte, error) {
 
 	// Walk through keys
 	for i := 0; i < mLen; i++ {
-		if v, ok := (*m)[i]; !ok {
+		v, ok := (*m)[i]
+		if !ok {
 			return nil, fmt.Errorf("rtmp: AMF0: AMF messages must have contiguous key indexs. %d does not exist", i)
-		} else {
-			switch v := v.(type) {
-			case float64: // 0x00
-				b := make([]byte, 8)
-				binary.BigEndian.PutUint64(b, math.Float64bits(v))
-				ret = append(ret, 0x00)
-				ret = append(ret, b...)
-
-			case bool: // 0x01
-				var b byte
-				if v {
-					b = 0x01
-				} else {
-					b = 0x00
-				}
-				ret = append(ret, 0x01, b)
-
-			case string: // 0x02
-				if len(v) >= 0xFFFF { // Size is 2 bytes
-					return nil, fmt.Errorf("rtmp: AMF0: string too long: length: %d, max: %d", len(v), 0xFFFF)
-				}
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(len(v)))
-
-				ret = append(ret, 0x02)
-				ret = append(ret, b...)
-				ret = append(ret, []byte(v)...)
-
-			case AMF0Object: // 0x03
-				if b, err := v.MarshalBinary(); err == nil {
-					ret = append(ret, b...)
-				} else {
-					return nil, err
-				}
-
-			case nil: // 0x05
-				ret = append(ret, 0x05)
-
-			default:
-				return nil, fmt.Errorf("rtmp: AMF0: AMF type not recognized: %d: %v", i, v)
-			}
+		}
+		var err error
+		if ret, err = appendAMF0Value(ret, v); err != nil {
+			return nil, fmt.Errorf("rtmp: AMF0: value %d: %s", i, err.Error())
 		}
 	}
 
@@ -72,298 +131,625 @@ func (m *AMF0Msg) MarshalBinary() ([]byte, error) {
 // It fills the fields of an existing AMF0Msg with values parsed from a
 // byte slice, b.
 func (m *AMF0Msg) UnmarshalBinary(b []byte) error {
-	k := 0
-	i := 0
-	for i < len(b) {
-		// First byte determines type
-		switch b[i] {
-		case 0x00: // number
-			if (i + 9) > len(b) {
-				return errors.New("rtmp: AMF0: number marker found without enough bytes for number")
-			}
+	d := &amf0Decoder{r: newBytesReader(b)}
+	for k := 0; ; k++ {
+		marker, err := d.r.nextOrEOF(1, "rtmp: AMF0", "marker")
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if (*m)[k], err = d.decode(marker[0]); err != nil {
+			return err
+		}
+	}
+}
 
-			num := math.Float64frombits(binary.BigEndian.Uint64(b[i+1 : i+9]))
-			(*m)[k] = num
-			i = i + 9 // 1 + 8
+// MarshalBinary allows AMF0Object to adhere to the BinaryMarshaler interface.
+// It serializes the existing AMF0Object to the Network Order byte slice expected
+// by AMF0 clients. Typically this is function is called from an AMF0Msg
+// having MarshalBinary called on it.
+func (o *AMF0Object) MarshalBinary() ([]byte, error) {
+	b, err := appendAMF0Value(nil, *o)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: AMF0: %s", err.Error())
+	}
+	return b, nil
+}
 
-		case 0x01: // boolean
-			if (i + 1) > len(b) {
-				return errors.New("rtmp: AMF0: boolean marker found without enough bytes for boolean")
-			}
+// UnmarshalBinary allows AMF0Object to the BinaryUnmarshaler interface.
+// It fills the fields of an existing AMF0Object with values parsed from a
+// byte slice, b.
+func (o *AMF0Object) UnmarshalBinary(b []byte) error {
+	// Ensure the first byte is the object start marker
+	if len(b) < 1 || b[0] != amf0Object {
+		return errors.New("rtmp: AMF0: Object binary must start with 0x03 object start marker")
+	}
+	d := &amf0Decoder{r: newBytesReader(b[1:])}
+	d.refs = append(d.refs, nil)
+	if err := d.decodeProperties(*o, false); err != nil {
+		return err
+	}
+	if d.r.left != 0 {
+		return errors.New("rtmp: AMF0: Object binary has trailing bytes after object end marker")
+	}
+	return nil
+}
 
-			(*m)[k] = b[i+1] != 0x00 // boolean. 0x00 = false. everything else is true
-			i = i + 2                // 1 + 1
+// Get returns the value of the property key and whether it exists.
+func (o AMF0OrderedObject) Get(key string) (interface{}, bool) {
+	for _, p := range o {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
 
-		case 0x02: // string
-			if (i + 2) > len(b) {
-				return errors.New("rtmp: AMF0: string marker found without enough bytes for string size")
-			}
+// Set sets the value of the property key, adding it at the end if it does not
+// exist yet.
+func (o *AMF0OrderedObject) Set(key string, v interface{}) {
+	for i := range *o {
+		if (*o)[i].Key == key {
+			(*o)[i].Value = v
+			return
+		}
+	}
+	*o = append(*o, AMF0Property{Key: key, Value: v})
+}
 
-			strSz := binary.BigEndian.Uint16(b[i+1 : i+3])
-			if (i + 2 + int(strSz)) > len(b) {
-				return errors.New("rtmp: AMF0: string marker and size forund without enough bytes for string")
-			}
-			str := string(b[i+3 : i+3+int(strSz)])
-			(*m)[k] = str
-			i = i + 3 + int(strSz) // 2 + 1
+// MarshalBinary allows AMF0OrderedObject to adhere to the BinaryMarshaler
+// interface. Properties are encoded in order.
+func (o *AMF0OrderedObject) MarshalBinary() ([]byte, error) {
+	b, err := appendAMF0Value(nil, *o)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: AMF0: %s", err.Error())
+	}
+	return b, nil
+}
 
-		case 0x03: // object
-			if (i + 3) > len(b) {
-				return errors.New("rtmp: AMF0: object marker found without enough bytes for object")
-			}
+// UnmarshalBinary allows AMF0OrderedObject to adhere to the
+// BinaryUnmarshaler interface. It replaces the properties of o with those of
+// the object in b, in the order they were encoded.
+func (o *AMF0OrderedObject) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 || b[0] != amf0Object {
+		return errors.New("rtmp: AMF0: Object binary must start with 0x03 object start marker")
+	}
+	d := &amf0Decoder{r: newBytesReader(b[1:]), ordered: true}
+	d.refs = append(d.refs, nil)
+	props, err := d.decodeOrderedProperties(false)
+	if err != nil {
+		return err
+	}
+	if d.r.left != 0 {
+		return errors.New("rtmp: AMF0: Object binary has trailing bytes after object end marker")
+	}
+	*o = AMF0OrderedObject(props)
+	return nil
+}
 
-			objSz, err := scanForAMF0ObjectEnd(b[i:])
-			if err != nil {
-				return err
-			}
+// Get returns the value of the property key and whether it exists.
+func (a AMF0OrderedECMAArray) Get(key string) (interface{}, bool) {
+	return AMF0OrderedObject(a).Get(key)
+}
 
-			obj := &AMF0Object{}
-			if err := obj.UnmarshalBinary(b[i : i+objSz]); err != nil {
-				return err
+// Set sets the value of the property key, adding it at the end if it does not
+// exist yet.
+func (a *AMF0OrderedECMAArray) Set(key string, v interface{}) {
+	o := AMF0OrderedObject(*a)
+	o.Set(key, v)
+	*a = AMF0OrderedECMAArray(o)
+}
+
+// appendAMF0Value appends the AMF0 encoding of v, marker included, to b.
+// Objects and arrays containing themselves cannot be encoded and return an
+// error.
+func appendAMF0Value(b []byte, v interface{}) ([]byte, error) {
+	return (&amf0Encoder{}).appendValue(b, v)
+}
+
+// amf0Encoder encodes AMF0 values, keeping track of the objects and arrays
+// it is inside of.
+type amf0Encoder struct {
+	visiting marshalState
+}
+
+// enter marks the map or slice c as being encoded, failing if it already is.
+// Every successful call must be matched by a call to leave.
+func (e *amf0Encoder) enter(c interface{}) (visit, error) {
+	return e.visiting.enter(reflect.ValueOf(c))
+}
+
+func (e *amf0Encoder) leave(k visit) {
+	e.visiting.leave(k)
+}
+
+func (e *amf0Encoder) appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case float64:
+		b = append(b, amf0Number)
+		return appendUint64(b, math.Float64bits(v)), nil
+
+	case bool:
+		if v {
+			return append(b, amf0Boolean, 0x01), nil
+		}
+		return append(b, amf0Boolean, 0x00), nil
+
+	case string:
+		if len(v) > math.MaxUint16 {
+			if uint64(len(v)) > math.MaxUint32 {
+				return nil, fmt.Errorf("long string too long: length: %d, max: %d", len(v), uint32(math.MaxUint32))
 			}
-			(*m)[k] = *obj
-			i = i + objSz
+			b = append(b, amf0LongString)
+			b = appendUint32(b, uint32(len(v)))
+			return append(b, v...), nil
+		}
+		b = append(b, amf0String)
+		return appendAMF0UTF8(b, v)
+
+	case AMF0Object:
+		return e.appendProperties(append(b, amf0Object), v)
+
+	case *AMF0Object:
+		return e.appendValue(b, *v)
+
+	case AMF0OrderedObject:
+		return e.appendOrderedProperties(append(b, amf0Object), v)
+
+	case *AMF0OrderedObject:
+		return e.appendValue(b, *v)
+
+	case nil:
+		return append(b, amf0Null), nil
+
+	case AMF0Undefined:
+		return append(b, amf0Undefined), nil
+
+	case AMF0Reference:
+		b = append(b, amf0Reference)
+		return appendUint16(b, uint16(v)), nil
+
+	case AMF0ECMAArray:
+		b = append(b, amf0ECMAArray)
+		b = appendUint32(b, uint32(len(v)))
+		return e.appendProperties(b, v)
+
+	case AMF0OrderedECMAArray:
+		b = append(b, amf0ECMAArray)
+		b = appendUint32(b, uint32(len(v)))
+		return e.appendOrderedProperties(b, v)
+
+	case AMF0StrictArray:
+		return e.appendStrictArray(b, v)
+
+	case []interface{}:
+		return e.appendStrictArray(b, v)
 
-		case 0x05: // null marker
-			(*m)[k] = nil
-			i = i + 1
+	case time.Time:
+		ms := float64(v.UnixNano()) / float64(time.Millisecond)
+		b = append(b, amf0Date)
+		b = appendUint64(b, math.Float64bits(ms))
+		return appendUint16(b, 0), nil // time zone, reserved and 0
 
-		default:
-			return fmt.Errorf("rtmp: AMF0: unimplemented marker found: %v", b[i])
+	case AMF0XMLDocument:
+		if uint64(len(v)) > math.MaxUint32 {
+			return nil, fmt.Errorf("XML document too long: length: %d, max: %d", len(v), uint32(math.MaxUint32))
 		}
+		b = append(b, amf0XMLDocument)
+		b = appendUint32(b, uint32(len(v)))
+		return append(b, v...), nil
+
+	case AMF0TypedObject:
+		b = append(b, amf0TypedObject)
+		b, err := appendAMF0UTF8(b, v.ClassName)
+		if err != nil {
+			return nil, err
+		}
+		return e.appendProperties(b, v.Object)
+
+	case AMF0AVMPlus:
+		return appendAMF3Value(append(b, amf0AVMPlus), v.Value)
 
-		k += 1
+	default:
+		return nil, fmt.Errorf("AMF type not recognized: %T: %v", v, v)
 	}
+}
 
-	return nil
+// appendAMF0UTF8 appends s, preceded by its 16 bit length, to b.
+func appendAMF0UTF8(b []byte, s string) ([]byte, error) {
+	if len(s) > math.MaxUint16 {
+		return nil, fmt.Errorf("string too long: length: %d, max: %d", len(s), math.MaxUint16)
+	}
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...), nil
 }
 
-// MarshalBinary allows AMF0Object to adhere to the BinaryMarshaler interface.
-// It serializes the existing AMF0Object to the Network Order byte slice expected
-// by AMF0 clients. Typically this is function is called from an AMF0Msg
-// having MarshalBinary called on it.
-func (o *AMF0Object) MarshalBinary() ([]byte, error) {
-	var ret []byte
+// appendProperties appends the key value pairs of an object or ECMA array,
+// sorted by key so the encoding is always the same, followed by the object
+// end marker, to b.
+func (e *amf0Encoder) appendProperties(b []byte, props map[string]interface{}) ([]byte, error) {
+	k, err := e.enter(props)
+	if err != nil {
+		return nil, err
+	}
+	defer e.leave(k)
+	return e.appendOrderedProperties(b, sortedProperties(props))
+}
 
-	ret = append(ret, 0x03) // Object start marker 0x03
-	for k, v := range *o {
-		if len(k) >= 0xFFFF { // Size is 2 bytes
-			return nil, fmt.Errorf("rtmp: AMF0: string too long: length: %d, max: %d", len(k), 0xFFFF)
-		}
-		b := make([]byte, 2)
-		binary.BigEndian.PutUint16(b, uint16(len(k)))
-		ret = append(ret, b...)
-		ret = append(ret, []byte(k)...)
-
-		switch v := v.(type) {
-		case float64: // 0x00
-			b := make([]byte, 8)
-			binary.BigEndian.PutUint64(b, math.Float64bits(v))
-			ret = append(ret, 0x00)
-			ret = append(ret, b...)
-
-		case bool: // 0x01
-			var b byte
-			if v {
-				b = 0x01
-			} else {
-				b = 0x00
-			}
-			ret = append(ret, 0x01, b)
+// appendOrderedProperties appends the key value pairs of an object or ECMA
+// array in order, followed by the object end marker, to b.
+func (e *amf0Encoder) appendOrderedProperties(b []byte, props []AMF0Property) ([]byte, error) {
+	k, err := e.enter(props)
+	if err != nil {
+		return nil, err
+	}
+	defer e.leave(k)
+	for _, p := range props {
+		if p.Key == "" {
+			return nil, errors.New("object keys must not be empty")
+		}
+		if b, err = appendAMF0UTF8(b, p.Key); err != nil {
+			return nil, err
+		}
+		if b, err = e.appendValue(b, p.Value); err != nil {
+			return nil, fmt.Errorf("%s: %s", p.Key, err.Error())
+		}
+	}
+	return append(b, 0x00, 0x00, amf0ObjectEnd), nil // Empty key and object end marker
+}
 
-		case string: // 0x02
-			if len(v) >= 0xFFFF { // Size is 2 bytes
-				return nil, fmt.Errorf("rtmp: AMF0: string too long: length: %d, max: %d", len(v), 0xFFFF)
-			}
-			b := make([]byte, 2)
-			binary.BigEndian.PutUint16(b, uint16(len(v)))
+// sortedProperties returns the key value pairs of props sorted by key.
+func sortedProperties(props map[string]interface{}) []AMF0Property {
+	sorted := make([]AMF0Property, 0, len(props))
+	for k, v := range props {
+		sorted = append(sorted, AMF0Property{Key: k, Value: v})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
 
-			ret = append(ret, 0x02)
-			ret = append(ret, b...)
-			ret = append(ret, []byte(v)...)
+// appendStrictArray appends the strict array of values to b.
+func (e *amf0Encoder) appendStrictArray(b []byte, values []interface{}) ([]byte, error) {
+	if uint64(len(values)) > math.MaxUint32 {
+		return nil, fmt.Errorf("strict array too long: length: %d", len(values))
+	}
+	k, err := e.enter(values)
+	if err != nil {
+		return nil, err
+	}
+	defer e.leave(k)
+	b = append(b, amf0StrictArray)
+	b = appendUint32(b, uint32(len(values)))
+	for i, v := range values {
+		if b, err = e.appendValue(b, v); err != nil {
+			return nil, fmt.Errorf("%d: %s", i, err.Error())
+		}
+	}
+	return b, nil
+}
 
-		case AMF0Object: // 0x03
-			if b, err := v.MarshalBinary(); err == nil {
-				ret = append(ret, b...)
-			} else {
-				return nil, err
-			}
+// amf0Decoder decodes AMF0 values from r.
+type amf0Decoder struct {
+	r *valueReader
 
-		case nil: // 0x05
-			ret = append(ret, 0x05)
+	// Whether objects and ECMA arrays decode to the ordered types
+	ordered bool
 
-		default:
-			return nil, fmt.Errorf("rtmp: AMF0: AMF type not recognized: %s: %v", k, v)
-		}
+	// Complex values decoded so far, which reference markers index. Values
+	// still being decoded are nil, so a value referencing itself decodes
+	// to one holding nil instead of containing itself.
+	refs []interface{}
+}
+
+// next returns the following n bytes, which are only valid until the next
+// call.
+func (d *amf0Decoder) next(n int, what string) ([]byte, error) {
+	return d.r.next(n, "rtmp: AMF0", what)
+}
+
+func (d *amf0Decoder) uint16(what string) (uint16, error) {
+	b, err := d.next(2, what)
+	if err != nil {
+		return 0, err
 	}
-	ret = append(ret, 0x00, 0x00, 0x09) // Null key marker 0x00 0x00; End Object marker 0x09
+	return binary.BigEndian.Uint16(b), nil
+}
 
-	return ret, nil
+func (d *amf0Decoder) uint32(what string) (uint32, error) {
+	b, err := d.next(4, what)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
 }
 
-// UnmarshalBinary allows AMF0Object to the BinaryUnmarshaler interface.
-// It fills the fields of an existing AMF0Object with values parsed from a
-// byte slice, b.
-func (o *AMF0Object) UnmarshalBinary(b []byte) error {
-	i := 0
+func (d *amf0Decoder) float64(what string) (float64, error) {
+	b, err := d.next(8, what)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
 
-	// Ensure the first byte is the object start marker and skip it
-	if len(b) < 1 || b[i] != 0x03 { // Object start marker
-		return errors.New("rtmp: AMF0: Object binary must start with 0x03 object start marker")
+// utf8 decodes a string preceded by its 16 bit length.
+func (d *amf0Decoder) utf8(what string) (string, error) {
+	n, err := d.uint16(what + " size")
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(int(n), what)
+	if err != nil {
+		return "", err
 	}
-	i += 1
+	return string(b), nil
+}
 
-	// Ensure the last 3 bytes are null key marker (0x00 0x00) and object end marker (0x09)
-	if len(b) <= 3 || b[len(b)-3] != 0x00 || b[len(b)-2] != 0x00 || b[len(b)-1] != 0x09 {
-		return errors.New("rtmp: AMF0: Object binary must end with 0x00 0x00 0x09 null key marker; object end marker")
+// utf8Long decodes a string preceded by its 32 bit length.
+func (d *amf0Decoder) utf8Long(what string) (string, error) {
+	n, err := d.uint32(what + " size")
+	if err != nil {
+		return "", err
 	}
+	if err := d.r.fits(n, 1, "rtmp: AMF0", what); err != nil {
+		return "", err
+	}
+	b, err := d.next(int(n), what)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
-	for i < (len(b) - 3) { // Exclude null key marker (0x00 0x00) and object end marker (0x09)
-		if (i + 3) > len(b) {
-			return errors.New("rtmp: AMF0: message object does not have enough bytes for key size")
+// decodeValue decodes the next value, marker included.
+func (d *amf0Decoder) decodeValue() (interface{}, error) {
+	marker, err := d.next(1, "marker")
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(marker[0])
+}
+
+// decode decodes a value of the type of marker following the marker.
+func (d *amf0Decoder) decode(marker byte) (interface{}, error) {
+	switch marker {
+	case amf0Number:
+		return d.float64("number")
+
+	case amf0Boolean:
+		b, err := d.next(1, "boolean")
+		if err != nil {
+			return nil, err
 		}
-		if kSz := binary.BigEndian.Uint16(b[i : i+2]); kSz != 0 {
-			if (i + 2 + int(kSz)) > (len(b) - 3) {
-				return errors.New("rtmp: AMF0: message object does not have enough bytes for key")
+		return b[0] != 0x00, nil // boolean. 0x00 = false. everything else is true
+
+	case amf0String:
+		return d.utf8("string")
+
+	case amf0Object:
+		if d.ordered {
+			ref := len(d.refs)
+			d.refs = append(d.refs, nil)
+			props, err := d.nestedOrdered(false)
+			if err != nil {
+				return nil, err
 			}
-			k := string(b[i+2 : i+2+int(kSz)])
-			i = i + 2 + int(kSz)
-			if i > (len(b) - 3) {
-				return errors.New("rtmp: AMF0: message object does not have enough bytes for key type")
+			d.refs[ref] = AMF0OrderedObject(props)
+			return d.refs[ref], nil
+		}
+		ref := len(d.refs)
+		d.refs = append(d.refs, nil)
+		obj := AMF0Object{}
+		if err := d.nested(obj, false); err != nil {
+			return nil, err
+		}
+		d.refs[ref] = obj
+		return obj, nil
+
+	case amf0Null:
+		return nil, nil
+
+	case amf0Undefined:
+		return AMF0Undefined{}, nil
+
+	case amf0Reference:
+		ref, err := d.uint16("reference")
+		if err != nil {
+			return nil, err
+		}
+		if int(ref) >= len(d.refs) {
+			return nil, fmt.Errorf("rtmp: AMF0: reference %d out of range", ref)
+		}
+		return d.refs[ref], nil
+
+	case amf0ECMAArray:
+		// The count is only a hint, the array ends with the object end marker
+		if _, err := d.uint32("ECMA array count"); err != nil {
+			return nil, err
+		}
+		if d.ordered {
+			ref := len(d.refs)
+			d.refs = append(d.refs, nil)
+			props, err := d.nestedOrdered(true)
+			if err != nil {
+				return nil, err
 			}
-			switch b[i] {
-			case 0x00: // number
-				if (i + 9) > (len(b) - 3) {
-					return errors.New("rtmp: AMF0: number marker found without enough bytes for number")
-				}
-
-				num := math.Float64frombits(binary.BigEndian.Uint64(b[i+1 : i+9]))
-				(*o)[k] = num
-				i = i + 9 // 1 + 8
-
-			case 0x01: // boolean
-				if (i + 1) > (len(b) - 3) {
-					return errors.New("rtmp: AMF0: boolean marker found without enough bytes for boolean")
-				}
-
-				(*o)[k] = b[i+1] != 0x00 // boolean. 0x00 = false. everything else is true
-				i = i + 2                // 1 + 1
-
-			case 0x02: // string
-				if (i + 2) > (len(b) - 3) {
-					return errors.New("rtmp: AMF0: string marker found without enough bytes for string size")
-				}
-
-				strSz := binary.BigEndian.Uint16(b[i+1 : i+3])
-				if (i + 2 + int(strSz)) > (len(b) - 3) {
-					return errors.New("rtmp: AMF0: string marker and size forund without enough bytes for string")
-				}
-				str := string(b[i+3 : i+3+int(strSz)])
-				(*o)[k] = str
-				i = i + 3 + int(strSz) // 1 + 2
-
-			case 0x03: // object
-				if (i + 3) > (len(b) - 3) {
-					return errors.New("rtmp: AMF0: object marker found without enough bytes for object")
-				}
-
-				objSz, err := scanForAMF0ObjectEnd(b[i:])
-				if err != nil {
-					return err
-				}
-
-				obj := &AMF0Object{}
-				if err := obj.UnmarshalBinary(b[i : i+objSz]); err != nil {
-					return err
-				}
-				(*o)[k] = obj
-				i = i + objSz
-
-			case 0x05: // null marker
-				(*o)[k] = nil
-				i = i + 1
-
-			default:
-				return fmt.Errorf("rtmp: AMF0: unimplemented marker found: %v", b[i])
+			d.refs[ref] = AMF0OrderedECMAArray(props)
+			return d.refs[ref], nil
+		}
+		ref := len(d.refs)
+		d.refs = append(d.refs, nil)
+		arr := AMF0ECMAArray{}
+		if err := d.nested(arr, true); err != nil {
+			return nil, err
+		}
+		d.refs[ref] = arr
+		return arr, nil
+
+	case amf0StrictArray:
+		n, err := d.uint32("strict array count")
+		if err != nil {
+			return nil, err
+		}
+		// Every value takes at least a byte
+		if err := d.r.fits(n, 1, "rtmp: AMF0", "strict array"); err != nil {
+			return nil, err
+		}
+		if err := d.r.enter("rtmp: AMF0"); err != nil {
+			return nil, err
+		}
+		defer d.r.leave()
+		ref := len(d.refs)
+		d.refs = append(d.refs, nil)
+		arr := make(AMF0StrictArray, 0, initialCap(int(n)))
+		for j := uint32(0); j < n; j++ {
+			v, err := d.decodeValue()
+			if err != nil {
+				return nil, err
 			}
-		} else { // null key sigil
-			i += 2 // TODO: ? I guess you can have a null key and continue the object?
+			arr = append(arr, v)
+		}
+		d.refs[ref] = arr
+		return arr, nil
+
+	case amf0Date:
+		ms, err := d.float64("date")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := d.uint16("date time zone"); err != nil { // reserved
+			return nil, err
+		}
+		whole, frac := math.Modf(ms)
+		nsec := int64(whole)%1000*int64(time.Millisecond) + int64(frac*float64(time.Millisecond))
+		return time.Unix(int64(whole)/1000, nsec), nil
+
+	case amf0LongString:
+		return d.utf8Long("long string")
+
+	case amf0XMLDocument:
+		s, err := d.utf8Long("XML document")
+		return AMF0XMLDocument(s), err
+
+	case amf0TypedObject:
+		name, err := d.utf8("class name")
+		if err != nil {
+			return nil, err
 		}
+		ref := len(d.refs)
+		d.refs = append(d.refs, nil)
+		obj := AMF0TypedObject{ClassName: name, Object: AMF0Object{}}
+		if err := d.nested(obj.Object, false); err != nil {
+			return nil, err
+		}
+		d.refs[ref] = obj
+		return obj, nil
+
+	case amf0AVMPlus:
+		// The AMF3 value has reference tables of its own
+		v, err := (&amf3Decoder{r: d.r}).decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		return AMF0AVMPlus{Value: v}, nil
+
+	default:
+		return nil, fmt.Errorf("rtmp: AMF0: unimplemented marker found: %v", marker)
 	}
-	return nil
 }
 
-// scanForAMF0ObjectEnd is a recursive scan for the end of the object.
-// TODO: optimize this.
-func scanForAMF0ObjectEnd(b []byte) (int, error) {
-	i := 0
+// nested decodes the properties of an object or ECMA array nested one level
+// deeper.
+func (d *amf0Decoder) nested(props map[string]interface{}, endOptional bool) error {
+	if err := d.r.enter("rtmp: AMF0"); err != nil {
+		return err
+	}
+	defer d.r.leave()
+	return d.decodeProperties(props, endOptional)
+}
 
-	// Ensure object start marker and skip it
-	if len(b) < 1 || b[i] != 0x03 { // object start marker
-		return 0, errors.New("rtmp: AMF0: object must start with object start marker 0x03")
+// nestedOrdered is like nested but returns the properties in order.
+func (d *amf0Decoder) nestedOrdered(endOptional bool) ([]AMF0Property, error) {
+	if err := d.r.enter("rtmp: AMF0"); err != nil {
+		return nil, err
 	}
-	i += 1
+	defer d.r.leave()
+	return d.decodeOrderedProperties(endOptional)
+}
 
-	for i < len(b) {
-		if (i + 3) > len(b) {
-			return 0, errors.New("rtmp: AMF0: message object does not have enough bytes for key size")
+// decodeProperties decodes key value pairs into props up to and including
+// the empty key and object end marker. If endOptional is set, as some
+// encoders leave it off ECMA arrays, the input may end instead.
+func (d *amf0Decoder) decodeProperties(props map[string]interface{}, endOptional bool) error {
+	return d.eachProperty(endOptional, func(k string, v interface{}) {
+		props[k] = v
+	})
+}
+
+// decodeOrderedProperties is like decodeProperties but returns the key value
+// pairs in order.
+func (d *amf0Decoder) decodeOrderedProperties(endOptional bool) ([]AMF0Property, error) {
+	props := []AMF0Property{}
+	err := d.eachProperty(endOptional, func(k string, v interface{}) {
+		props = append(props, AMF0Property{Key: k, Value: v})
+	})
+	return props, err
+}
+
+// eachProperty decodes key value pairs, passing each to add, as
+// decodeProperties describes.
+func (d *amf0Decoder) eachProperty(endOptional bool, add func(k string, v interface{})) error {
+	for {
+		k, err := d.key(endOptional)
+		if err == io.EOF {
+			return nil
 		}
-		if kSz := binary.BigEndian.Uint16(b[i : i+2]); kSz != 0 {
-			if (i + 2 + int(kSz)) > (len(b) - 3) {
-				return 0, errors.New("rtmp: AMF0: message object does not have enough bytes for key")
-			}
-			i = i + 2 + int(kSz)
-			if i > (len(b) - 3) {
-				return 0, errors.New("rtmp: AMF0: message object does not have enough bytes for key type")
-			}
-			switch b[i] {
-			case 0x00: // number
-				if (i + 9) > (len(b) - 3) {
-					return 0, errors.New("rtmp: AMF0: number marker found without enough bytes for number")
-				}
-				i = i + 8 + 1
-
-			case 0x01: // boolean
-				if (i + 1) > (len(b) - 3) {
-					return 0, errors.New("rtmp: AMF0: boolean marker found without enough bytes for boolean")
-				}
-				i = i + 1 + 1
-
-			case 0x02: // string
-				if (i + 2) > (len(b) - 3) {
-					return 0, errors.New("rtmp: AMF0: string marker found without enough bytes for string size")
-				}
-
-				strSz := binary.BigEndian.Uint16(b[i+1 : i+3])
-				if (i + 2 + int(strSz)) > (len(b) - 3) {
-					return 0, errors.New("rtmp: AMF0: string marker and size forund without enough bytes for string")
-				}
-				i = i + 2 + int(strSz) + 1
-
-			case 0x03: // object
-				if (i + 3) > (len(b) - 3) {
-					return 0, errors.New("rtmp: AMF0: object marker found without enough bytes for object")
-				}
-
-				offset, err := scanForAMF0ObjectEnd(b[i:])
-				if err != nil {
-					return 0, err
-				}
-				i = i + offset + 1
-
-			case 0x05: // null marker
-				i = i + 1
-
-			default:
-				return 0, fmt.Errorf("rtmp: AMF0: unimplemented marker found: %v", b[i])
+		if err != nil {
+			return err
+		}
+		if k == "" {
+			end, err := d.next(1, "object end marker")
+			if err != nil {
+				return err
 			}
-		} else { // null key sigil
-			i += 2
-			if b[i] == 0x09 {
-				i += 1
-				return i, nil
+			if end[0] != amf0ObjectEnd {
+				return fmt.Errorf("rtmp: AMF0: expected object end marker, got: %v", end[0])
 			}
+			return nil
 		}
+		v, err := d.decodeValue()
+		if err != nil {
+			return err
+		}
+		add(k, v)
+	}
+}
+
+// key decodes the key of a property. If endOptional is set it returns io.EOF
+// if the input ends first.
+func (d *amf0Decoder) key(endOptional bool) (string, error) {
+	if !endOptional {
+		return d.utf8("key")
+	}
+	b, err := d.r.nextOrEOF(2, "rtmp: AMF0", "key size")
+	if err != nil {
+		return "", err
+	}
+	if b, err = d.next(int(binary.BigEndian.Uint16(b)), "key"); err != nil {
+		return "", err
 	}
-	return 0, errors.New("rtmp: AMF0: no object end found")
+	return string(b), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
 }
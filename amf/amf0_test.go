@@ -0,0 +1,265 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	obj := AMF0Object{"app": "live", "audio": true}
+	date := time.Unix(1600000000, 123*int64(time.Millisecond))
+
+	tests := []struct {
+		name   string
+		in     interface{}
+		marker byte
+		want   interface{} // in if nil
+	}{
+		{"number", 1.5, amf0Number, nil},
+		{"boolean false", false, amf0Boolean, nil},
+		{"boolean true", true, amf0Boolean, nil},
+		{"string", "connect", amf0String, nil},
+		{"empty string", "", amf0String, nil},
+		{"string 65535 bytes", strings.Repeat("a", 65535), amf0String, nil},
+		{"long string 65536 bytes", strings.Repeat("a", 65536), amf0LongString, nil},
+		{"object", obj, amf0Object, nil},
+		{"empty object", AMF0Object{}, amf0Object, nil},
+		{"nested object", AMF0Object{"o": AMF0Object{"n": 2.0}}, amf0Object, nil},
+		{"ordered object", AMF0OrderedObject{{"level", "status"}, {"code", "NetStream.Play.Start"}}, amf0Object,
+			AMF0Object{"level": "status", "code": "NetStream.Play.Start"}},
+		{"null", nil, amf0Null, nil},
+		{"undefined", AMF0Undefined{}, amf0Undefined, nil},
+		{"ECMA array", AMF0ECMAArray{"duration": 0.0, "width": 1280.0}, amf0ECMAArray, nil},
+		{"empty ECMA array", AMF0ECMAArray{}, amf0ECMAArray, nil},
+		{"strict array", AMF0StrictArray{1.0, "two", nil}, amf0StrictArray, nil},
+		{"slice", []interface{}{1.0}, amf0StrictArray, AMF0StrictArray{1.0}},
+		{"date", date, amf0Date, nil},
+		{"XML document", AMF0XMLDocument("<a/>"), amf0XMLDocument, nil},
+		{"typed object", AMF0TypedObject{ClassName: "flash.geom.Point", Object: AMF0Object{"x": 1.0, "y": 2.0}}, amf0TypedObject, nil},
+		{"AVM+ switch", AMF0AVMPlus{Value: AMF3Array{Dense: []interface{}{1, "a"}}}, amf0AVMPlus, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := AMF0Msg{0: tt.in}
+			b, err := in.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if b[0] != tt.marker {
+				t.Errorf("marker = %#x, want %#x", b[0], tt.marker)
+			}
+			got := AMF0Msg{}
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.in
+			}
+			if !reflect.DeepEqual(got, AMF0Msg{0: want}) {
+				t.Errorf("got %#v, want %#v", got[0], want)
+			}
+		})
+	}
+}
+
+func TestAMF0Reference(t *testing.T) {
+	// References count the complex values of the message in the order they
+	// start, so the nested object is 1 and the strict array 2
+	inner := AMF0Object{"n": 1.0}
+	in := AMF0Msg{
+		0: AMF0Object{"inner": inner},
+		1: AMF0StrictArray{AMF0Reference(1)},
+		2: AMF0Reference(0),
+		3: AMF0Reference(2),
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := AMF0Msg{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	want := AMF0Msg{
+		0: AMF0Object{"inner": inner},
+		1: AMF0StrictArray{inner},
+		2: AMF0Object{"inner": inner},
+		3: AMF0StrictArray{inner},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	if err := (&AMF0Msg{}).UnmarshalBinary([]byte{amf0Reference, 0x00, 0x00}); err == nil {
+		t.Error("reference to nothing decoded")
+	}
+}
+
+func TestAMF0SelfReference(t *testing.T) {
+	// Each value has property a referencing the value itself, which decodes
+	// as null rather than a value containing itself
+	tests := []struct {
+		name    string
+		in      []byte
+		want    interface{}
+		ordered interface{}
+	}{
+		{"object", []byte{amf0Object, 0x00, 0x01, 'a', amf0Reference, 0x00, 0x00, 0x00, 0x00, amf0ObjectEnd},
+			AMF0Object{"a": nil}, AMF0OrderedObject{{"a", nil}}},
+		{"ECMA array", []byte{amf0ECMAArray, 0, 0, 0, 1, 0x00, 0x01, 'a', amf0Reference, 0x00, 0x00, 0x00, 0x00, amf0ObjectEnd},
+			AMF0ECMAArray{"a": nil}, AMF0OrderedECMAArray{{"a", nil}}},
+		{"typed object", []byte{amf0TypedObject, 0x00, 0x01, 'T', 0x00, 0x01, 'a', amf0Reference, 0x00, 0x00, 0x00, 0x00, amf0ObjectEnd},
+			AMF0TypedObject{ClassName: "T", Object: AMF0Object{"a": nil}}, nil},
+		{"strict array", []byte{amf0StrictArray, 0, 0, 0, 1, amf0Reference, 0x00, 0x00},
+			AMF0StrictArray{nil}, AMF0StrictArray{nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AMF0Msg{}
+			if err := got.UnmarshalBinary(tt.in); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("got %v, want %v", got[0], tt.want)
+			}
+			if _, err := got.MarshalBinary(); err != nil {
+				t.Errorf("MarshalBinary: %v", err)
+			}
+
+			if tt.ordered == nil {
+				return
+			}
+			d := NewDecoder(bytes.NewReader(tt.in))
+			d.Ordered = true
+			v, err := d.Decode()
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !reflect.DeepEqual(v, tt.ordered) {
+				t.Errorf("ordered got %v, want %v", v, tt.ordered)
+			}
+		})
+	}
+
+	obj := AMF0Object{}
+	if err := obj.UnmarshalBinary(tests[0].in); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(obj, tests[0].want) {
+		t.Errorf("AMF0Object got %v, want %v", obj, tests[0].want)
+	}
+}
+
+func TestAMF0EncodeCycle(t *testing.T) {
+	obj := AMF0Object{}
+	obj["a"] = obj
+	typed := AMF0TypedObject{ClassName: "T", Object: AMF0Object{}}
+	typed.Object["a"] = typed
+	arr := AMF0StrictArray{nil}
+	arr[0] = arr
+	ordered := AMF0OrderedObject{{"a", nil}}
+	ordered[0].Value = ordered
+	dense := AMF3Array{Dense: []interface{}{nil}}
+	dense.Dense[0] = dense
+	values := AMF3Object{Dynamic: true, Values: map[string]interface{}{}}
+	values.Values["a"] = values
+
+	tests := []struct {
+		name string
+		in   interface{}
+	}{
+		{"object", obj},
+		{"object through ECMA array", AMF0Object{"a": AMF0ECMAArray(obj)}},
+		{"typed object", typed},
+		{"strict array", arr},
+		{"ordered object", ordered},
+		{"AMF3 array", AMF0AVMPlus{Value: dense}},
+		{"AMF3 object", AMF0AVMPlus{Value: values}},
+	}
+	for _, tt := range tests {
+		if _, err := (&AMF0Msg{0: tt.in}).MarshalBinary(); err == nil {
+			t.Errorf("%s: value containing itself encoded", tt.name)
+		}
+	}
+
+	// Values seen twice side by side are not cycles
+	inner := AMF0Object{"n": 1.0}
+	if _, err := (&AMF0Msg{0: AMF0StrictArray{inner, inner}}).MarshalBinary(); err != nil {
+		t.Errorf("repeated value: %v", err)
+	}
+	// Nor are empty values nested in each other
+	nested := AMF3Array{Dense: []interface{}{AMF3Array{Dense: []interface{}{}}}}
+	if _, err := (&AMF0Msg{0: AMF0AVMPlus{Value: nested}}).MarshalBinary(); err != nil {
+		t.Errorf("nested empty values: %v", err)
+	}
+}
+
+func TestAMF0ECMAArrayEnd(t *testing.T) {
+	withEnd := []byte{
+		amf0ECMAArray, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, 'a', amf0Number, 0x3F, 0xF0, 0, 0, 0, 0, 0, 0,
+		0x00, 0x00, amf0ObjectEnd,
+	}
+	want := AMF0Msg{0: AMF0ECMAArray{"a": 1.0}}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"with end marker", withEnd},
+		// Some encoders leave the end marker out at the end of a message
+		{"without end marker", withEnd[:len(withEnd)-3]},
+		// The count is only a hint
+		{"wrong count", append([]byte{amf0ECMAArray, 0x00, 0x00, 0x00, 0x07}, withEnd[5:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AMF0Msg{}
+			if err := got.UnmarshalBinary(tt.b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %#v, want %#v", got, want)
+			}
+			b, err := got.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if !bytes.Equal(b, withEnd) {
+				t.Errorf("encoded % x, want % x", b, withEnd)
+			}
+		})
+	}
+
+	// Objects must end with the marker
+	obj := append([]byte{amf0Object}, withEnd[5:len(withEnd)-3]...)
+	if err := (&AMF0Msg{}).UnmarshalBinary(obj); err == nil {
+		t.Error("object without end marker decoded")
+	}
+}
+
+func TestAMF0Ordered(t *testing.T) {
+	in := AMF0Msg{
+		0: AMF0OrderedObject{{"z", 1.0}, {"a", 2.0}},
+		1: AMF0OrderedECMAArray{{"z", 1.0}, {"a", 2.0}},
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(bytes.NewReader(b))
+	d.Ordered = true
+	for i := 0; i < len(in); i++ {
+		v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, in[i]) {
+			t.Errorf("value %d = %#v, want %#v", i, v, in[i])
+		}
+	}
+}
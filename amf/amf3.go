@@ -0,0 +1,936 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// AMF3 type markers
+const (
+	amf3Undefined    = 0x00
+	amf3Null         = 0x01
+	amf3False        = 0x02
+	amf3True         = 0x03
+	amf3Integer      = 0x04
+	amf3Double       = 0x05
+	amf3String       = 0x06
+	amf3XMLDocument  = 0x07
+	amf3Date         = 0x08
+	amf3Array        = 0x09
+	amf3Object       = 0x0A
+	amf3XML          = 0x0B
+	amf3ByteArray    = 0x0C
+	amf3VectorInt    = 0x0D
+	amf3VectorUint   = 0x0E
+	amf3VectorDouble = 0x0F
+	amf3VectorObject = 0x10
+	amf3Dictionary   = 0x11
+)
+
+// Range of the 29 bit signed integers of AMF3
+const (
+	amf3IntMin = -1 << 28
+	amf3IntMax = 1<<28 - 1
+)
+
+// AMF3Msg is a sequence of AMF3 values keyed by their position, as carried by
+// AMF3 data and command messages. Every value is encoded with its own string,
+// object and trait reference tables, the way values following an AMF0 AVM+
+// marker are.
+//
+// Values are decoded to and encoded from the following Go types:
+//
+//	undefined      AMF0Undefined
+//	null           nil
+//	false, true    bool
+//	integer        int; ints out of the 29 bit range encode as doubles
+//	double         float64
+//	string         string
+//	XML document   AMF0XMLDocument
+//	date           time.Time
+//	array          AMF3Array, or []interface{} when encoding
+//	object         AMF3Object
+//	XML            AMF3XML
+//	byte array     []byte
+//	vectors        []int32, []uint32, []float64 and AMF3VectorObject
+//	dictionary     AMF3Dictionary
+//
+// Externalizable objects only decode for the flex.messaging.io classes
+// ArrayCollection and ObjectProxy, whose external form is a single value.
+type AMF3Msg map[int]interface{}
+
+// AMF3Array is an AMF3 array with its dense, ordinal, part and its
+// associative part, which is usually empty.
+type AMF3Array struct {
+	Dense []interface{}
+	Assoc map[string]interface{}
+}
+
+// AMF3Object is an AMF3 object. The traits of the object are its class name,
+// an empty ClassName for anonymous objects, the names of its sealed members and
+// whether it is dynamic. Values holds the sealed members and, for dynamic
+// objects, any other members.
+//
+// For externalizable classes Externalized holds the value the object wrote
+// instead of members.
+type AMF3Object struct {
+	ClassName    string
+	Sealed       []string
+	Dynamic      bool
+	Values       map[string]interface{}
+	Externalized interface{}
+}
+
+// AMF3XML is an AMF3 E4X XML value, held as its XML text. XML documents use
+// AMF0XMLDocument as in AMF0.
+type AMF3XML string
+
+// AMF3VectorObject is an AMF3 vector of objects of the class TypeName, the
+// empty string for Object.
+type AMF3VectorObject struct {
+	TypeName string
+	Fixed    bool
+	Values   []interface{}
+}
+
+// AMF3Dictionary is an AMF3 dictionary. Its keys are values of any type, so
+// its entries are kept in order.
+type AMF3Dictionary struct {
+	WeakKeys bool
+	Entries  []AMF3DictionaryEntry
+}
+
+// AMF3DictionaryEntry is a single key value pair of an AMF3Dictionary.
+type AMF3DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// externalizable lists the externalizable classes which can be decoded. All
+// of them write a single AMF3 value.
+var externalizable = map[string]bool{
+	"flex.messaging.io.ArrayCollection": true,
+	"flex.messaging.io.ObjectProxy":     true,
+}
+
+// MarshalBinary allows AMF3Msg to adhere to the BinaryMarshaler interface.
+func (m *AMF3Msg) MarshalBinary() ([]byte, error) {
+	var ret []byte
+	for i := 0; i < len(*m); i++ {
+		v, ok := (*m)[i]
+		if !ok {
+			return nil, fmt.Errorf("rtmp: AMF3: AMF messages must have contiguous key indexs. %d does not exist", i)
+		}
+		var err error
+		if ret, err = appendAMF3Value(ret, v); err != nil {
+			return nil, fmt.Errorf("rtmp: AMF3: value %d: %s", i, err.Error())
+		}
+	}
+	return ret, nil
+}
+
+// UnmarshalBinary allows AMF3Msg to adhere to the BinaryUnmarshaler interface.
+// It fills the fields of an existing AMF3Msg with values parsed from b.
+func (m *AMF3Msg) UnmarshalBinary(b []byte) error {
+	r := newBytesReader(b)
+	for k := 0; ; k++ {
+		marker, err := r.nextOrEOF(1, "rtmp: AMF3", "marker")
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Every value has reference tables of its own
+		d := &amf3Decoder{r: r}
+		if (*m)[k], err = d.decode(marker[0]); err != nil {
+			return err
+		}
+	}
+}
+
+// amf3Traits are the traits of an AMF3 object.
+type amf3Traits struct {
+	className      string
+	sealed         []string
+	dynamic        bool
+	externalizable bool
+}
+
+// amf3Decoder decodes AMF3 values from r.
+type amf3Decoder struct {
+	r *valueReader
+
+	// Reference tables of the strings, complex values and object traits
+	// decoded so far
+	strings []string
+	objects []interface{}
+	traits  []*amf3Traits
+}
+
+func (d *amf3Decoder) next(n int, what string) ([]byte, error) {
+	return d.r.next(n, "rtmp: AMF3", what)
+}
+
+// u29 decodes a variable length unsigned 29 bit integer.
+func (d *amf3Decoder) u29(what string) (uint32, error) {
+	var v uint32
+	for j := 0; j < 4; j++ {
+		b, err := d.next(1, what)
+		if err != nil {
+			return 0, err
+		}
+		if j == 3 {
+			// The fourth byte contributes all 8 bits
+			return v<<8 | uint32(b[0]), nil
+		}
+		v = v<<7 | uint32(b[0]&0x7F)
+		if b[0]&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return v, nil
+}
+
+// count decodes the length of a value of elements taking at least min bytes
+// each, checking the value may take that many bytes.
+func (d *amf3Decoder) count(n uint32, min int, what string) (int, error) {
+	if err := d.r.fits(n, min, "rtmp: AMF3", what); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// header decodes the U29 header of a value which may be sent by reference.
+// If the value is a reference, ref is set with its index, otherwise the
+// remaining bits are returned in v.
+func (d *amf3Decoder) header(what string) (v uint32, ref int, isRef bool, err error) {
+	h, err := d.u29(what + " header")
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if h&1 == 0 {
+		return 0, int(h >> 1), true, nil
+	}
+	return h >> 1, 0, false, nil
+}
+
+// object returns the complex value at index ref of the reference table.
+func (d *amf3Decoder) object(ref int) (interface{}, error) {
+	if ref >= len(d.objects) {
+		return nil, fmt.Errorf("rtmp: AMF3: object reference %d out of range", ref)
+	}
+	return d.objects[ref], nil
+}
+
+// string decodes a string or a reference to an earlier one.
+func (d *amf3Decoder) string() (string, error) {
+	n, ref, isRef, err := d.header("string")
+	if err != nil {
+		return "", err
+	}
+	if isRef {
+		if ref >= len(d.strings) {
+			return "", fmt.Errorf("rtmp: AMF3: string reference %d out of range", ref)
+		}
+		return d.strings[ref], nil
+	}
+	b, err := d.next(int(n), "string")
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	if s != "" { // The empty string is never sent by reference
+		d.strings = append(d.strings, s)
+	}
+	return s, nil
+}
+
+// decodeValue decodes the next value, marker included.
+func (d *amf3Decoder) decodeValue() (interface{}, error) {
+	marker, err := d.next(1, "marker")
+	if err != nil {
+		return nil, err
+	}
+	return d.decode(marker[0])
+}
+
+// decode decodes a value of the type of marker following the marker.
+func (d *amf3Decoder) decode(marker byte) (interface{}, error) {
+	switch marker {
+	case amf3Undefined:
+		return AMF0Undefined{}, nil
+
+	case amf3Null:
+		return nil, nil
+
+	case amf3False:
+		return false, nil
+
+	case amf3True:
+		return true, nil
+
+	case amf3Integer:
+		v, err := d.u29("integer")
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend the 29 bits
+		return int(int32(v<<3) >> 3), nil
+
+	case amf3Double:
+		return d.float64("double")
+
+	case amf3String:
+		return d.string()
+
+	case amf3XMLDocument, amf3XML:
+		n, ref, isRef, err := d.header("XML")
+		if err != nil {
+			return nil, err
+		}
+		if isRef {
+			return d.object(ref)
+		}
+		b, err := d.next(int(n), "XML")
+		if err != nil {
+			return nil, err
+		}
+		var v interface{} = AMF0XMLDocument(b)
+		if marker == amf3XML {
+			v = AMF3XML(b)
+		}
+		d.objects = append(d.objects, v)
+		return v, nil
+
+	case amf3Date:
+		_, ref, isRef, err := d.header("date")
+		if err != nil {
+			return nil, err
+		}
+		if isRef {
+			return d.object(ref)
+		}
+		ms, err := d.float64("date")
+		if err != nil {
+			return nil, err
+		}
+		whole, frac := math.Modf(ms)
+		nsec := int64(whole)%1000*int64(time.Millisecond) + int64(frac*float64(time.Millisecond))
+		t := time.Unix(int64(whole)/1000, nsec)
+		d.objects = append(d.objects, t)
+		return t, nil
+
+	case amf3Array:
+		return d.array()
+
+	case amf3Object:
+		return d.decodeObject()
+
+	case amf3ByteArray:
+		n, ref, isRef, err := d.header("byte array")
+		if err != nil {
+			return nil, err
+		}
+		if isRef {
+			return d.object(ref)
+		}
+		b, err := d.next(int(n), "byte array")
+		if err != nil {
+			return nil, err
+		}
+		v := append([]byte(nil), b...)
+		d.objects = append(d.objects, v)
+		return v, nil
+
+	case amf3VectorInt, amf3VectorUint, amf3VectorDouble, amf3VectorObject:
+		return d.vector(marker)
+
+	case amf3Dictionary:
+		return d.dictionary()
+
+	default:
+		return nil, fmt.Errorf("rtmp: AMF3: unimplemented marker found: %v", marker)
+	}
+}
+
+func (d *amf3Decoder) float64(what string) (float64, error) {
+	b, err := d.next(8, what)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+// array decodes an array following its marker.
+func (d *amf3Decoder) array() (interface{}, error) {
+	n, ref, isRef, err := d.header("array")
+	if err != nil {
+		return nil, err
+	}
+	if isRef {
+		return d.object(ref)
+	}
+	if err := d.r.enter("rtmp: AMF3"); err != nil {
+		return nil, err
+	}
+	defer d.r.leave()
+	arr := &AMF3Array{}
+	ref = len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	// The associative part comes first and ends with the empty string
+	for {
+		k, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		if k == "" {
+			break
+		}
+		if arr.Assoc == nil {
+			arr.Assoc = make(map[string]interface{})
+		}
+		if arr.Assoc[k], err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+	}
+
+	count, err := d.count(n, 1, "array")
+	if err != nil {
+		return nil, err
+	}
+	if arr.Dense, err = d.values(count); err != nil {
+		return nil, err
+	}
+	d.objects[ref] = *arr
+	return *arr, nil
+}
+
+// decodeObject decodes an object following its marker.
+func (d *amf3Decoder) decodeObject() (interface{}, error) {
+	h, ref, isRef, err := d.header("object")
+	if err != nil {
+		return nil, err
+	}
+	if isRef {
+		return d.object(ref)
+	}
+
+	var traits *amf3Traits
+	if h&1 == 0 { // Traits reference
+		ref := int(h >> 1)
+		if ref >= len(d.traits) {
+			return nil, fmt.Errorf("rtmp: AMF3: traits reference %d out of range", ref)
+		}
+		traits = d.traits[ref]
+	} else {
+		traits = &amf3Traits{
+			externalizable: h&2 != 0,
+			dynamic:        h&4 != 0,
+		}
+		if traits.className, err = d.string(); err != nil {
+			return nil, err
+		}
+		count, err := d.count(h>>3, 1, "sealed members")
+		if err != nil {
+			return nil, err
+		}
+		traits.sealed = make([]string, 0, initialCap(count))
+		for j := 0; j < count; j++ {
+			k, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			traits.sealed = append(traits.sealed, k)
+		}
+		d.traits = append(d.traits, traits)
+	}
+
+	if err := d.r.enter("rtmp: AMF3"); err != nil {
+		return nil, err
+	}
+	defer d.r.leave()
+	obj := AMF3Object{
+		ClassName: traits.className,
+		Sealed:    traits.sealed,
+		Dynamic:   traits.dynamic,
+	}
+	ref = len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	if traits.externalizable {
+		if !externalizable[traits.className] {
+			return nil, fmt.Errorf("rtmp: AMF3: externalizable class not supported: %q", traits.className)
+		}
+		if obj.Externalized, err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+		d.objects[ref] = obj
+		return obj, nil
+	}
+
+	obj.Values = make(map[string]interface{})
+	for _, k := range traits.sealed {
+		if obj.Values[k], err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+	}
+	if traits.dynamic {
+		// Dynamic members end with the empty string
+		for {
+			k, err := d.string()
+			if err != nil {
+				return nil, err
+			}
+			if k == "" {
+				break
+			}
+			if obj.Values[k], err = d.decodeValue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.objects[ref] = obj
+	return obj, nil
+}
+
+// vector decodes a vector of the type of marker following the marker.
+func (d *amf3Decoder) vector(marker byte) (interface{}, error) {
+	n, ref, isRef, err := d.header("vector")
+	if err != nil {
+		return nil, err
+	}
+	if isRef {
+		return d.object(ref)
+	}
+	b, err := d.next(1, "vector fixed flag")
+	if err != nil {
+		return nil, err
+	}
+	fixed := b[0] != 0
+
+	var v interface{}
+	switch marker {
+	case amf3VectorInt, amf3VectorUint:
+		count, err := d.count(n, 4, "vector")
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(count*4, "vector")
+		if err != nil {
+			return nil, err
+		}
+		if marker == amf3VectorInt {
+			vec := make([]int32, count)
+			for j := range vec {
+				vec[j] = int32(binary.BigEndian.Uint32(b[j*4:]))
+			}
+			v = vec
+		} else {
+			vec := make([]uint32, count)
+			for j := range vec {
+				vec[j] = binary.BigEndian.Uint32(b[j*4:])
+			}
+			v = vec
+		}
+		d.objects = append(d.objects, v)
+
+	case amf3VectorDouble:
+		count, err := d.count(n, 8, "vector")
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(count*8, "vector")
+		if err != nil {
+			return nil, err
+		}
+		vec := make([]float64, count)
+		for j := range vec {
+			vec[j] = math.Float64frombits(binary.BigEndian.Uint64(b[j*8:]))
+		}
+		v = vec
+		d.objects = append(d.objects, v)
+
+	default:
+		vec := AMF3VectorObject{Fixed: fixed}
+		if vec.TypeName, err = d.string(); err != nil {
+			return nil, err
+		}
+		count, err := d.count(n, 1, "vector")
+		if err != nil {
+			return nil, err
+		}
+		if err := d.r.enter("rtmp: AMF3"); err != nil {
+			return nil, err
+		}
+		defer d.r.leave()
+		ref := len(d.objects)
+		d.objects = append(d.objects, nil)
+		if vec.Values, err = d.values(count); err != nil {
+			return nil, err
+		}
+		v = vec
+		d.objects[ref] = v
+	}
+	return v, nil
+}
+
+// dictionary decodes a dictionary following its marker.
+func (d *amf3Decoder) dictionary() (interface{}, error) {
+	n, ref, isRef, err := d.header("dictionary")
+	if err != nil {
+		return nil, err
+	}
+	if isRef {
+		return d.object(ref)
+	}
+	weak, err := d.next(1, "dictionary weak keys flag")
+	if err != nil {
+		return nil, err
+	}
+	dict := AMF3Dictionary{WeakKeys: weak[0] != 0}
+	count, err := d.count(n, 2, "dictionary")
+	if err != nil {
+		return nil, err
+	}
+	if err := d.r.enter("rtmp: AMF3"); err != nil {
+		return nil, err
+	}
+	defer d.r.leave()
+	dict.Entries = make([]AMF3DictionaryEntry, 0, initialCap(count))
+	ref = len(d.objects)
+	d.objects = append(d.objects, nil)
+	for j := 0; j < count; j++ {
+		var entry AMF3DictionaryEntry
+		if entry.Key, err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+		if entry.Value, err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+		dict.Entries = append(dict.Entries, entry)
+	}
+	d.objects[ref] = dict
+	return dict, nil
+}
+
+// values decodes count values in a row.
+func (d *amf3Decoder) values(count int) ([]interface{}, error) {
+	values := make([]interface{}, 0, initialCap(count))
+	for j := 0; j < count; j++ {
+		v, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// appendAMF3Value appends the AMF3 encoding of v, marker included, to b.
+// Strings are sent by reference when repeated within v; complex values and
+// traits are always sent in full, so values containing themselves cannot be
+// encoded and return an error.
+func appendAMF3Value(b []byte, v interface{}) ([]byte, error) {
+	e := &amf3Encoder{strings: make(map[string]int)}
+	return e.appendValue(b, v)
+}
+
+// amf3Encoder encodes AMF3 values, keeping the string reference table and
+// track of the complex values it is inside of.
+type amf3Encoder struct {
+	strings  map[string]int
+	visiting marshalState
+}
+
+// enter marks the map or slice c as being encoded, failing if it already is.
+// Every successful call must be matched by a call to leave.
+func (e *amf3Encoder) enter(c interface{}) (visit, error) {
+	return e.visiting.enter(reflect.ValueOf(c))
+}
+
+func (e *amf3Encoder) leave(k visit) {
+	e.visiting.leave(k)
+}
+
+func (e *amf3Encoder) appendValue(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case AMF0Undefined:
+		return append(b, amf3Undefined), nil
+
+	case nil:
+		return append(b, amf3Null), nil
+
+	case bool:
+		if v {
+			return append(b, amf3True), nil
+		}
+		return append(b, amf3False), nil
+
+	case int:
+		if v < amf3IntMin || v > amf3IntMax {
+			return e.appendValue(b, float64(v))
+		}
+		return appendU29(append(b, amf3Integer), uint32(v)&0x1FFFFFFF)
+
+	case float64:
+		b = append(b, amf3Double)
+		return appendUint64(b, math.Float64bits(v)), nil
+
+	case string:
+		return e.appendString(append(b, amf3String), v)
+
+	case AMF0XMLDocument:
+		return appendAMF3Bytes(append(b, amf3XMLDocument), []byte(v))
+
+	case AMF3XML:
+		return appendAMF3Bytes(append(b, amf3XML), []byte(v))
+
+	case time.Time:
+		b = append(b, amf3Date, 0x01) // Not a reference
+		ms := float64(v.UnixNano()) / float64(time.Millisecond)
+		return appendUint64(b, math.Float64bits(ms)), nil
+
+	case []interface{}:
+		return e.appendValue(b, AMF3Array{Dense: v})
+
+	case AMF3Array:
+		dense, err := e.enter(v.Dense)
+		if err != nil {
+			return nil, err
+		}
+		defer e.leave(dense)
+		assoc, err := e.enter(v.Assoc)
+		if err != nil {
+			return nil, err
+		}
+		defer e.leave(assoc)
+		if b, err = appendU29Header(append(b, amf3Array), len(v.Dense)); err != nil {
+			return nil, err
+		}
+		for k, val := range v.Assoc {
+			if k == "" {
+				return nil, errors.New("AMF3 array keys must not be empty")
+			}
+			if b, err = e.appendString(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = e.appendValue(b, val); err != nil {
+				return nil, err
+			}
+		}
+		b = append(b, 0x01) // The empty string ends the associative part
+		for _, val := range v.Dense {
+			if b, err = e.appendValue(b, val); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case AMF3Object:
+		return e.appendObject(append(b, amf3Object), v)
+
+	case []byte:
+		return appendAMF3Bytes(append(b, amf3ByteArray), v)
+
+	case []int32:
+		if b, err = appendU29Header(append(b, amf3VectorInt), len(v)); err != nil {
+			return nil, err
+		}
+		b = append(b, 0x00) // Not fixed length
+		for _, n := range v {
+			b = appendUint32(b, uint32(n))
+		}
+		return b, nil
+
+	case []uint32:
+		if b, err = appendU29Header(append(b, amf3VectorUint), len(v)); err != nil {
+			return nil, err
+		}
+		b = append(b, 0x00) // Not fixed length
+		for _, n := range v {
+			b = appendUint32(b, n)
+		}
+		return b, nil
+
+	case []float64:
+		if b, err = appendU29Header(append(b, amf3VectorDouble), len(v)); err != nil {
+			return nil, err
+		}
+		b = append(b, 0x00) // Not fixed length
+		for _, n := range v {
+			b = appendUint64(b, math.Float64bits(n))
+		}
+		return b, nil
+
+	case AMF3VectorObject:
+		k, err := e.enter(v.Values)
+		if err != nil {
+			return nil, err
+		}
+		defer e.leave(k)
+		if b, err = appendU29Header(append(b, amf3VectorObject), len(v.Values)); err != nil {
+			return nil, err
+		}
+		if v.Fixed {
+			b = append(b, 0x01)
+		} else {
+			b = append(b, 0x00)
+		}
+		if b, err = e.appendString(b, v.TypeName); err != nil {
+			return nil, err
+		}
+		for _, val := range v.Values {
+			if b, err = e.appendValue(b, val); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	case AMF3Dictionary:
+		k, err := e.enter(v.Entries)
+		if err != nil {
+			return nil, err
+		}
+		defer e.leave(k)
+		if b, err = appendU29Header(append(b, amf3Dictionary), len(v.Entries)); err != nil {
+			return nil, err
+		}
+		if v.WeakKeys {
+			b = append(b, 0x01)
+		} else {
+			b = append(b, 0x00)
+		}
+		for _, entry := range v.Entries {
+			if b, err = e.appendValue(b, entry.Key); err != nil {
+				return nil, err
+			}
+			if b, err = e.appendValue(b, entry.Value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+
+	default:
+		return nil, fmt.Errorf("AMF3 type not recognized: %T: %v", v, v)
+	}
+}
+
+// appendObject appends an object, with its traits inline, following its
+// marker.
+func (e *amf3Encoder) appendObject(b []byte, obj AMF3Object) ([]byte, error) {
+	if len(obj.Sealed) > 0xFFFFFF {
+		return nil, errors.New("AMF3 object has too many sealed members")
+	}
+	h := uint32(len(obj.Sealed))<<4 | 0x03 // Not a reference, traits inline
+	externalized := obj.Externalized != nil
+	if externalized {
+		h |= 0x04
+	}
+	if obj.Dynamic {
+		h |= 0x08
+	}
+	b, err := appendU29(b, h)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = e.appendString(b, obj.ClassName); err != nil {
+		return nil, err
+	}
+	for _, k := range obj.Sealed {
+		if b, err = e.appendString(b, k); err != nil {
+			return nil, err
+		}
+	}
+
+	if externalized {
+		return e.appendValue(b, obj.Externalized)
+	}
+	k, err := e.enter(obj.Values)
+	if err != nil {
+		return nil, err
+	}
+	defer e.leave(k)
+
+	for _, k := range obj.Sealed {
+		if b, err = e.appendValue(b, obj.Values[k]); err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+	}
+	if !obj.Dynamic {
+		return b, nil
+	}
+	sealed := make(map[string]bool, len(obj.Sealed))
+	for _, k := range obj.Sealed {
+		sealed[k] = true
+	}
+	for k, v := range obj.Values {
+		if sealed[k] {
+			continue
+		}
+		if k == "" {
+			return nil, errors.New("AMF3 object keys must not be empty")
+		}
+		if b, err = e.appendString(b, k); err != nil {
+			return nil, err
+		}
+		if b, err = e.appendValue(b, v); err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+	}
+	return append(b, 0x01), nil // The empty string ends the dynamic members
+}
+
+// appendString appends s, or a reference to it if it was appended before,
+// without a marker.
+func (e *amf3Encoder) appendString(b []byte, s string) ([]byte, error) {
+	if ref, ok := e.strings[s]; ok {
+		return appendU29(b, uint32(ref)<<1)
+	}
+	if s != "" {
+		e.strings[s] = len(e.strings)
+	}
+	return appendAMF3Bytes(b, []byte(s))
+}
+
+// appendAMF3Bytes appends the length of p, as a header of a value not sent by
+// reference, followed by p.
+func appendAMF3Bytes(b []byte, p []byte) ([]byte, error) {
+	b, err := appendU29Header(b, len(p))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, p...), nil
+}
+
+// appendU29Header appends the header of a value which is not sent by
+// reference, n followed by a set low bit.
+func appendU29Header(b []byte, n int) ([]byte, error) {
+	if n < 0 || n >= 1<<28 {
+		return nil, fmt.Errorf("AMF3 length out of range: %d", n)
+	}
+	return appendU29(b, uint32(n)<<1|1)
+}
+
+// appendU29 appends v as a variable length unsigned 29 bit integer.
+func appendU29(b []byte, v uint32) ([]byte, error) {
+	switch {
+	case v < 1<<7:
+		return append(b, byte(v)), nil
+	case v < 1<<14:
+		return append(b, byte(v>>7)|0x80, byte(v)&0x7F), nil
+	case v < 1<<21:
+		return append(b, byte(v>>14)|0x80, byte(v>>7)|0x80, byte(v)&0x7F), nil
+	case v < 1<<29:
+		return append(b, byte(v>>22)|0x80, byte(v>>15)|0x80, byte(v>>8)|0x80, byte(v)), nil
+	default:
+		return nil, fmt.Errorf("AMF3 integer out of range: %d", v)
+	}
+}
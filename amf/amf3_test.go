@@ -0,0 +1,156 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAMF3RoundTrip(t *testing.T) {
+	date := time.Unix(1600000000, 123*int64(time.Millisecond))
+
+	tests := []struct {
+		name   string
+		in     interface{}
+		marker byte
+		want   interface{} // in if nil
+	}{
+		{"undefined", AMF0Undefined{}, amf3Undefined, nil},
+		{"null", nil, amf3Null, nil},
+		{"false", false, amf3False, nil},
+		{"true", true, amf3True, nil},
+		{"integer 1 byte", 0x7F, amf3Integer, nil},
+		{"integer 2 bytes", 0x3FFF, amf3Integer, nil},
+		{"integer 3 bytes", 0x1FFFFF, amf3Integer, nil},
+		{"integer 4 bytes", amf3IntMax, amf3Integer, nil},
+		{"negative integer", -1, amf3Integer, nil},
+		{"smallest integer", amf3IntMin, amf3Integer, nil},
+		{"integer out of range", amf3IntMax + 1, amf3Double, float64(amf3IntMax + 1)},
+		{"double", 1.5, amf3Double, nil},
+		{"string", "connect", amf3String, nil},
+		{"empty string", "", amf3String, nil},
+		{"string 65536 bytes", strings.Repeat("a", 65536), amf3String, nil},
+		{"XML document", AMF0XMLDocument("<a/>"), amf3XMLDocument, nil},
+		{"date", date, amf3Date, nil},
+		{"array", AMF3Array{Dense: []interface{}{1, "two", nil}}, amf3Array, nil},
+		{"associative array", AMF3Array{Dense: []interface{}{}, Assoc: map[string]interface{}{"a": 1}}, amf3Array, nil},
+		{"slice", []interface{}{1}, amf3Array, AMF3Array{Dense: []interface{}{1}}},
+		{"anonymous object", AMF3Object{Dynamic: true, Values: map[string]interface{}{"a": 1, "b": "c"}}, amf3Object,
+			AMF3Object{Sealed: []string{}, Dynamic: true, Values: map[string]interface{}{"a": 1, "b": "c"}}},
+		{"typed object", AMF3Object{ClassName: "flash.geom.Point", Sealed: []string{"x", "y"}, Values: map[string]interface{}{"x": 1, "y": 2}}, amf3Object, nil},
+		{"externalizable object", AMF3Object{ClassName: "flex.messaging.io.ArrayCollection", Sealed: []string{}, Externalized: AMF3Array{Dense: []interface{}{1}}}, amf3Object, nil},
+		{"XML", AMF3XML("<a/>"), amf3XML, nil},
+		{"byte array", []byte{1, 2, 3}, amf3ByteArray, nil},
+		{"int vector", []int32{-1, 0, 1}, amf3VectorInt, nil},
+		{"uint vector", []uint32{0, 1, 0xFFFFFFFF}, amf3VectorUint, nil},
+		{"double vector", []float64{-1.5, 0, 1.5}, amf3VectorDouble, nil},
+		{"object vector", AMF3VectorObject{TypeName: "String", Fixed: true, Values: []interface{}{"a", "b"}}, amf3VectorObject, nil},
+		{"dictionary", AMF3Dictionary{WeakKeys: true, Entries: []AMF3DictionaryEntry{{Key: 1, Value: "one"}, {Key: "two", Value: 2.0}}}, amf3Dictionary, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := AMF3Msg{0: tt.in}
+			b, err := in.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if b[0] != tt.marker {
+				t.Errorf("marker = %#x, want %#x", b[0], tt.marker)
+			}
+			got := AMF3Msg{}
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.in
+			}
+			if !reflect.DeepEqual(got, AMF3Msg{0: want}) {
+				t.Errorf("got %#v, want %#v", got[0], want)
+			}
+		})
+	}
+}
+
+func TestAMF3StringReference(t *testing.T) {
+	in := AMF3Msg{0: []interface{}{"abc", "abc", ""}}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		amf3Array, 0x07, 0x01,
+		amf3String, 0x07, 'a', 'b', 'c',
+		amf3String, 0x00, // reference 0
+		amf3String, 0x01, // the empty string is never a reference
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoded % x, want % x", b, want)
+	}
+	got := AMF3Msg{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, AMF3Msg{0: AMF3Array{Dense: []interface{}{"abc", "abc", ""}}}) {
+		t.Errorf("got %#v", got[0])
+	}
+}
+
+func TestAMF3References(t *testing.T) {
+	point := AMF3Object{ClassName: "P", Sealed: []string{"x"}, Values: map[string]interface{}{"x": 1}}
+	date := time.Unix(1, 0)
+	b := []byte{
+		amf3Array, 0x0B, 0x01,
+		// Object 1 with traits 0 inline
+		amf3Object, 0x13, 0x03, 'P', 0x03, 'x', amf3Integer, 0x01,
+		// Object 2 by traits reference 0
+		amf3Object, 0x01, amf3Integer, 0x01,
+		// Object 3, a date
+		amf3Date, 0x01, 0x40, 0x8F, 0x40, 0, 0, 0, 0, 0,
+		// References to objects 1 and 3
+		amf3Object, 0x02,
+		amf3Date, 0x06,
+	}
+	got := AMF3Msg{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	want := AMF3Msg{0: AMF3Array{Dense: []interface{}{point, point, date, point, date}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	// Every value of a message has reference tables of its own
+	b = []byte{amf3String, 0x03, 'a', amf3String, 0x00}
+	if err := (&AMF3Msg{}).UnmarshalBinary(b); err == nil {
+		t.Error("string reference to another value decoded")
+	}
+}
+
+func TestAMF0AVMPlusReferences(t *testing.T) {
+	// The AMF3 value after an AVM+ marker starts reference tables of its own,
+	// leaving those of AMF0 alone
+	in := AMF0Msg{
+		0: AMF0Object{"a": 1.0},
+		1: AMF0AVMPlus{Value: []interface{}{"s", "s"}},
+		2: AMF0Reference(0),
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := AMF0Msg{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	want := AMF0Msg{
+		0: AMF0Object{"a": 1.0},
+		1: AMF0AVMPlus{Value: AMF3Array{Dense: []interface{}{"s", "s"}}},
+		2: AMF0Object{"a": 1.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,552 @@
+package amf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Marshal returns the AMF0 encoding of v as a single value.
+//
+// Booleans, numbers of any Go type and strings encode as their AMF0
+// counterparts, time.Time as a date, slices and arrays as strict arrays, and
+// maps with string keys and structs as objects, keys sorted for maps and in
+// declaration order for structs, embedded fields last. Nil pointers,
+// interfaces, slices and maps encode as null. The types of this package, such
+// as AMF0ECMAArray or AMF0Undefined, encode as the AMF0 type they stand for.
+//
+// Struct fields are encoded under their name unless the field's tag gives
+// another, as in `amf:"name"`. Like encoding/json, the tag option omitempty
+// skips fields with a zero value, a tag of "-" skips the field altogether,
+// unexported fields are skipped and the fields of embedded structs are
+// encoded as fields of the outer struct, except for unexported embedded
+// struct pointers, which are skipped. Values containing themselves through
+// pointers, maps or slices cannot be encoded and return an error.
+func Marshal(v interface{}) ([]byte, error) {
+	g, err := (&marshalState{}).toAMF0(reflect.ValueOf(v))
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: AMF0: %s", err.Error())
+	}
+	b, err := appendAMF0Value(nil, g)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: AMF0: %s", err.Error())
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the single AMF0 value in b and stores it in the value
+// pointed to by v, following the mappings of Marshal in reverse. Numbers
+// only decode into integer types if they are whole and in range. Objects
+// decode into structs by matching keys to field names or tags, preferring an
+// exact match but accepting a case-insensitive one; keys without a field are
+// ignored. Null and undefined set v to its zero value. Into an empty
+// interface values decode as a Decoder with Ordered set decodes them, so
+// objects keep the order of their properties wherever they are stored.
+func Unmarshal(b []byte, v interface{}) error {
+	d := &amf0Decoder{r: newBytesReader(b), ordered: true}
+	src, err := d.decodeValue()
+	if err != nil {
+		return err
+	}
+	if d.r.left != 0 {
+		return errors.New("rtmp: AMF0: trailing bytes after value")
+	}
+	return UnmarshalValue(src, v)
+}
+
+// UnmarshalValue stores src, a value as decoded into an AMF0Msg or
+// AMF0Object, in the value pointed to by v, like Unmarshal does. It lets
+// arguments of an already decoded message be read into Go types.
+func UnmarshalValue(src interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("rtmp: AMF0: unmarshal into non-pointer or nil %T", v)
+	}
+	if err := assignAMF0(rv.Elem(), src); err != nil {
+		return fmt.Errorf("rtmp: AMF0: %s", err.Error())
+	}
+	return nil
+}
+
+var (
+	timeType             = reflect.TypeOf(time.Time{})
+	orderedObjectType    = reflect.TypeOf(AMF0OrderedObject{})
+	orderedECMAArrayType = reflect.TypeOf(AMF0OrderedECMAArray{})
+)
+
+// isAMF0Type reports whether t is one of the types appendAMF0Value encodes
+// directly with no conversion of its own.
+func isAMF0Type(t reflect.Type) bool {
+	switch t {
+	case reflect.TypeOf(AMF0Undefined{}), reflect.TypeOf(AMF0Reference(0)), reflect.TypeOf(AMF0XMLDocument("")),
+		reflect.TypeOf(AMF0AVMPlus{}), timeType:
+		return true
+	}
+	return false
+}
+
+// marshalState tracks the pointers, maps and slices Marshal is inside of, so
+// that values referencing themselves fail instead of recursing forever.
+type marshalState struct {
+	visiting map[visit]bool
+}
+
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// enter marks the pointer, map or slice v as being converted, failing if it
+// already is. Every successful call must be matched by a call to leave.
+func (s *marshalState) enter(v reflect.Value) (visit, error) {
+	// Empty maps and slices cannot contain themselves, while nil and empty
+	// ones of a type share their pointer
+	if v.Kind() != reflect.Ptr && v.Len() == 0 {
+		return visit{}, nil
+	}
+	k := visit{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		k.len = v.Len()
+	}
+	if s.visiting[k] {
+		return k, fmt.Errorf("encountered a cycle via %s", v.Type())
+	}
+	if s.visiting == nil {
+		s.visiting = make(map[visit]bool)
+	}
+	s.visiting[k] = true
+	return k, nil
+}
+
+func (s *marshalState) leave(k visit) {
+	delete(s.visiting, k)
+}
+
+// toAMF0 converts v to the generic values appendAMF0Value encodes.
+func (s *marshalState) toAMF0(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if isAMF0Type(v.Type()) {
+		return v.Interface(), nil
+	}
+	switch v.Type() {
+	case orderedObjectType, orderedECMAArrayType:
+		k, err := s.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer s.leave(k)
+		props, err := s.toAMF0Properties(v.Convert(orderedObjectType).Interface().(AMF0OrderedObject))
+		if err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(props).Convert(v.Type()).Interface(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+
+	case reflect.String:
+		return v.String(), nil
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Kind() == reflect.Ptr {
+			k, err := s.enter(v)
+			if err != nil {
+				return nil, err
+			}
+			defer s.leave(k)
+		}
+		return s.toAMF0(v.Elem())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return nil, nil
+			}
+			k, err := s.enter(v)
+			if err != nil {
+				return nil, err
+			}
+			defer s.leave(k)
+		}
+		arr := make(AMF0StrictArray, v.Len())
+		for i := range arr {
+			var err error
+			if arr[i], err = s.toAMF0(v.Index(i)); err != nil {
+				return nil, fmt.Errorf("%d: %s", i, err.Error())
+			}
+		}
+		return arr, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type: %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		k, err := s.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer s.leave(k)
+		obj := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			var err error
+			if obj[k.String()], err = s.toAMF0(v.MapIndex(k)); err != nil {
+				return nil, fmt.Errorf("%s: %s", k.String(), err.Error())
+			}
+		}
+		if v.Type() == reflect.TypeOf(AMF0ECMAArray{}) {
+			return AMF0ECMAArray(obj), nil
+		}
+		return AMF0Object(obj), nil
+
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(AMF0TypedObject{}) {
+			obj, err := s.toAMF0(v.Field(1))
+			if err != nil {
+				return nil, err
+			}
+			typed := v.Interface().(AMF0TypedObject)
+			typed.Object, _ = obj.(AMF0Object)
+			return typed, nil
+		}
+		obj := AMF0OrderedObject{}
+		for _, f := range structFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			g, err := s.toAMF0(fv)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.name, err.Error())
+			}
+			obj = append(obj, AMF0Property{Key: f.name, Value: g})
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", v.Type())
+}
+
+// toAMF0Properties converts the values of props, keeping their order.
+func (s *marshalState) toAMF0Properties(props []AMF0Property) ([]AMF0Property, error) {
+	out := make([]AMF0Property, len(props))
+	for i, p := range props {
+		g, err := s.toAMF0(reflect.ValueOf(p.Value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.Key, err.Error())
+		}
+		out[i] = AMF0Property{Key: p.Key, Value: g}
+	}
+	return out, nil
+}
+
+// assignAMF0 stores the decoded value src in dst.
+func assignAMF0(dst reflect.Value, src interface{}) error {
+	switch src.(type) {
+	case nil, AMF0Undefined:
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assignAMF0(dst.Elem(), src)
+	}
+	if sv := reflect.ValueOf(src); sv.Type().AssignableTo(dst.Type()) {
+		dst.Set(sv)
+		return nil
+	}
+	switch dst.Type() {
+	case orderedObjectType, orderedECMAArrayType:
+		props, ok := properties(src)
+		if !ok {
+			return fmt.Errorf("cannot unmarshal %T into %s", src, dst.Type())
+		}
+		dst.Set(reflect.ValueOf(props).Convert(dst.Type()))
+		return nil
+	}
+
+	mismatch := fmt.Errorf("cannot unmarshal %T into %s", src, dst.Type())
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch
+		}
+		dst.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := src.(float64)
+		if !ok {
+			return mismatch
+		}
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || dst.OverflowInt(int64(f)) {
+			return fmt.Errorf("number %v does not fit %s", f, dst.Type())
+		}
+		dst.SetInt(int64(f))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f, ok := src.(float64)
+		if !ok {
+			return mismatch
+		}
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || dst.OverflowUint(uint64(f)) {
+			return fmt.Errorf("number %v does not fit %s", f, dst.Type())
+		}
+		dst.SetUint(uint64(f))
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := src.(float64)
+		if !ok {
+			return mismatch
+		}
+		dst.SetFloat(f)
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case AMF0XMLDocument:
+			dst.SetString(string(s))
+		default:
+			return mismatch
+		}
+
+	case reflect.Slice, reflect.Array:
+		arr, ok := src.(AMF0StrictArray)
+		if !ok {
+			return mismatch
+		}
+		if dst.Kind() == reflect.Slice {
+			dst.Set(reflect.MakeSlice(dst.Type(), len(arr), len(arr)))
+		} else if dst.Len() != len(arr) {
+			return fmt.Errorf("cannot unmarshal strict array of %d values into %s", len(arr), dst.Type())
+		}
+		for i, v := range arr {
+			if err := assignAMF0(dst.Index(i), v); err != nil {
+				return fmt.Errorf("%d: %s", i, err.Error())
+			}
+		}
+
+	case reflect.Map:
+		props, ok := properties(src)
+		if !ok || dst.Type().Key().Kind() != reflect.String {
+			return mismatch
+		}
+		m := reflect.MakeMapWithSize(dst.Type(), len(props))
+		for _, p := range props {
+			ev := reflect.New(dst.Type().Elem()).Elem()
+			if err := assignAMF0(ev, p.Value); err != nil {
+				return fmt.Errorf("%s: %s", p.Key, err.Error())
+			}
+			m.SetMapIndex(reflect.ValueOf(p.Key).Convert(dst.Type().Key()), ev)
+		}
+		dst.Set(m)
+
+	case reflect.Struct:
+		props, ok := properties(src)
+		if !ok {
+			return mismatch
+		}
+		fields := structFields(dst.Type())
+		for _, p := range props {
+			f := lookupField(fields, p.Key)
+			if f == nil {
+				continue
+			}
+			fv, ok := fieldByIndexAlloc(dst, f.index)
+			if !ok {
+				return fmt.Errorf("%s: cannot allocate embedded struct of %s", p.Key, dst.Type())
+			}
+			if err := assignAMF0(fv, p.Value); err != nil {
+				return fmt.Errorf("%s: %s", p.Key, err.Error())
+			}
+		}
+
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return mismatch
+		}
+		dst.Set(reflect.ValueOf(src))
+
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+// properties returns the key value pairs of an object, typed object or ECMA
+// array, in order for the ordered types and sorted by key for the others.
+func properties(src interface{}) ([]AMF0Property, bool) {
+	switch src := src.(type) {
+	case AMF0Object:
+		return sortedProperties(src), true
+	case AMF0ECMAArray:
+		return sortedProperties(src), true
+	case AMF0TypedObject:
+		return sortedProperties(src.Object), true
+	case AMF0OrderedObject:
+		return src, true
+	case AMF0OrderedECMAArray:
+		return src, true
+	}
+	return nil, false
+}
+
+// field is a struct field as encoded in an AMF0 object.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFields returns the fields of struct type t encoded in AMF0 objects,
+// including those of embedded structs. Fields of the outer struct win over
+// embedded ones of the same name.
+func structFields(t reflect.Type) []field {
+	var fields []field
+	seen := make(map[string]bool)
+	var walk func(t reflect.Type, index []int, depth int)
+	walk = func(t reflect.Type, index []int, depth int) {
+		var embedded []reflect.StructField
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("amf")
+			if tag == "-" {
+				continue
+			}
+			name, opts := tag, ""
+			if j := strings.IndexByte(tag, ','); j >= 0 {
+				name, opts = tag[:j], tag[j+1:]
+			}
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				// As encoding/json does, unexported embedded pointers are
+				// skipped: they cannot be allocated when decoding
+				if sf.PkgPath != "" && sf.Type.Kind() == reflect.Ptr {
+					continue
+				}
+				embedded = append(embedded, sf)
+				continue
+			}
+			if sf.PkgPath != "" { // unexported
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fields = append(fields, field{
+				name:      name,
+				index:     append(append([]int(nil), index...), i),
+				omitEmpty: opts == "omitempty",
+			})
+		}
+		// Embedded fields come after the outer ones so those take precedence
+		if depth < 16 {
+			for _, sf := range embedded {
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				walk(ft, append(append([]int(nil), index...), sf.Index...), depth+1)
+			}
+		}
+	}
+	walk(t, nil, 0)
+	return fields
+}
+
+// lookupField returns the field encoded under key, preferring an exact match
+// over a case-insensitive one.
+func lookupField(fields []field, key string) *field {
+	var fold *field
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, key) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// fieldByIndex is like FieldByIndex but reports false instead of panicking
+// when the field is in a nil embedded struct pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like FieldByIndex but allocates nil embedded struct
+// pointers on the way. It reports false if one of them cannot be set.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
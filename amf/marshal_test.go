@@ -0,0 +1,264 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testCodec struct {
+	Codec string
+	Rate  float64 `amf:"rate"`
+}
+
+type testInner struct {
+	Depth int
+}
+
+type testStatus struct {
+	Level       string `amf:"level"`
+	Code        string `amf:"code"`
+	Description string `amf:"description,omitempty"`
+	Secret      string `amf:"-"`
+	hidden      string
+	Count       *int `amf:"count,omitempty"`
+	testCodec
+	Inner *testInner `amf:"inner,omitempty"`
+}
+
+type testCase struct {
+	Upper string `amf:"Level"`
+	Lower string `amf:"level"`
+}
+
+type testNode struct {
+	Next *testNode
+}
+
+func TestMarshal(t *testing.T) {
+	three := 3
+	shared := &testInner{Depth: 1}
+
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{} // as encoded by appendAMF0Value
+	}{
+		{"bool", true, true},
+		{"int", int8(-1), -1.0},
+		{"uint", uint32(1 << 31), float64(1 << 31)},
+		{"float32", float32(0.5), 0.5},
+		{"string", "live", "live"},
+		{"pointer", &three, 3.0},
+		{"nil pointer", (*int)(nil), nil},
+		{"nil slice", []string(nil), nil},
+		{"slice", []string{"a", "b"}, AMF0StrictArray{"a", "b"}},
+		{"array", [2]int{1, 2}, AMF0StrictArray{1.0, 2.0}},
+		{"map", map[string]int{"a": 1}, AMF0Object{"a": 1.0}},
+		{"ECMA array", AMF0ECMAArray{"a": 1.0}, AMF0ECMAArray{"a": 1.0}},
+		{"ordered ECMA array", AMF0OrderedECMAArray{{"z", 1}, {"a", 2}}, AMF0OrderedECMAArray{{"z", 1.0}, {"a", 2.0}}},
+		{
+			// Tagged names, "-" and unexported fields, then the fields of
+			// embedded structs after those of the outer one
+			"struct",
+			testStatus{
+				Level: "status", Code: "NetStream.Play.Start", Description: "Started",
+				Secret: "s", hidden: "h", Count: &three,
+				testCodec: testCodec{Codec: "aac", Rate: 44100},
+				Inner:     &testInner{Depth: 2},
+			},
+			AMF0OrderedObject{
+				{"level", "status"}, {"code", "NetStream.Play.Start"}, {"description", "Started"},
+				{"count", 3.0}, {"inner", AMF0OrderedObject{{"Depth", 2.0}}},
+				{"Codec", "aac"}, {"rate", 44100.0},
+			},
+		},
+		{
+			"omitempty",
+			testStatus{Level: "status"},
+			AMF0OrderedObject{{"level", "status"}, {"code", ""}, {"Codec", ""}, {"rate", 0.0}},
+		},
+		{
+			// Values seen twice side by side are not cycles
+			"repeated pointer",
+			[]*testInner{shared, shared},
+			AMF0StrictArray{AMF0OrderedObject{{"Depth", 1.0}}, AMF0OrderedObject{{"Depth", 1.0}}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want, err := appendAMF0Value(nil, tt.want)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: encoded % x, want % x", tt.name, got, want)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	node := &testNode{}
+	node.Next = node
+	m := map[string]interface{}{}
+	m["m"] = m
+	s := []interface{}{nil}
+	s[0] = s
+	ordered := AMF0OrderedObject{{"o", nil}}
+	ordered[0].Value = ordered
+	orderedECMA := AMF0OrderedECMAArray{{"o", nil}}
+	orderedECMA[0].Value = AMF0StrictArray{orderedECMA}
+
+	tests := []struct {
+		name    string
+		in      interface{}
+		wantErr string
+	}{
+		{"channel", make(chan int), "unsupported type: chan int"},
+		{"map key", map[int]string{}, "unsupported map key type: int"},
+		{"pointer cycle", node, "cycle"},
+		{"map cycle", m, "cycle"},
+		{"slice cycle", s, "cycle"},
+		{"ordered object cycle", ordered, "cycle via amf.AMF0OrderedObject"},
+		{"ordered ECMA array cycle", orderedECMA, "cycle via amf.AMF0OrderedECMAArray"},
+		{"cycle in a field", struct{ N *testNode }{node}, "N: Next: "},
+	}
+	for _, tt := range tests {
+		_, err := Marshal(tt.in)
+		if err == nil || !strings.HasPrefix(err.Error(), "rtmp: AMF0: ") || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	three := 3
+	status := AMF0OrderedObject{
+		{"level", "status"}, {"CODE", "NetStream.Play.Start"}, {"description", "Started"},
+		{"Secret", "s"}, {"count", 3.0}, {"inner", AMF0Object{"depth": 2.0}},
+		{"codec", "aac"}, {"rate", 44100.0}, {"unknown", true},
+	}
+
+	tests := []struct {
+		name string
+		in   interface{}
+		ptr  interface{} // to a zero value to decode into
+		want interface{}
+	}{
+		{"int", 3.0, new(int8), int8(3)},
+		{"uint", 255.0, new(uint8), uint8(255)},
+		{"float32", 0.5, new(float32), float32(0.5)},
+		{"string", "live", new(string), "live"},
+		{"XML document", AMF0XMLDocument("<a/>"), new(string), "<a/>"},
+		{"pointer", 3.0, new(*int), &three},
+		{"null", nil, &[]*int{&three}[0], (*int)(nil)},
+		{"slice", AMF0StrictArray{"a", "b"}, new([]string), []string{"a", "b"}},
+		{"array", AMF0StrictArray{1.0, 2.0}, new([2]int), [2]int{1, 2}},
+		{"map", AMF0Object{"a": 1.0}, new(map[string]int), map[string]int{"a": 1}},
+		{"ordered object", AMF0ECMAArray{"b": 1.0, "a": 2.0}, new(AMF0OrderedObject), AMF0OrderedObject{{"a", 2.0}, {"b", 1.0}}},
+		{
+			// Objects decode into interfaces in order
+			"interface",
+			AMF0StrictArray{AMF0OrderedObject{{"z", 1.0}, {"a", 2.0}}},
+			new(interface{}),
+			AMF0StrictArray{AMF0OrderedObject{{"z", 1.0}, {"a", 2.0}}},
+		},
+		{
+			// Keys match fields exactly or case-insensitively and those
+			// without a field are ignored
+			"struct",
+			status,
+			new(testStatus),
+			testStatus{
+				Level: "status", Code: "NetStream.Play.Start", Description: "Started", Count: &three,
+				testCodec: testCodec{Codec: "aac", Rate: 44100},
+				Inner:     &testInner{Depth: 2},
+			},
+		},
+		{
+			"exact match first",
+			AMF0OrderedObject{{"level", "a"}, {"LEVEL", "b"}},
+			new(testCase),
+			testCase{Upper: "b", Lower: "a"},
+		},
+	}
+	for _, tt := range tests {
+		b, err := appendAMF0Value(nil, tt.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := Unmarshal(b, tt.ptr); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := reflect.ValueOf(tt.ptr).Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	number, err := appendAMF0Value(nil, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		in      interface{}
+		ptr     interface{}
+		wantErr string
+	}{
+		{"fraction", 3.5, new(int), "number 3.5 does not fit int"},
+		{"overflow", 256.0, new(uint8), "number 256 does not fit uint8"},
+		{"negative", -1.0, new(uint), "number -1 does not fit uint"},
+		{"type mismatch", "3", new(int), "cannot unmarshal string into int"},
+		{"array length", AMF0StrictArray{1.0, 2.0, 3.0}, new([2]int), "strict array of 3 values"},
+		{"field", AMF0Object{"count": "three"}, new(testStatus), "count: cannot unmarshal string into int"},
+		{"non-pointer", 1.0, 1.0, "non-pointer"},
+		{"nil pointer", 1.0, (*float64)(nil), "non-pointer or nil"},
+	}
+	for _, tt := range tests {
+		b, err := appendAMF0Value(nil, tt.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err = Unmarshal(b, tt.ptr)
+		if err == nil || !strings.HasPrefix(err.Error(), "rtmp: AMF0: ") || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	var f float64
+	if err := Unmarshal(append(number, amf0Null), &f); err == nil {
+		t.Error("trailing bytes decoded")
+	}
+	if err := Unmarshal(number[:5], &f); err == nil {
+		t.Error("truncated number decoded")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	three := 3
+	in := testStatus{
+		Level: "status", Code: "NetStream.Play.Start", Count: &three,
+		testCodec: testCodec{Codec: "aac", Rate: 44100},
+		Inner:     &testInner{Depth: 2},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out testStatus
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v, want %#v", out, in)
+	}
+}
@@ -0,0 +1,224 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DefaultMaxDepth is how deeply objects and arrays may nest in a value
+	// decoded by a Decoder whose MaxDepth is 0.
+	DefaultMaxDepth = 32
+
+	// DefaultMaxSize is the largest encoded value, in bytes, a Decoder whose
+	// MaxSize is 0 decodes. It is the largest RTMP message or FLV tag.
+	DefaultMaxSize = 0xFFFFFF
+)
+
+// A Decoder reads AMF0 values from an input stream, one at a time, in a
+// single pass. It reads exactly the bytes of each value, so it can be handed
+// a stream holding other data after the values, such as an FLV file. Inputs
+// which are not buffered should be wrapped in a bufio.Reader.
+//
+// References in a value may refer to complex values of earlier values decoded
+// by the same Decoder, as values of one message share a reference table.
+type Decoder struct {
+	// MaxDepth limits how deeply objects and arrays may nest in a value and
+	// MaxSize limits the bytes a single value may take, so that hostile
+	// input cannot exhaust the stack or memory. Zero values use
+	// DefaultMaxDepth and DefaultMaxSize.
+	MaxDepth int
+	MaxSize  int64
+
+	// Ordered makes objects and ECMA arrays decode to AMF0OrderedObject and
+	// AMF0OrderedECMAArray, keeping their properties in the order sent.
+	Ordered bool
+
+	r   valueReader
+	dec amf0Decoder
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{r: valueReader{r: r}}
+	d.dec.r = &d.r
+	return d
+}
+
+// Decode reads the next AMF0 value, decoded to the Go types listed for
+// AMF0Msg. It returns io.EOF once the input ends between values.
+func (d *Decoder) Decode() (interface{}, error) {
+	d.r.reset(d.MaxSize, d.MaxDepth)
+	d.dec.ordered = d.Ordered
+	m, err := d.r.nextOrEOF(1, "rtmp: AMF0", "marker")
+	if err != nil {
+		return nil, err
+	}
+	return d.dec.decode(m[0])
+}
+
+// An Encoder writes AMF0 values to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the AMF0 encoding of v, as Marshal encodes it, with a single
+// write.
+func (e *Encoder) Encode(v interface{}) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(b); err != nil {
+		return fmt.Errorf("rtmp: AMF0: write failed: %s", err.Error())
+	}
+	return nil
+}
+
+// valueReader reads the bytes of encoded values for the AMF0 and AMF3
+// decoders while enforcing the limits of a Decoder.
+type valueReader struct {
+	r io.Reader
+
+	// Bytes the current value may still take and the nesting depth left
+	left  int64
+	depth int
+
+	// Whether left is exactly what the input holds rather than a limit
+	exact bool
+
+	buf []byte
+}
+
+// newBytesReader returns a valueReader for the values held in b, limited to
+// the size of b and the default depth.
+func newBytesReader(b []byte) *valueReader {
+	r := &valueReader{r: bytes.NewReader(b), exact: true}
+	r.reset(int64(len(b)), 0)
+	return r
+}
+
+// reset sets the limits for the next value.
+func (r *valueReader) reset(maxSize int64, maxDepth int) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	r.left = maxSize
+	r.depth = maxDepth
+}
+
+// next returns the following n bytes, which are only valid until the next
+// call. prefix starts error messages, what names the bytes in them.
+func (r *valueReader) next(n int, prefix, what string) ([]byte, error) {
+	b, err := r.read(n, false)
+	if err != nil {
+		return nil, r.readError(err, prefix, what)
+	}
+	return b, nil
+}
+
+// nextOrEOF is like next but returns io.EOF if the input ends before the
+// first byte.
+func (r *valueReader) nextOrEOF(n int, prefix, what string) ([]byte, error) {
+	b, err := r.read(n, true)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, r.readError(err, prefix, what)
+	}
+	return b, nil
+}
+
+func (r *valueReader) read(n int, eofOK bool) ([]byte, error) {
+	if n < 0 || int64(n) > r.left {
+		if eofOK {
+			// Tell an input ending here apart from one going on too long
+			if _, err := io.ReadFull(r.r, make([]byte, 1)); err == io.EOF {
+				return nil, io.EOF
+			}
+		}
+		return nil, errSizeLimit
+	}
+	// The buffer grows as bytes arrive, so a bogus length cannot make us
+	// allocate more than the input holds
+	r.buf = r.buf[:0]
+	for len(r.buf) < n {
+		start := len(r.buf)
+		grow := n - start
+		if limit := start + 4096; grow > limit {
+			grow = limit
+		}
+		if cap(r.buf) < start+grow {
+			r.buf = append(r.buf, make([]byte, grow)...)
+		} else {
+			r.buf = r.buf[:start+grow]
+		}
+		if _, err := io.ReadFull(r.r, r.buf[start:]); err != nil {
+			if err == io.EOF && (start > 0 || !eofOK) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	r.left -= int64(n)
+	return r.buf, nil
+}
+
+// errSizeLimit is returned by read for bytes beyond what the value may take.
+var errSizeLimit = errors.New("size limit exceeded")
+
+// readError describes err, returned while reading what.
+func (r *valueReader) readError(err error, prefix, what string) error {
+	switch {
+	case err == errSizeLimit && !r.exact:
+		return fmt.Errorf("%s: %s exceeds size limit", prefix, what)
+	case err == errSizeLimit, err == io.ErrUnexpectedEOF, err == io.EOF:
+		return fmt.Errorf("%s: not enough bytes for %s", prefix, what)
+	default:
+		return fmt.Errorf("%s: read %s failed: %s", prefix, what, err.Error())
+	}
+}
+
+// fits checks count elements taking at least min bytes each fit in what the
+// value may still take, so a bogus count cannot make decoders loop or
+// allocate beyond that.
+func (r *valueReader) fits(count uint32, min int, prefix, what string) error {
+	if uint64(count)*uint64(min) > uint64(r.left) {
+		return r.readError(errSizeLimit, prefix, fmt.Sprintf("%s of %d", what, count))
+	}
+	return nil
+}
+
+// enter descends into an object or array, failing past the depth limit.
+// Every successful call must be matched by a call to leave.
+func (r *valueReader) enter(prefix string) error {
+	if r.depth == 0 {
+		return fmt.Errorf("%s: values nested too deeply", prefix)
+	}
+	r.depth--
+	return nil
+}
+
+func (r *valueReader) leave() {
+	r.depth++
+}
+
+// initialCap returns the capacity to allocate up front for count elements,
+// which is bounded as elements still have to arrive.
+func initialCap(count int) int {
+	if count > 1024 {
+		return 1024
+	}
+	return count
+}
@@ -0,0 +1,190 @@
+package amf
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nestedArrays returns n strict arrays nested in each other, around a null.
+func nestedArrays(n int) interface{} {
+	var v interface{}
+	for i := 0; i < n; i++ {
+		v = AMF0StrictArray{v}
+	}
+	return v
+}
+
+// nestedObjects returns n objects nested in each other.
+func nestedObjects(n int) interface{} {
+	v := AMF0Object{}
+	for i := 1; i < n; i++ {
+		v = AMF0Object{"o": v}
+	}
+	return v
+}
+
+// nestedAMF3 returns n AMF3 arrays nested in each other behind an AVM+ switch.
+func nestedAMF3(n int) interface{} {
+	var v interface{}
+	for i := 0; i < n; i++ {
+		v = AMF3Array{Dense: []interface{}{v}}
+	}
+	return AMF0AVMPlus{Value: v}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	encode := func(v interface{}) []byte {
+		b, err := appendAMF0Value(nil, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	str := encode(strings.Repeat("a", 100)) // 103 bytes
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		maxSize  int64
+		in       []byte
+		wantErr  string // no error if empty
+	}{
+		{"arrays at MaxDepth", 3, 0, encode(nestedArrays(3)), ""},
+		{"arrays over MaxDepth", 3, 0, encode(nestedArrays(4)), "rtmp: AMF0: values nested too deeply"},
+		{"objects over MaxDepth", 3, 0, encode(nestedObjects(4)), "rtmp: AMF0: values nested too deeply"},
+		{"AMF3 over MaxDepth", 3, 0, encode(nestedAMF3(4)), "rtmp: AMF3: values nested too deeply"},
+		{"arrays at DefaultMaxDepth", 0, 0, encode(nestedArrays(DefaultMaxDepth)), ""},
+		{"arrays over DefaultMaxDepth", 0, 0, encode(nestedArrays(DefaultMaxDepth + 1)), "rtmp: AMF0: values nested too deeply"},
+
+		{"string at MaxSize", 0, 103, str, ""},
+		{"string over MaxSize", 0, 102, str, "rtmp: AMF0: string exceeds size limit"},
+		{
+			// Counts and lengths are checked before anything is allocated
+			"strict array count over DefaultMaxSize",
+			0, 0,
+			[]byte{amf0StrictArray, 0xFF, 0xFF, 0xFF, 0xFF, amf0Null},
+			"rtmp: AMF0: strict array of 4294967295 exceeds size limit",
+		},
+		{
+			"long string length over MaxSize",
+			0, 1024,
+			[]byte{amf0LongString, 0x7F, 0xFF, 0xFF, 0xFF, 'a'},
+			"rtmp: AMF0: long string of 2147483647 exceeds size limit",
+		},
+		{
+			"AMF3 string length over MaxSize",
+			0, 1024,
+			[]byte{amf0AVMPlus, 0x06, 0xBF, 0xFF, 0xFF, 0xFF, 'a'},
+			"rtmp: AMF3: string exceeds size limit",
+		},
+		{"truncated", 0, 0, str[:50], "rtmp: AMF0: not enough bytes for string"},
+	}
+	for _, tt := range tests {
+		d := NewDecoder(bytes.NewReader(tt.in))
+		d.MaxDepth, d.MaxSize = tt.maxDepth, tt.maxSize
+		_, err := d.Decode()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Ordered objects are decoded apart from the others
+	d := NewDecoder(bytes.NewReader(encode(nestedObjects(4))))
+	d.MaxDepth, d.Ordered = 3, true
+	if _, err := d.Decode(); err == nil || err.Error() != "rtmp: AMF0: values nested too deeply" {
+		t.Errorf("ordered objects over MaxDepth: got error %v", err)
+	}
+}
+
+func TestDecoderEOF(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	in := []interface{}{"onMetaData", AMF0ECMAArray{"duration": 1.0}, nil}
+	for _, v := range in {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := buf.Bytes()
+
+	// MaxSize applies to each value rather than to the whole input
+	d := NewDecoder(bytes.NewReader(b))
+	d.MaxSize = int64(len(b)) - 1
+	for i, want := range in {
+		v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("value %d = %#v, want %#v", i, v, want)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Decode(); err != io.EOF {
+			t.Errorf("Decode after the last value: %v, want io.EOF", err)
+		}
+	}
+
+	// Input ending inside a value is an error
+	d = NewDecoder(bytes.NewReader(b[:len(b)-2]))
+	if _, err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err == nil || err == io.EOF {
+		t.Errorf("Decode of a truncated value: %v", err)
+	}
+}
+
+func TestEncoderOrdered(t *testing.T) {
+	type point struct {
+		Y, X float64
+	}
+	in := []interface{}{
+		AMF0OrderedObject{{"z", 1.0}, {"a", AMF0OrderedObject{{"y", 2.0}, {"b", 3.0}}}},
+		AMF0OrderedECMAArray{{"z", AMF0StrictArray{AMF0OrderedObject{{"y", 1.0}, {"b", 2.0}}}}},
+		point{Y: 1, X: 2},
+	}
+	want := []interface{}{
+		in[0],
+		in[1],
+		AMF0OrderedObject{{"Y", 1.0}, {"X", 2.0}},
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, v := range in {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := NewDecoder(&buf)
+	d.Ordered = true
+	for i := range want {
+		v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, want[i]) {
+			t.Errorf("value %d = %#v, want %#v", i, v, want[i])
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Decode after the last value: %v, want io.EOF", err)
+	}
+
+	// Values which cannot be encoded write nothing
+	cycle := AMF0OrderedObject{{"a", nil}}
+	cycle[0].Value = cycle
+	if err := e.Encode(cycle); err == nil {
+		t.Error("value containing itself encoded")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written for a failed value", buf.Len())
+	}
+}
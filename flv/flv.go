@@ -0,0 +1,98 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FLV tag types, which match the RTMP message type ids of the same payloads.
+const (
+	TagAudio      uint8 = 8
+	TagVideo      uint8 = 9
+	TagScriptData uint8 = 18
+)
+
+// Flags of the FLV file header announcing which kinds of tags follow.
+const (
+	FlagVideo uint8 = 0x01
+	FlagAudio uint8 = 0x04
+)
+
+// headerLen is the length of the FLV file header. It is also the data
+// offset the header carries.
+const headerLen = 9
+
+// tagHeaderLen is the length of an FLV tag header.
+const tagHeaderLen = 11
+
+// maxTagDataLen is the largest tag body the 3 byte data size field can hold.
+const maxTagDataLen = 0xFFFFFF
+
+// A Writer muxes tags into an FLV file. The file header must be written with
+// WriteHeader before any tag.
+type Writer struct {
+	w           io.Writer
+	wroteHeader bool
+}
+
+// NewWriter returns a Writer writing an FLV file to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader writes the FLV file header with flags, a combination of
+// FlagAudio and FlagVideo, followed by the first PreviousTagSize field.
+func (w *Writer) WriteHeader(flags uint8) error {
+	if w.wroteHeader {
+		return errors.New("flv: header already written")
+	}
+	b := make([]byte, headerLen+4)
+	copy(b, "FLV")
+	b[3] = 1 // version
+	b[4] = flags & (FlagAudio | FlagVideo)
+	binary.BigEndian.PutUint32(b[5:9], headerLen)
+	// PreviousTagSize0 is always 0
+	if _, err := w.w.Write(b); err != nil {
+		return fmt.Errorf("flv: write header failed: %s", err.Error())
+	}
+	w.wroteHeader = true
+	return nil
+}
+
+// WriteTag writes a tag of tagType with timestamp ts in milliseconds and body
+// data, followed by its PreviousTagSize trailer. For audio and video tags data
+// is the RTMP message payload as is. Script data tags hold AMF0 values, such
+// as "onMetaData" and an ECMA array.
+func (w *Writer) WriteTag(tagType uint8, ts uint32, data []byte) error {
+	if !w.wroteHeader {
+		return errors.New("flv: tag written before header")
+	}
+	if len(data) > maxTagDataLen {
+		return fmt.Errorf("flv: tag data too large: %d", len(data))
+	}
+
+	h := make([]byte, tagHeaderLen)
+	h[0] = tagType & 0x1F // upper bits are reserved and the filter flag
+	putUint24(h[1:4], uint32(len(data)))
+	putUint24(h[4:7], ts&0xFFFFFF)
+	h[7] = byte(ts >> 24) // TimestampExtended holds the upper 8 bits
+	// StreamID, h[8:11], is always 0
+
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, uint32(tagHeaderLen+len(data)))
+
+	for _, b := range [][]byte{h, data, trailer} {
+		if _, err := w.w.Write(b); err != nil {
+			return fmt.Errorf("flv: write tag failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
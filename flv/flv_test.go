@@ -0,0 +1,130 @@
+package flv
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type tag struct {
+	tagType uint8
+	ts      uint32
+	data    []byte
+}
+
+func TestRoundTrip(t *testing.T) {
+	tags := []tag{
+		{TagScriptData, 0, []byte("\x02\x00\x0aonMetaData")},
+		{TagVideo, 0, []byte{0x17, 0x00, 0, 0, 0}},
+		{TagAudio, 23, []byte{0xAF, 0x01, 0x21}},
+		{TagVideo, 0xFFFFFF, []byte{0x27, 0x01}},
+		{TagVideo, 0x01000000, []byte{0x27, 0x01}}, // needs TimestampExtended
+		{TagAudio, 0xFFFFFFFF, []byte{}},
+		{TagVideo, 40, bytes.Repeat([]byte{0x27}, 70000)},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteTag(TagAudio, 0, nil); err == nil {
+		t.Error("tag written before header")
+	}
+	if err := w.WriteHeader(FlagAudio | FlagVideo); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(FlagAudio); err == nil {
+		t.Error("header written twice")
+	}
+	for _, tg := range tags {
+		if err := w.WriteTag(tg.tagType, tg.ts, tg.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTag(TagVideo, 0, make([]byte, maxTagDataLen+1)); err == nil {
+		t.Error("oversized tag written")
+	}
+
+	b := buf.Bytes()
+	wantHeader := []byte{'F', 'L', 'V', 1, FlagAudio | FlagVideo, 0, 0, 0, 9, 0, 0, 0, 0}
+	if !bytes.Equal(b[:len(wantHeader)], wantHeader) {
+		t.Errorf("header % x, want % x", b[:len(wantHeader)], wantHeader)
+	}
+
+	r := NewReader(bytes.NewReader(b))
+	if _, _, _, err := r.ReadTag(); err == nil {
+		t.Error("tag read before header")
+	}
+	flags, err := r.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != FlagAudio|FlagVideo {
+		t.Errorf("flags %#x, want %#x", flags, FlagAudio|FlagVideo)
+	}
+	for i, want := range tags {
+		var got tag
+		got.tagType, got.ts, got.data, err = r.ReadTag()
+		if err != nil {
+			t.Fatalf("tag %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("tag %d: got type %d ts %d and %d bytes, want type %d ts %d and %d bytes",
+				i, got.tagType, got.ts, len(got.data), want.tagType, want.ts, len(want.data))
+		}
+	}
+	if _, _, _, err := r.ReadTag(); err != io.EOF {
+		t.Errorf("after the last tag: %v, want EOF", err)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteHeader(FlagVideo)
+	w.WriteTag(TagVideo, 0, []byte{0x17, 0x01})
+	file := buf.Bytes()
+
+	extended := append([]byte(nil), file[:headerLen]...)
+	extended[8] = headerLen + 2
+	extended = append(extended, 0xAA, 0xBB)
+	extended = append(extended, file[headerLen:]...)
+
+	encrypted := append([]byte(nil), file...)
+	encrypted[headerLen+4] |= 0x20
+
+	tests := []struct {
+		name      string
+		in        []byte
+		headerErr bool
+		tagErr    bool
+	}{
+		{"valid", file, false, false},
+		{"header extension", extended, false, false},
+		{"empty", nil, true, false},
+		{"not FLV", append([]byte("FLX"), file[3:]...), true, false},
+		{"version 2", append([]byte("FLV\x02"), file[4:]...), true, false},
+		{"data offset too small", append(append([]byte(nil), file[:8]...), append([]byte{8}, file[9:]...)...), true, false},
+		{"encrypted tag", encrypted, false, true},
+		{"truncated tag header", file[:headerLen+4+5], false, true},
+		{"truncated tag body", file[:len(file)-5], false, true},
+	}
+	for _, tt := range tests {
+		r := NewReader(bytes.NewReader(tt.in))
+		_, err := r.ReadHeader()
+		if (err != nil) != tt.headerErr {
+			t.Errorf("%s: ReadHeader: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		_, _, data, err := r.ReadTag()
+		if (err != nil) != tt.tagErr {
+			t.Errorf("%s: ReadTag: %v", tt.name, err)
+			continue
+		}
+		if err == nil && !bytes.Equal(data, []byte{0x17, 0x01}) {
+			t.Errorf("%s: tag data % x", tt.name, data)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/iotv/rtmp-tee-server/flv
+
+go 1.12
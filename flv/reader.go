@@ -0,0 +1,83 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// A Reader demuxes the tags of an FLV file. The file header must be read with
+// ReadHeader before any tag.
+type Reader struct {
+	r          io.Reader
+	readHeader bool
+}
+
+// NewReader returns a Reader reading an FLV file from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadHeader reads the FLV file header and the first PreviousTagSize field and
+// returns the header flags, a combination of FlagAudio and FlagVideo.
+func (r *Reader) ReadHeader() (flags uint8, err error) {
+	if r.readHeader {
+		return 0, errors.New("flv: header already read")
+	}
+	b := make([]byte, headerLen)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return 0, fmt.Errorf("flv: read header failed: %s", err.Error())
+	}
+	if string(b[0:3]) != "FLV" {
+		return 0, errors.New("flv: not an FLV file")
+	}
+	if b[3] != 1 {
+		return 0, fmt.Errorf("flv: unsupported version: %d", b[3])
+	}
+	offset := binary.BigEndian.Uint32(b[5:9])
+	if offset < headerLen {
+		return 0, fmt.Errorf("flv: invalid data offset: %d", offset)
+	}
+	// Skip any header extension along with PreviousTagSize0
+	if _, err := io.CopyN(ioutil.Discard, r.r, int64(offset-headerLen)+4); err != nil {
+		return 0, fmt.Errorf("flv: read header failed: %s", err.Error())
+	}
+	r.readHeader = true
+	return b[4] & (FlagAudio | FlagVideo), nil
+}
+
+// ReadTag reads the next tag and its PreviousTagSize trailer, returning the
+// tag type, the timestamp in milliseconds and the tag body. It returns io.EOF
+// once the file ends cleanly between tags.
+func (r *Reader) ReadTag() (tagType uint8, ts uint32, data []byte, err error) {
+	if !r.readHeader {
+		return 0, 0, nil, errors.New("flv: tag read before header")
+	}
+
+	h := make([]byte, tagHeaderLen)
+	if _, err := io.ReadFull(r.r, h); err != nil {
+		if err == io.EOF {
+			return 0, 0, nil, io.EOF
+		}
+		return 0, 0, nil, fmt.Errorf("flv: read tag failed: %s", err.Error())
+	}
+	if h[0]&0x20 != 0 {
+		return 0, 0, nil, errors.New("flv: encrypted tags are not supported")
+	}
+	tagType = h[0] & 0x1F
+	size := getUint24(h[1:4])
+	ts = getUint24(h[4:7]) | uint32(h[7])<<24
+
+	// The body and trailer are read together
+	b := make([]byte, size+4)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return 0, 0, nil, fmt.Errorf("flv: read tag failed: %s", err.Error())
+	}
+	return tagType, ts, b[:size], nil
+}
+
+func getUint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
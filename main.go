@@ -1,10 +1,176 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/iotv/rtmp-tee-server/rtmp"
 )
 
+// teeFlag collects repeated -tee app/stream=rtmp://host/app/stream flags into
+// a rtmp.Server Tee configuration.
+type teeFlag map[string][]rtmp.TeeOutput
+
+func (f teeFlag) String() string {
+	return fmt.Sprint(map[string][]rtmp.TeeOutput(f))
+}
+
+func (f teeFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("tee must be of the form app/stream=rtmp://host/app/stream, got: %q", v)
+	}
+	key := v[:i]
+	f[key] = append(f[key], rtmp.TeeOutput{URL: v[i+1:]})
+	return nil
+}
+
+// ingestFlag collects repeated -ingest app/stream=file.flv flags, mapping
+// each stream to the FLV file published as it.
+type ingestFlag map[string]string
+
+func (f ingestFlag) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f ingestFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 || i == len(v)-1 || strings.IndexByte(v[:i], '/') <= 0 {
+		return fmt.Errorf("ingest must be of the form app/stream=file.flv, got: %q", v)
+	}
+	f[v[:i]] = v[i+1:]
+	return nil
+}
+
+// levelFlag parses the -log-level flag, one of debug, info, warn and error.
+type levelFlag rtmp.Level
+
+func (f *levelFlag) String() string {
+	return strings.ToLower(rtmp.Level(*f).String())
+}
+
+func (f *levelFlag) Set(v string) error {
+	for _, l := range []rtmp.Level{rtmp.LevelDebug, rtmp.LevelInfo, rtmp.LevelWarn, rtmp.LevelError} {
+		if strings.EqualFold(v, l.String()) {
+			*f = levelFlag(l)
+			return nil
+		}
+	}
+	return fmt.Errorf("log level must be one of debug, info, warn and error, got: %q", v)
+}
+
+// flagTimeout converts a timeout flag, where 0 disables the timeout as it
+// does for -record-rotate, to a rtmp.Server timeout, where that is negative.
+func flagTimeout(d time.Duration) time.Duration {
+	if d == 0 {
+		return -1
+	}
+	return d
+}
+
 func main() {
-	server := rtmp.Server{}
-	_ = server.ListenAndServe()
+	tee := teeFlag{}
+	addr := flag.String("addr", ":1935", "address to listen on")
+	flag.Var(tee, "tee", "relay a published stream to an RTMP URL, as app/stream=rtmp://host/app/stream (repeatable)")
+	record := flag.String("record", "", "record published streams to FLV files named by this template, e.g. "+rtmp.DefaultRecordPath)
+	recordRotate := flag.Duration("record-rotate", 0, "start a new recording file after this duration (0 disables)")
+	ingest := ingestFlag{}
+	flag.Var(ingest, "ingest", "publish an FLV file as a stream, as app/stream=file.flv (repeatable)")
+	ingestLoop := flag.Bool("ingest-loop", false, "replay ingested files whenever they end")
+	authKeys := flag.String("auth-keys", "", "require publishers to pass a key from this file, of app/stream key lines, as stream?key=...")
+	authSecret := flag.String("auth-secret", "", "require publishers to pass an expiring token signed with this secret, as stream?expires=...&token=...")
+	authPlay := flag.Bool("auth-play", false, "require players to authenticate like publishers")
+	tlsAddr := flag.String("tls-addr", "", "address to serve RTMPS on, e.g. :443 (requires -tls-cert and -tls-key)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file for RTMPS, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key file for RTMPS, reloaded when it changes")
+	handshakeTimeout := flag.Duration("handshake-timeout", rtmp.DefaultHandshakeTimeout, "close connections which have not completed the handshake after this long (0 disables)")
+	readTimeout := flag.Duration("read-timeout", rtmp.DefaultReadTimeout, "close connections which have sent nothing for this long (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", rtmp.DefaultWriteTimeout, "close connections a message could not be written to for this long (0 disables)")
+	publishTimeout := flag.Duration("publish-timeout", rtmp.DefaultPublishTimeout, "close publishers which have sent no media for this long (0 disables)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "on SIGINT or SIGTERM, wait this long for connections to close before closing them")
+	logLevel := levelFlag(rtmp.LevelInfo)
+	flag.Var(&logLevel, "log-level", "log entries of this level and above: debug, info, warn or error")
+	flag.Parse()
+
+	logger := rtmp.NewStdLogger(nil, rtmp.Level(logLevel))
+
+	server := rtmp.Server{
+		Addr:             *addr,
+		Tee:              tee,
+		Logger:           logger,
+		HandshakeTimeout: flagTimeout(*handshakeTimeout),
+		ReadTimeout:      flagTimeout(*readTimeout),
+		WriteTimeout:     flagTimeout(*writeTimeout),
+		PublishTimeout:   flagTimeout(*publishTimeout),
+	}
+	switch {
+	case *authKeys != "" && *authSecret != "":
+		log.Fatal("only one of -auth-keys and -auth-secret may be set")
+	case *authKeys != "":
+		a, err := rtmp.NewKeyFileAuthenticator(*authKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.ProtectPlay = *authPlay
+		a.Logger = logger
+		server.Authenticator = a
+	case *authSecret != "":
+		server.Authenticator = &rtmp.TokenAuthenticator{Secret: []byte(*authSecret), ProtectPlay: *authPlay}
+	}
+	if *record != "" {
+		server.Record = &rtmp.RecordConfig{Path: *record, MaxDuration: *recordRotate}
+	}
+	// Ingested files stop with the server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for key, path := range ingest {
+		i := strings.IndexByte(key, '/')
+		go func(app, name, path string) {
+			err := server.PublishFile(ctx, path, app, name, *ingestLoop)
+			if err != nil && ctx.Err() == nil {
+				logger.Log(rtmp.LevelError, "ingest failed", "key", app+"/"+name, "err", err)
+			}
+		}(key[:i], key[i+1:], path)
+	}
+	if *tlsAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-addr requires -tls-cert and -tls-key")
+		}
+		ln, err := net.Listen("tcp", *tlsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := server.ServeTLS(ln, *tlsCert, *tlsKey); err != rtmp.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cancel()
+		sctx, scancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer scancel()
+		if err := server.Shutdown(sctx); err != nil {
+			logger.Log(rtmp.LevelWarn, "shutdown timed out, closing connections", "err", err)
+			server.Close()
+		}
+		close(done)
+	}()
+	if err := server.ListenAndServe(); err != rtmp.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,255 @@
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An AuthAction is what a peer asks an Authenticator to be allowed to do.
+type AuthAction int
+
+const (
+	AuthConnect AuthAction = iota // connect to an app
+	AuthPublish                   // publish a stream
+	AuthPlay                      // play a stream
+)
+
+func (a AuthAction) String() string {
+	switch a {
+	case AuthConnect:
+		return "connect"
+	case AuthPublish:
+		return "publish"
+	case AuthPlay:
+		return "play"
+	}
+	return "AuthAction(" + strconv.Itoa(int(a)) + ")"
+}
+
+// An AuthRequest describes a connect, publish or play to be authenticated.
+type AuthRequest struct {
+	Action AuthAction
+
+	// App is the app the peer connected to. Stream is the stream name
+	// without its query string and Key the stream key, "app/stream", both
+	// empty for AuthConnect.
+	App    string
+	Stream string
+	Key    string
+
+	// Query is the query string of the stream name, or of the tcUrl for
+	// AuthConnect.
+	Query url.Values
+
+	RemoteAddr net.Addr
+
+	// Params are the parameters the peer connected with.
+	Params *ConnectParams
+}
+
+// An Authenticator decides whether peers may connect, publish and play.
+//
+// Authenticate returns nil to accept req and an error describing why it is
+// rejected otherwise. Rejected connects are answered with
+// NetConnection.Connect.Rejected and the connection is closed, rejected
+// publishes with NetStream.Publish.BadName and rejected plays with
+// NetStream.Play.Failed. The error is sent to the peer as the description.
+//
+// Authenticate is called from the connection's read loop with the context of
+// the connection, so it should not block for long.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *AuthRequest) error
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of ordinary
+// functions as Authenticators.
+type AuthenticatorFunc func(context.Context, *AuthRequest) error
+
+// Authenticate calls f(ctx, req).
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req *AuthRequest) error {
+	return f(ctx, req)
+}
+
+// authenticate asks the server's Authenticator, if any, whether the peer
+// connecting or connected with params may take action on the stream name,
+// which carries its query string. name is ignored for AuthConnect.
+func (c *conn) authenticate(action AuthAction, params *ConnectParams, name string) error {
+	if c.server == nil || c.server.Authenticator == nil {
+		return nil
+	}
+	req := &AuthRequest{
+		Action:     action,
+		App:        params.App,
+		RemoteAddr: c.rwc.RemoteAddr(),
+		Params:     params,
+	}
+	var rawQuery string
+	if action == AuthConnect {
+		if u, err := url.Parse(params.TcUrl); err == nil {
+			rawQuery = u.RawQuery
+		}
+	} else {
+		req.Stream = name
+		if i := strings.IndexByte(name, '?'); i >= 0 {
+			req.Stream, rawQuery = name[:i], name[i+1:]
+		}
+		req.Key = streamKey(params.App, name)
+	}
+	req.Query, _ = url.ParseQuery(rawQuery) // keep what parses
+	return c.server.Authenticator.Authenticate(c.ctx, req)
+}
+
+// errAccessDenied is the error the built-in Authenticators reject with. It
+// tells the peer nothing about why.
+var errAccessDenied = errors.New("access denied")
+
+// A KeyFileAuthenticator requires publishers to pass a key listed in a file,
+// as the key parameter of the stream name's query string, e.g. publishing
+// "stream?key=s3cret". Connects are always accepted, and plays too unless
+// ProtectPlay is set.
+//
+// Every line of the file holds a stream key, "app/stream", and a key allowed
+// for it, separated by white space. The stream may be "*" to allow the key
+// for every stream of the app. Empty lines and lines starting with # are
+// ignored. The file is read again whenever it changes.
+type KeyFileAuthenticator struct {
+	Path        string
+	ProtectPlay bool
+
+	// Logger, if non-nil, is told when the file fails to load, which
+	// rejects everyone.
+	Logger Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    map[string][]string // by stream key
+}
+
+// NewKeyFileAuthenticator returns a KeyFileAuthenticator for the key file
+// path, reading it once to report errors early.
+func NewKeyFileAuthenticator(path string) (*KeyFileAuthenticator, error) {
+	a := &KeyFileAuthenticator{Path: path}
+	if _, err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *KeyFileAuthenticator) Authenticate(ctx context.Context, req *AuthRequest) error {
+	if req.Action == AuthConnect || req.Action == AuthPlay && !a.ProtectPlay {
+		return nil
+	}
+	keys, err := a.load()
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Log(LevelError, "key file failed to load", "err", err)
+		}
+		return errAccessDenied
+	}
+	key := req.Query.Get("key")
+	if key == "" {
+		return errAccessDenied
+	}
+	for _, k := range [][]string{keys[req.Key], keys[req.App+"/*"]} {
+		for _, allowed := range k {
+			if hmac.Equal([]byte(key), []byte(allowed)) {
+				return nil
+			}
+		}
+	}
+	return errAccessDenied
+}
+
+// load returns the keys of the file, reading it again if it changed since it
+// was last read.
+func (a *KeyFileAuthenticator) load() (map[string][]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fi, err := os.Stat(a.Path)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: key file: %s", err.Error())
+	}
+	if a.keys != nil && fi.ModTime().Equal(a.modTime) {
+		return a.keys, nil
+	}
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: key file: %s", err.Error())
+	}
+	defer f.Close()
+	keys := make(map[string][]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.IndexByte(fields[0], '/') <= 0 {
+			return nil, fmt.Errorf("rtmp: key file %s:%d: expected app/stream and key", a.Path, n)
+		}
+		keys[fields[0]] = append(keys[fields[0]], fields[1])
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("rtmp: key file: %s", err.Error())
+	}
+	a.keys, a.modTime = keys, fi.ModTime()
+	return keys, nil
+}
+
+// A TokenAuthenticator requires publishers to pass a token signed with
+// Secret which has not expired yet, in the query string of the stream name,
+// e.g. publishing "stream?expires=1700000000&token=...". Tokens are made with
+// Token. Connects are always accepted, and plays too unless ProtectPlay is
+// set, in which case players need a token for the stream too.
+type TokenAuthenticator struct {
+	Secret      []byte
+	ProtectPlay bool
+}
+
+// Token returns the query string, without the leading "?", which lets a peer
+// publish or play the stream key "app/stream" until expires.
+func (a *TokenAuthenticator) Token(key string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return "expires=" + exp + "&token=" + a.sign(key, exp)
+}
+
+// Authenticate implements Authenticator.
+func (a *TokenAuthenticator) Authenticate(ctx context.Context, req *AuthRequest) error {
+	if req.Action == AuthConnect || req.Action == AuthPlay && !a.ProtectPlay {
+		return nil
+	}
+	exp := req.Query.Get("expires")
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errAccessDenied
+	}
+	if time.Now().Unix() >= expires {
+		return errors.New("token expired")
+	}
+	if !hmac.Equal([]byte(req.Query.Get("token")), []byte(a.sign(req.Key, exp))) {
+		return errAccessDenied
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the stream key and expiry time.
+func (a *TokenAuthenticator) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,172 @@
+package rtmp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authRequest returns the request of a peer taking action on the stream
+// name, with its query string, in app.
+func authRequest(action AuthAction, app, name string) *AuthRequest {
+	req := &AuthRequest{Action: action, App: app, Stream: name}
+	var rawQuery string
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		req.Stream, rawQuery = name[:i], name[i+1:]
+	}
+	req.Key = app + "/" + req.Stream
+	req.Query, _ = url.ParseQuery(rawQuery)
+	return req
+}
+
+func writeKeyFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeyFileAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeKeyFile(t, dir, `
+# comment
+live/abc  s3cret
+live/abc  other
+live/*    wild
+`)
+	a, err := NewKeyFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		action AuthAction
+		app    string
+		name   string
+		ok     bool
+	}{
+		{AuthConnect, "live", "", true},
+		{AuthPublish, "live", "abc?key=s3cret", true},
+		{AuthPublish, "live", "abc?key=other", true},
+		{AuthPublish, "live", "abc?key=wild", true},
+		{AuthPublish, "live", "xyz?key=wild", true},
+		{AuthPublish, "live", "xyz?key=s3cret", false},
+		{AuthPublish, "live", "abc?key=wrong", false},
+		{AuthPublish, "live", "abc?key=", false},
+		{AuthPublish, "live", "abc", false},
+		{AuthPublish, "other", "abc?key=s3cret", false},
+		{AuthPlay, "live", "abc", true},
+	}
+	for _, tt := range tests {
+		err := a.Authenticate(context.Background(), authRequest(tt.action, tt.app, tt.name))
+		if (err == nil) != tt.ok {
+			t.Errorf("%v %s/%s: %v, want ok %t", tt.action, tt.app, tt.name, err, tt.ok)
+		}
+	}
+
+	a.ProtectPlay = true
+	if err := a.Authenticate(context.Background(), authRequest(AuthPlay, "live", "abc")); err == nil {
+		t.Error("play without key accepted with ProtectPlay")
+	}
+	if err := a.Authenticate(context.Background(), authRequest(AuthPlay, "live", "abc?key=s3cret")); err != nil {
+		t.Errorf("play with key: %v", err)
+	}
+
+	// The file is read again once it changes
+	writeKeyFile(t, dir, "live/abc new\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate(context.Background(), authRequest(AuthPublish, "live", "abc?key=s3cret")); err == nil {
+		t.Error("removed key accepted")
+	}
+	if err := a.Authenticate(context.Background(), authRequest(AuthPublish, "live", "abc?key=new")); err != nil {
+		t.Errorf("added key: %v", err)
+	}
+
+	// Everyone is rejected once the file is gone
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authenticate(context.Background(), authRequest(AuthPublish, "live", "abc?key=new")); err == nil {
+		t.Error("key accepted without a key file")
+	}
+}
+
+func TestKeyFileAuthenticatorBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewKeyFileAuthenticator(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing key file loaded")
+	}
+	for _, content := range []string{
+		"live/abc\n",
+		"live/abc key extra\n",
+		"abc key\n",
+		"/abc key\n",
+	} {
+		if _, err := NewKeyFileAuthenticator(writeKeyFile(t, dir, content)); err == nil {
+			t.Errorf("key file %q loaded", content)
+		}
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := &TokenAuthenticator{Secret: []byte("secret")}
+	valid := a.Token("live/abc", time.Now().Add(time.Hour))
+	expired := a.Token("live/abc", time.Now().Add(-time.Second))
+
+	q, _ := url.ParseQuery(valid)
+	tampered := url.Values{"expires": q["expires"], "token": {strings.Repeat("0", len(q.Get("token")))}}
+	// Pushing the expiry out invalidates the signature
+	extended := url.Values{"expires": {"99999999999"}, "token": q["token"]}
+	otherSecret := (&TokenAuthenticator{Secret: []byte("other")}).Token("live/abc", time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		action AuthAction
+		stream string
+		ok     bool
+	}{
+		{"connect", AuthConnect, "", true},
+		{"valid", AuthPublish, "abc?" + valid, true},
+		{"other stream", AuthPublish, "xyz?" + valid, false},
+		{"expired", AuthPublish, "abc?" + expired, false},
+		{"tampered signature", AuthPublish, "abc?" + tampered.Encode(), false},
+		{"extended expiry", AuthPublish, "abc?" + extended.Encode(), false},
+		{"other secret", AuthPublish, "abc?" + otherSecret, false},
+		{"no token", AuthPublish, "abc", false},
+		{"bad expiry", AuthPublish, "abc?expires=soon&token=x", false},
+		{"play", AuthPlay, "abc", true},
+	}
+	for _, tt := range tests {
+		err := a.Authenticate(context.Background(), authRequest(tt.action, "live", tt.stream))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+
+	a.ProtectPlay = true
+	if err := a.Authenticate(context.Background(), authRequest(AuthPlay, "live", "abc")); err == nil {
+		t.Error("play without token accepted with ProtectPlay")
+	}
+	if err := a.Authenticate(context.Background(), authRequest(AuthPlay, "live", "abc?"+valid)); err != nil {
+		t.Errorf("play with token: %v", err)
+	}
+}
@@ -25,12 +25,40 @@ type chunkBasicHeader struct {
 	ChunkStreamId            uint32
 }
 
+// defaultChunkSize is the maximum chunk payload size in effect in both
+// directions until a peer negotiates a different one with Set Chunk Size.
+const defaultChunkSize = 128
+
+// chunkStream holds the state of a single incoming chunk stream. Type 1, 2
+// and 3 chunk message headers omit fields which are resolved against the
+// previous header received on the same chunk stream id, so a connection keeps
+// one of these per chunk stream id. Messages larger than the chunk size are
+// reassembled here from type 3 continuation chunks.
+type chunkStream struct {
+	id uint32
+
+	// Stateful information about the previous incoming message
+	msgTime   *time.Time // Actual time it came in
+	msgTs     *uint32    // Timestamp on the message
+	msgTsD    *uint32    // Timestamp delta
+	msgLen    *uint32    // Message length
+	msgTypId  *uint8     // Message type ID
+	msgStrmId *uint32    // Message stream ID
+
+	// extTs is set when the last message header carried an extended
+	// timestamp, which is then repeated on type 3 chunks.
+	extTs bool
+
+	// Payload of the message currently being assembled. It is nil between
+	// messages.
+	buf []byte
+}
+
 func (c *conn) receiveChunkBasicHeader(ctx context.Context) (*chunkBasicHeader, error) {
 	// FIXME: debug log this
 	basicHeaderType, err := c.bufr.Peek(1)
 	if err != nil {
-		// FIXME
-		return nil, err
+		return nil, fmt.Errorf("rtmp: read chunk basic header failed: %s", err.Error())
 	}
 	var basicHeaderLen int
 	// Apply a "bit clear" (AND NOT) to bit mask 0b11000000, removing the chunk format
@@ -50,10 +78,8 @@ func (c *conn) receiveChunkBasicHeader(ctx context.Context) (*chunkBasicHeader,
 	basicHeader := make([]byte, basicHeaderLen)
 
 	// Read basic header for the chunk
-	if bHLen, err := io.ReadFull(c.bufr, basicHeader); bHLen != basicHeaderLen {
-		return nil, fmt.Errorf("rtmp: read basic header failed: expected %d len header, got: %d", basicHeaderLen, bHLen)
-	} else if err != nil {
-		return nil, fmt.Errorf("rtmp: read chunk basic header failed: %s", err.Error())
+	if bHLen, err := io.ReadFull(c.bufr, basicHeader); err != nil {
+		return nil, fmt.Errorf("rtmp: read chunk basic header failed: expected %d len header, got: %d: %s", basicHeaderLen, bHLen, err.Error())
 	}
 
 	// read fmt from first 2 bits and move them from the most significant bits to the least significant bits
@@ -73,12 +99,9 @@ func (c *conn) receiveChunkBasicHeader(ctx context.Context) (*chunkBasicHeader,
 		//  stream IDs 64-65599 can be encoded in the 3-byte version of
 		// this field. ID is computed as ((the third byte)*256 + (the second
 		// byte) + 64)
-		streamId += (uint32(basicHeader[2]) * 256) + 64
+		streamId += (uint32(basicHeader[2]) * 256) + uint32(basicHeader[1]) + 64
 	}
 
-	if basicHeaderLen == 2 || basicHeaderLen == 3 {
-		streamId += 64 // 2 and 3 byte headers exclude IDs 2-63. It's ghetto. It's RTMP.
-	}
 	return &chunkBasicHeader{
 			ChunkMessageHeaderFormat: chunkHeaderType(chunkHeaderFormat),
 			ChunkStreamId:            streamId,
@@ -86,230 +109,340 @@ func (c *conn) receiveChunkBasicHeader(ctx context.Context) (*chunkBasicHeader,
 		nil
 }
 
-func (c *conn) receiveChunkMessageHeader(ctx context.Context) ([]byte, error) {
-	return nil, nil
-}
+// receiveChunkMessageHeader reads the chunk message header following a basic
+// header and applies it to the state of the chunk stream it belongs to.
+func (c *conn) receiveChunkMessageHeader(ctx context.Context, basicHeader *chunkBasicHeader) (*chunkStream, error) {
+	cs, ok := c.chunkStreams[basicHeader.ChunkStreamId]
+	if !ok {
+		cs = &chunkStream{id: basicHeader.ChunkStreamId}
+		c.chunkStreams[basicHeader.ChunkStreamId] = cs
+	}
 
-func (c *conn) receiveChunkExtendedTimestamp(ctx context.Context) ([]byte, error) {
-	return nil, nil
-}
+	// Only type 3 chunks may continue a message that is being assembled
+	if basicHeader.ChunkMessageHeaderFormat != type3 && cs.buf != nil {
+		return nil, fmt.Errorf("rtmp: chunk stream %d: type %d header received before previous message was complete", cs.id, basicHeader.ChunkMessageHeaderFormat)
+	}
 
-func (c *conn) receiveChunkHeader(ctx context.Context) ([]byte, error) {
-	return nil, nil
+	var err error
+	switch basicHeader.ChunkMessageHeaderFormat {
+	case type0:
+		err = c.readType0MessageHeader(ctx, cs)
+	case type1:
+		err = c.readType1MessageHeader(ctx, cs)
+	case type2:
+		err = c.readType2MessageHeader(ctx, cs)
+	default: // implied type 3 header
+		err = c.verifyType3MessageHeader(ctx, cs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
 }
 
-func (c *conn) receiveChunkData(ctx context.Context) ([]byte, error) {
-	return nil, nil
+// extendedTimestamp is the value of the 3 byte timestamp or timestamp delta
+// field signalling that the actual value follows the message header in a 4 byte
+// extended timestamp field.
+const extendedTimestamp = 0xFFFFFF
+
+// receiveChunkExtendedTimestamp reads the 4 byte extended timestamp field that
+// follows a chunk message header whose timestamp field was 0xFFFFFF.
+func (c *conn) receiveChunkExtendedTimestamp(ctx context.Context) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c.bufr, b); err != nil {
+		return 0, fmt.Errorf("rtmp: read extended timestamp failed: %s", err.Error())
+	}
+	return binary.BigEndian.Uint32(b), nil
 }
 
-func (c *conn) receiveChunk(ctx context.Context) ([]byte, error) {
+// receiveChunkHeader reads a full chunk header, basic and message header, and
+// returns the chunk stream the chunk's data belongs to.
+func (c *conn) receiveChunkHeader(ctx context.Context) (*chunkStream, error) {
 	basicHeader, err := c.receiveChunkBasicHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.receiveChunkMessageHeader(ctx, basicHeader)
+}
 
-	// Chunk Message header
-	switch basicHeader.ChunkMessageHeaderFormat {
-	case type0:
-		err = c.readType0MessageHeader()
-	case type1:
-		err = c.readType1MessageHeader()
-	case type2:
-		err = c.readType2MessageHeader()
-	default: // implied type 3 header
-		err = c.verifyType3MessageHeader()
+// receiveChunkData reads the data of a single chunk into the message being
+// assembled on cs. At most one chunk size worth of data is read. Once the
+// whole message has been received it is returned and cs is reset for the next
+// message, otherwise the returned message is nil.
+func (c *conn) receiveChunkData(ctx context.Context, cs *chunkStream) (*Message, error) {
+	remaining := *cs.msgLen - uint32(len(cs.buf))
+	n := remaining
+	if n > c.incChunkSize {
+		n = c.incChunkSize
+	}
+
+	// The buffer grows by at most one chunk at a time so a peer has to actually
+	// send the bytes of the message length it announces to make us hold them.
+	start := len(cs.buf)
+	if cs.buf == nil {
+		cs.buf = make([]byte, 0, n)
 	}
+	cs.buf = append(cs.buf, make([]byte, n)...)
+	if _, err := io.ReadFull(c.bufr, cs.buf[start:]); err != nil {
+		return nil, fmt.Errorf("rtmp: read chunk data failed: %s", err.Error())
+	}
+
+	if uint32(len(cs.buf)) < *cs.msgLen {
+		return nil, nil
+	}
+
+	msg := &Message{
+		ChunkStreamId: cs.id,
+		Timestamp:     *cs.msgTs,
+		TypeId:        MessageType(*cs.msgTypId),
+		StreamId:      *cs.msgStrmId,
+		Payload:       cs.buf,
+	}
+	cs.buf = nil
+	return msg, nil
+}
+
+// receiveChunk reads a single chunk from the connection. It returns a message
+// when the chunk completes one and nil when more chunks are needed.
+func (c *conn) receiveChunk(ctx context.Context) (*Message, error) {
+	cs, err := c.receiveChunkHeader(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("rtmp: receive chunk failed: %s", err.Error())
 	}
+	return c.receiveChunkData(ctx, cs)
+}
 
-	// FIXME: do not allocate memory based on a network peer's demands. set a limit and obey it
-	message := make([]byte, *c.prvIncMsgLen)
-	c.bufr.Read(message)
-
-	switch *c.prvIncMsgTypId {
-	case 20: // AMF0 command message
-		// write a user result amf0
-		amf0 := &amf.AMF0Msg{}
-		if err := amf0.UnmarshalBinary(message); err != nil {
+// receiveMessage reads chunks from the connection, which may be interleaved
+// across chunk streams, until one of them completes a message. The peer is
+// acknowledged as it crosses its window size.
+func (c *conn) receiveMessage(ctx context.Context) (*Message, error) {
+	for {
+		msg, err := c.receiveChunk(ctx)
+		if err != nil {
 			return nil, err
 		}
-		v, ok := (*amf0)[0]
-		if !ok {
-			fmt.Println("Tots bonkers message. ---")
-		} else {
-			switch v {
-			case "connect":
-				c.writeAMF0NetConnectionConnectSuccess()
-			case "FCPublish":
-				f := (*amf0)[1].(float64)
-				c.writeAMF0FCPublishSuccess(f)
-			case "releaseStream":
-				f := (*amf0)[1].(float64)
-				c.writeAMF0ReleaseStreamSuccess(f)
-			case "createStream":
-				f := (*amf0)[1].(float64)
-				c.writeAMF0CreateStreamSuccess(f)
-			case "publish":
-				f := (*amf0)[1].(float64)
-				c.writeAMF0CreateStreamSuccess(f)
-			}
+		if err := c.acknowledge(); err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
 		}
 	}
-	return nil, nil
 }
 
-func (c *conn) readType0MessageHeader() error {
+func (c *conn) readType0MessageHeader(ctx context.Context, cs *chunkStream) error {
 	now := time.Now()
 
 	header := make([]byte, 11)
-	if hLen, err := c.bufr.Read(header); hLen != 11 {
-		return fmt.Errorf("rtmp: read message header failed: expected 11 len header, got: %d", hLen)
-	} else if err != nil {
-		return fmt.Errorf("rtmp: read message header failed: %s", err.Error())
+	if hLen, err := io.ReadFull(c.bufr, header); err != nil {
+		return fmt.Errorf("rtmp: read message header failed: expected 11 len header, got: %d: %s", hLen, err.Error())
 	}
 
 	msgTs := binary.BigEndian.Uint32(append([]byte{0}, header[0:3]...))
-	// FIXME: handle extended timestamp
+	extTs := msgTs == extendedTimestamp
+	if extTs {
+		var err error
+		if msgTs, err = c.receiveChunkExtendedTimestamp(ctx); err != nil {
+			return err
+		}
+	}
 
 	msgLen := binary.BigEndian.Uint32(append([]byte{0}, header[3:6]...))
 	msgTypId := uint8(header[6])
-	msgStrmId := binary.BigEndian.Uint32(header[7:])
+	// Message stream ID is the only little endian field in the chunk header
+	msgStrmId := binary.LittleEndian.Uint32(header[7:])
+
+	// A type 3 chunk starting a new message after a type 0 chunk uses the
+	// type 0 timestamp as its delta
+	msgTsD := msgTs
 
-	c.prvIncMsgTime = &now
-	c.prvIncMsgTs = &msgTs
-	c.prvIncMsgLen = &msgLen
-	c.prvIncMsgTypId = &msgTypId
-	c.prvIncMsgStrmId = &msgStrmId
+	cs.msgTime = &now
+	cs.msgTs = &msgTs
+	cs.msgTsD = &msgTsD
+	cs.msgLen = &msgLen
+	cs.msgTypId = &msgTypId
+	cs.msgStrmId = &msgStrmId
+	cs.extTs = extTs
 
 	return nil
 }
 
-func (c *conn) readType1MessageHeader() error {
-	if c.prvIncMsgStrmId == nil {
+func (c *conn) readType1MessageHeader(ctx context.Context, cs *chunkStream) error {
+	if cs.msgStrmId == nil {
 		return errors.New("rtmp: cannot read type 1 message header if no previous type 0 has been sent with stream id")
 	}
-	if c.prvIncMsgTs == nil {
+	if cs.msgTs == nil {
 		return errors.New("rtmp: cannot read type 1 message header if no previous type 0, has been sent with message timestamp")
 	}
 
 	now := time.Now()
 
 	header := make([]byte, 7)
-	if hLen, err := c.bufr.Read(header); hLen != 7 {
-		return fmt.Errorf("rtmp: read message header failed")
-	} else if err != nil {
+	if _, err := io.ReadFull(c.bufr, header); err != nil {
 		return fmt.Errorf("rtmp: read message header failed: %s", err.Error())
 	}
 
 	msgTsD := binary.BigEndian.Uint32(append([]byte{0}, header[0:3]...))
-	msgTs := (*c.prvIncMsgTs + msgTsD) % 0x01000000 // keep it to 3 bytes by rolling it
-	// FIXME: handle extended timestamp
+	extTs := msgTsD == extendedTimestamp
+	if extTs {
+		var err error
+		if msgTsD, err = c.receiveChunkExtendedTimestamp(ctx); err != nil {
+			return err
+		}
+	}
+	msgTs := *cs.msgTs + msgTsD // 32 bit timestamps wrap around by design
 
 	msgLen := binary.BigEndian.Uint32(append([]byte{0}, header[3:6]...))
 	msgTypId := uint8(header[6])
 
-	c.prvIncMsgTime = &now
-	c.prvIncMsgTsD = &msgTsD
-	c.prvIncMsgTs = &msgTs
-	c.prvIncMsgLen = &msgLen
-	c.prvIncMsgTypId = &msgTypId
+	cs.msgTime = &now
+	cs.msgTsD = &msgTsD
+	cs.msgTs = &msgTs
+	cs.msgLen = &msgLen
+	cs.msgTypId = &msgTypId
+	cs.extTs = extTs
 
 	return nil
 }
 
-func (c *conn) readType2MessageHeader() error {
-	if c.prvIncMsgStrmId == nil {
+func (c *conn) readType2MessageHeader(ctx context.Context, cs *chunkStream) error {
+	if cs.msgStrmId == nil {
 		return errors.New("rtmp: cannot read type 2 message header if no previous type 0 has been sent with stream id")
 	}
-	if c.prvIncMsgTs == nil {
+	if cs.msgTs == nil {
 		return errors.New("rtmp: cannot read type 2 message header if no previous type 0, has been sent with message timestamp")
 	}
-	if c.prvIncMsgLen == nil {
+	if cs.msgLen == nil {
 		return errors.New("rtmp: cannot read type 2 message header if no previous type 0,1 has been sent with message length")
 	}
-	if c.prvIncMsgTypId == nil {
+	if cs.msgTypId == nil {
 		return errors.New("rtmp: cannot read type 2 message header if no previous type 0,1 has been sent with message type id")
 	}
 
 	now := time.Now()
 
 	header := make([]byte, 3)
-	if hLen, err := c.bufr.Read(header); hLen != 3 {
-		return errors.New("rtmp: read message header failed")
-	} else if err != nil {
+	if _, err := io.ReadFull(c.bufr, header); err != nil {
 		return fmt.Errorf("rtmp: read message header failed: %s", err.Error())
 	}
 
 	msgTsD := binary.BigEndian.Uint32(append([]byte{0}, header[0:3]...))
-	msgTs := (*c.prvIncMsgTs + msgTsD) % 0x01000000 // keep it to 3 bytes by rolling it
-	// FIXME: handle extended timestamp
+	extTs := msgTsD == extendedTimestamp
+	if extTs {
+		var err error
+		if msgTsD, err = c.receiveChunkExtendedTimestamp(ctx); err != nil {
+			return err
+		}
+	}
+	msgTs := *cs.msgTs + msgTsD // 32 bit timestamps wrap around by design
 
-	c.prvIncMsgTime = &now
-	c.prvIncMsgTsD = &msgTsD
-	c.prvIncMsgTs = &msgTs
+	cs.msgTime = &now
+	cs.msgTsD = &msgTsD
+	cs.msgTs = &msgTs
+	cs.extTs = extTs
 
 	return nil
 }
 
-func (c *conn) verifyType3MessageHeader() error {
-	if c.prvIncMsgStrmId == nil {
+func (c *conn) verifyType3MessageHeader(ctx context.Context, cs *chunkStream) error {
+	if cs.msgStrmId == nil {
 		return errors.New("rtmp: cannot read type 3 message header if no previous type 0 has been sent with stream id")
 	}
-	if c.prvIncMsgTs == nil {
+	if cs.msgTs == nil {
 		return errors.New("rtmp: cannot read type 3 message header if no previous type 0, has been sent with message timestamp")
 	}
-	if c.prvIncMsgLen == nil {
+	if cs.msgLen == nil {
 		return errors.New("rtmp: cannot read type 3 message header if no previous type 0,1 has been sent with message length")
 	}
-	if c.prvIncMsgTypId == nil {
+	if cs.msgTypId == nil {
 		return errors.New("rtmp: cannot read type 3 message header if no previous type 0,1 has been sent with message type id")
 	}
-	if c.prvIncMsgTsD == nil {
-		return errors.New("rtmp: cannot read type 3 message header if no previous type 1,2 has been sent with message timestamp delta")
+	if cs.msgTsD == nil {
+		return errors.New("rtmp: cannot read type 3 message header if no previous type 0,1,2 has been sent with message timestamp delta")
+	}
+
+	// A type 3 chunk continuing a message carries no new header information
+	// other than a repetition of the extended timestamp. Not every encoder
+	// repeats it on continuation chunks, so it is only consumed when the next 4
+	// bytes match the value we expect.
+	if cs.buf != nil {
+		if cs.extTs {
+			b, err := c.bufr.Peek(4)
+			if err != nil {
+				return fmt.Errorf("rtmp: read extended timestamp failed: %s", err.Error())
+			}
+			if binary.BigEndian.Uint32(b) == *cs.msgTsD {
+				c.bufr.Discard(4)
+			}
+		}
+		return nil
+	}
+
+	msgTsD := *cs.msgTsD
+	if cs.extTs {
+		var err error
+		if msgTsD, err = c.receiveChunkExtendedTimestamp(ctx); err != nil {
+			return err
+		}
 	}
 
 	now := time.Now()
 
-	msgTs := (*c.prvIncMsgTs + *c.prvIncMsgTsD) % 0x01000000 // keep it to 3 bytes by rolling it
+	msgTs := *cs.msgTs + msgTsD // 32 bit timestamps wrap around by design
+	cs.msgTsD = &msgTsD
 
-	c.prvIncMsgTime = &now
-	c.prvIncMsgTs = &msgTs
+	cs.msgTime = &now
+	cs.msgTs = &msgTs
 
 	return nil
 }
 
-// FIXME: parametrize variables
-func (c *conn) writeWindowSizeAcknowledgementChunk() error {
-	// write a window size acknowledgement chunk
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, 4, 5, 0, 2)
-	c.bufw.Write([]byte{0, 0, 250, 0})
-	c.bufw.Flush()
+// writeSetChunkSize tells the peer the maximum chunk size we will use from now
+// on and starts using it. The size changes under the same lock the message is
+// written with, so no other message can be chunked with the wrong size.
+func (c *conn) writeSetChunkSize(size uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, size&^0x80000000) // The most significant bit must be zero
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeChunks(&Message{TypeId: TypeSetChunkSize, Payload: b}); err != nil {
+		return err
+	}
+	c.outChunkSize = size
 	return nil
 }
 
-// FIXME: parameterize variables
-func (c *conn) writeSetPeerBandwidthChunk() error {
-	// set bandwidth
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, 5, 6, 0, 2)
-	c.bufw.Write([]byte{0, 5, 0, 0, 0})
-	c.bufw.Flush()
+// writeWindowSizeAcknowledgementChunk tells the peer to acknowledge every size
+// bytes it receives from us.
+func (c *conn) writeWindowSizeAcknowledgementChunk(size uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeChunks(&Message{TypeId: TypeWindowAcknowledgementSize, Payload: b}); err != nil {
+		return err
+	}
+	c.outAckWindowSize = size
 	return nil
 }
 
-// FIXME: figure out if this is even needed. extract parameters
-func (c *conn) writeRTMPStartStreamMessage() error {
-	// write this terrible rtmp start stream thing
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, 17, 4, 0, 2)
-	c.bufw.Write([]byte{4})       // rtmp message type???
-	c.bufw.Write([]byte{0, 0, 6}) // payload length
-	whocares := make([]byte, 4)
-	binary.BigEndian.PutUint32(whocares, getUint32MilsTimestamp())
-	c.bufw.Write(whocares)
-	c.bufw.Write([]byte{0, 0, 0})          // stream id 0?
-	c.bufw.Write([]byte{0, 0, 0, 0, 0, 0}) // ?? Stream begin. Stream 0?
-	c.bufw.Flush()
-	return nil
+// writeAcknowledgement acknowledges the first sequenceNum bytes received
+// from the peer.
+func (c *conn) writeAcknowledgement(sequenceNum uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, sequenceNum)
+	return c.writeMessage(&Message{TypeId: TypeAcknowledgement, Payload: b})
+}
+
+// writeSetPeerBandwidthChunk limits the output of the peer to size bytes
+// between our acknowledgements, with one of the limitType constants.
+func (c *conn) writeSetPeerBandwidthChunk(size uint32, limitType uint8) error {
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint32(b[0:4], size)
+	b[4] = limitType
+	return c.writeMessage(&Message{TypeId: TypeSetPeerBandwidth, Payload: b})
 }
 
 // writeChunkBasicHeader writes the first bytes of a chunk which is the
@@ -356,10 +489,11 @@ func (c *conn) writeChunkBasicHeader(format uint8, chunkStreamId uint32) error {
 		binary.BigEndian.PutUint32(csBytes, chunkStreamId-64)
 		csBytes[2] = (csBytes[2] &^ 0xC0) | fmtBits // clear bits then write fmtBits
 		c.bufw.Write(csBytes[2:4])                  // write only the least significant 2 bytes
-	case 320 <= chunkStreamId && chunkStreamId < 65599:
-		binary.BigEndian.PutUint32(csBytes, chunkStreamId-64)
-		csBytes[1] = (csBytes[1] &^ 0xC0) | fmtBits | 0x01 // clear bits then write fmtBits + 1 to signal 3 byte message
-		c.bufw.Write(csBytes[1:4])                         // write only the least significant 3 bytes
+	case 320 <= chunkStreamId && chunkStreamId <= 65599:
+		// The 3 byte form stores the id minus 64 in little endian order
+		binary.LittleEndian.PutUint16(csBytes[1:3], uint16(chunkStreamId-64))
+		csBytes[0] = fmtBits | 0x01 // write fmtBits + 1 to signal 3 byte message
+		c.bufw.Write(csBytes[0:3])  // write the marker and the least significant 2 bytes
 	default: // This shouldn't be reachable
 		return fmt.Errorf("rtmp: failed to write chunk basic header: invalid id: %d", chunkStreamId)
 	}
@@ -367,16 +501,65 @@ func (c *conn) writeChunkBasicHeader(format uint8, chunkStreamId uint32) error {
 	return nil
 }
 
-func (c *conn) writeChunkMessageHeader() error {
-	return nil
+// writeMessage writes msg to the connection as a type 0 chunk followed by as
+// many type 3 continuation chunks as the outgoing chunk size requires, and
+// flushes it to the network.
+func (c *conn) writeMessage(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeChunks(msg)
 }
 
-func (c *conn) writeType0ChunkMessageHeader(ts uint, msgLen uint32, msgType uint8, msgStrmId, chunkStreamId uint32) error {
-	// TODO: see if this is legal without updating the client epoch
-	if ts > 0xFFFFFF { // Despite being > 4 bytes, it must fit in 3
-		ts = ts % 0x01000000 // roll the timestamp.
+// writeChunks does the work of writeMessage. c.mu must be held.
+func (c *conn) writeChunks(msg *Message) error {
+	if c.writeTimeout > 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	chunkStreamId := msg.ChunkStreamId
+	if chunkStreamId == 0 {
+		chunkStreamId = defaultChunkStreamId(msg.TypeId)
+	}
+
+	if err := c.writeChunkBasicHeader(0, chunkStreamId); err != nil {
+		return err
+	}
+	if err := c.writeType0ChunkMessageHeader(msg.Timestamp, uint32(len(msg.Payload)), uint8(msg.TypeId), msg.StreamId, chunkStreamId); err != nil {
+		return err
+	}
+
+	payload := msg.Payload
+	for {
+		n := uint32(len(payload))
+		if n > c.outChunkSize {
+			n = c.outChunkSize
+		}
+		if _, err := c.bufw.Write(payload[:n]); err != nil {
+			return fmt.Errorf("rtmp: failed to write chunk data: %s", err.Error())
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		if err := c.writeChunkBasicHeader(3, chunkStreamId); err != nil {
+			return err
+		}
+		if err := c.writeType3ChunkMessageHeader(msg.Timestamp); err != nil {
+			return err
+		}
 	}
 
+	if err := c.bufw.Flush(); err != nil {
+		return fmt.Errorf("rtmp: failed to flush message: %s", err.Error())
+	}
+	return nil
+}
+
+func (c *conn) writeChunkMessageHeader() error {
+	return nil
+}
+
+func (c *conn) writeType0ChunkMessageHeader(ts uint32, msgLen uint32, msgType uint8, msgStrmId, chunkStreamId uint32) error {
 	if msgLen > 0xFFFFFF { // Despite being 4 bytes, it must fit in 3
 		return fmt.Errorf("rtmp: failed to write type 0 chunk message header: message length too large: %d", msgLen)
 	}
@@ -413,13 +596,17 @@ func (c *conn) writeType0ChunkMessageHeader(ts uint, msgLen uint32, msgType uint
 
 	// TODO: get some pooling going
 	tsBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(tsBytes, uint32(ts)) // we modulo'd above so truncate should have no effect
+	if ts >= extendedTimestamp { // Timestamps that do not fit in 3 bytes follow the header
+		binary.BigEndian.PutUint32(tsBytes, extendedTimestamp)
+	} else {
+		binary.BigEndian.PutUint32(tsBytes, ts)
+	}
 
 	msgLenBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(msgLenBytes, msgLen)
 
 	msgStrmIdBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(msgStrmIdBytes, msgStrmId)
+	binary.LittleEndian.PutUint32(msgStrmIdBytes, msgStrmId) // the only little endian field
 
 	// TODO: is this the best I can do?
 	messageHeader := append([]byte{}, tsBytes[1:]...)
@@ -427,9 +614,24 @@ func (c *conn) writeType0ChunkMessageHeader(ts uint, msgLen uint32, msgType uint
 	messageHeader = append(messageHeader, byte(msgType))
 	messageHeader = append(messageHeader, msgStrmIdBytes...)
 
-	if mHLen, err := c.bufw.Write(messageHeader); mHLen != 11 || err != nil {
+	if _, err := c.bufw.Write(messageHeader); err != nil {
 		return fmt.Errorf("rtmp: failed to write type 0 chunk message header: %s", err.Error())
 	}
+	return c.writeChunkExtendedTimestamp(ts)
+}
+
+// writeChunkExtendedTimestamp writes the 4 byte extended timestamp field if ts
+// does not fit in the 3 byte timestamp field of a chunk message header. It
+// writes nothing otherwise.
+func (c *conn) writeChunkExtendedTimestamp(ts uint32) error {
+	if ts < extendedTimestamp {
+		return nil
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, ts)
+	if _, err := c.bufw.Write(b); err != nil {
+		return fmt.Errorf("rtmp: failed to write extended timestamp: %s", err.Error())
+	}
 	return nil
 }
 
@@ -441,19 +643,19 @@ func (c *conn) writeType2ChunkMessageHeader() error {
 	return nil
 }
 
-func (c *conn) writeType3ChunkMessageHeader() error {
-	return nil
+// writeType3ChunkMessageHeader writes the header of a type 3 chunk continuing
+// a message with timestamp ts. Type 3 headers are empty apart from the extended
+// timestamp, which librtmp and FFmpeg repeat on every continuation chunk.
+func (c *conn) writeType3ChunkMessageHeader(ts uint32) error {
+	return c.writeChunkExtendedTimestamp(ts)
 }
 
-func (c *conn) writeAMF0PublishSuccess(tId float64) error {
-	msg := &amf.AMF0Msg{
-		0: "_result",
-		1: tId,
-		2: amf.AMF0Object{},
-		3: amf.AMF0Object{
-			"level": "status",
-			"code":  "NetConnection.Connect.Success",
-		},
+// writeAMF0Command writes an AMF0 command message made up of values to the
+// message stream streamId.
+func (c *conn) writeAMF0Command(streamId uint32, values ...interface{}) error {
+	msg := amf.AMF0Msg{}
+	for i, v := range values {
+		msg[i] = v
 	}
 	b, err := msg.MarshalBinary()
 	if err != nil {
@@ -463,109 +665,90 @@ func (c *conn) writeAMF0PublishSuccess(tId float64) error {
 		return errors.New("rtmp: AMF0 message too large")
 	}
 
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, uint32(len(b)), 20, 0, 2)
-	c.bufw.Write(b)
-	c.bufw.Flush()
-	return nil
+	return c.writeMessage(&Message{TypeId: TypeAMF0Command, StreamId: streamId, Payload: b})
 }
 
-func (c *conn) writeAMF0FCPublishSuccess(tId float64) error {
-	msg := &amf.AMF0Msg{
-		0: "_result",
-		1: tId,
-		2: amf.AMF0Object{},
-		3: amf.AMF0Object{
-			"level": "status",
-			"code":  "NetConnection.Connect.Success",
-		},
-	}
-	b, err := msg.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	if len(b) > 0xFFFFFF {
-		return errors.New("rtmp: AMF0 message too large")
-	}
+// writeAMF0OnStatus writes an onStatus command with an info object made of
+// level, code and description to the message stream streamId.
+func (c *conn) writeAMF0OnStatus(streamId uint32, level, code, description string) error {
+	return c.writeAMF0Command(streamId, "onStatus", 0.0, nil, amf.AMF0OrderedObject{
+		{Key: "level", Value: level},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	})
+}
 
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, uint32(len(b)), 20, 0, 2)
-	c.bufw.Write(b)
-	c.bufw.Flush()
-	return nil
+func (c *conn) writeAMF0PublishSuccess(streamId uint32, name string) error {
+	return c.writeAMF0OnStatus(streamId, "status", "NetStream.Publish.Start", name+" is now published.")
 }
 
-func (c *conn) writeAMF0CreateStreamSuccess(tId float64) error {
-	msg := &amf.AMF0Msg{
-		0: "_result",
-		1: tId,
-		2: amf.AMF0Object{},
-		3: amf.AMF0Object{
-			"level": "status",
-			"code":  "NetConnection.Connect.Success",
-		},
-	}
-	b, err := msg.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	if len(b) > 0xFFFFFF {
-		return errors.New("rtmp: AMF0 message too large")
-	}
+func (c *conn) writeAMF0UnpublishSuccess(streamId uint32, name string) error {
+	return c.writeAMF0OnStatus(streamId, "status", "NetStream.Unpublish.Success", name+" is now unpublished.")
+}
 
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, uint32(len(b)), 20, 0, 2)
-	c.bufw.Write(b)
-	c.bufw.Flush()
-	return nil
+// writeAMF0Result answers the command with transaction id tId with a _result
+// made up of values.
+func (c *conn) writeAMF0Result(tId float64, values ...interface{}) error {
+	return c.writeAMF0Command(0, append([]interface{}{"_result", tId}, values...)...)
+}
+
+// writeAMF0Error answers the command with transaction id tId with an _error
+// carrying an info object made of code and description.
+func (c *conn) writeAMF0Error(tId float64, code, description string) error {
+	return c.writeAMF0Command(0, "_error", tId, nil, amf.AMF0OrderedObject{
+		{Key: "level", Value: "error"},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	})
+}
+
+// writeAMF0CreateStreamSuccess answers createStream with the id of the message
+// stream created.
+func (c *conn) writeAMF0CreateStreamSuccess(tId float64, streamId uint32) error {
+	return c.writeAMF0Result(tId, nil, float64(streamId))
 }
 
 func (c *conn) writeAMF0ReleaseStreamSuccess(tId float64) error {
-	msg := &amf.AMF0Msg{
-		0: "_result",
-		1: tId,
-		2: amf.AMF0Object{},
-		3: amf.AMF0Object{
-			"level": "status",
-			"code":  "NetConnection.Connect.Success",
-		},
-	}
-	b, err := msg.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	if len(b) > 0xFFFFFF {
-		return errors.New("rtmp: AMF0 message too large")
-	}
+	return c.writeAMF0Result(tId, nil)
+}
 
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, uint32(len(b)), 20, 0, 2)
-	c.bufw.Write(b)
-	c.bufw.Flush()
-	return nil
+// writeAMF0OnFCPublish answers FCPublish for the stream name, which encoders
+// such as FMLE wait for before publishing.
+func (c *conn) writeAMF0OnFCPublish(name string) error {
+	return c.writeAMF0Command(0, "onFCPublish", 0.0, nil, amf.AMF0OrderedObject{
+		{Key: "code", Value: "NetStream.Publish.Start"},
+		{Key: "description", Value: name},
+	})
 }
 
-func (c *conn) writeAMF0NetConnectionConnectSuccess() error {
-	msg := &amf.AMF0Msg{
-		0: "_result",
-		1: 1.0,
-		2: amf.AMF0Object{},
-		3: amf.AMF0Object{
-			"level": "status",
-			"code":  "NetConnection.Connect.Success",
-		},
-	}
-	b, err := msg.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	if len(b) > 0xFFFFFF {
-		return errors.New("rtmp: AMF0 message too large")
-	}
+// writeAMF0OnFCUnpublish answers FCUnpublish for the stream name.
+func (c *conn) writeAMF0OnFCUnpublish(name string) error {
+	return c.writeAMF0Command(0, "onFCUnpublish", 0.0, nil, amf.AMF0OrderedObject{
+		{Key: "code", Value: "NetStream.Unpublish.Success"},
+		{Key: "description", Value: name},
+	})
+}
 
-	c.writeChunkBasicHeader(0, 2)
-	c.writeType0ChunkMessageHeader(0, uint32(len(b)), 20, 0, 2)
-	c.bufw.Write(b)
-	c.bufw.Flush()
-	return nil
+// writeAMF0NetConnectionConnectSuccess answers the connect command with
+// transaction id tId from a peer which connected with params.
+func (c *conn) writeAMF0NetConnectionConnectSuccess(tId float64, params *ConnectParams) error {
+	info := amf.AMF0OrderedObject{
+		{Key: "level", Value: "status"},
+		{Key: "code", Value: "NetConnection.Connect.Success"},
+		{Key: "description", Value: "Connection succeeded."},
+		{Key: "objectEncoding", Value: params.ObjectEncoding},
+	}
+	if params.FourCcList != nil {
+		// Media is relayed as is, so whatever codecs the peer supports will do
+		fourCcs := make(amf.AMF0StrictArray, len(params.FourCcList))
+		for i, f := range params.FourCcList {
+			fourCcs[i] = f
+		}
+		info = append(info, amf.AMF0Property{Key: "fourCcList", Value: fourCcs})
+	}
+	return c.writeAMF0Result(tId, amf.AMF0OrderedObject{
+		{Key: "fmsVer", Value: serverFmsVer},
+		{Key: "capabilities", Value: 31.0},
+		{Key: "mode", Value: 1.0},
+	}, info)
 }
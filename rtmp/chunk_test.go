@@ -0,0 +1,361 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testConn is a net.Conn reading from r and writing to w.
+type testConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *testConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *testConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// newTestConn returns a conn reading the bytes in from the peer, and the
+// testConn under it holding what the conn writes.
+func newTestConn(in []byte) (*conn, *testConn) {
+	tc := &testConn{r: bytes.NewReader(in)}
+	c := newConn(tc)
+	c.setupBuffers()
+	return c, tc
+}
+
+// readMessages receives n messages from c, applying protocol control messages
+// as the read loop does.
+func readMessages(t *testing.T, c *conn, n int) []*Message {
+	t.Helper()
+	var msgs []*Message
+	for len(msgs) < n {
+		m, err := c.receiveMessage(context.Background())
+		if err != nil {
+			t.Fatalf("message %d: %v", len(msgs), err)
+		}
+		if m.TypeId >= TypeSetChunkSize && m.TypeId <= TypeSetPeerBandwidth {
+			if err := c.handleProtocolControlMessage(m); err != nil {
+				t.Fatalf("message %d: %v", len(msgs), err)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// basicHeader encodes a chunk basic header in the shortest form for csid.
+func basicHeader(format byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		return []byte{format<<6 | byte(csid)}
+	case csid < 320:
+		return []byte{format << 6, byte(csid - 64)}
+	default:
+		return []byte{format<<6 | 1, byte(csid - 64), byte((csid - 64) >> 8)}
+	}
+}
+
+// appendTimestamp appends a 3 byte timestamp field, followed by the extended
+// timestamp if ts does not fit.
+func appendTimestamp(b []byte, ts uint32, ext *[]byte) []byte {
+	if ts >= extendedTimestamp {
+		*ext = uint32Payload(ts)
+		ts = extendedTimestamp
+	}
+	return append(b, byte(ts>>16), byte(ts>>8), byte(ts))
+}
+
+func type0Chunk(csid, ts uint32, typ MessageType, streamId uint32, msgLen int, data []byte) []byte {
+	var ext []byte
+	b := appendTimestamp(basicHeader(0, csid), ts, &ext)
+	b = append(b, byte(msgLen>>16), byte(msgLen>>8), byte(msgLen), byte(typ))
+	b = append(b, byte(streamId), byte(streamId>>8), byte(streamId>>16), byte(streamId>>24))
+	return append(append(b, ext...), data...)
+}
+
+func type1Chunk(csid, delta uint32, typ MessageType, msgLen int, data []byte) []byte {
+	var ext []byte
+	b := appendTimestamp(basicHeader(1, csid), delta, &ext)
+	b = append(b, byte(msgLen>>16), byte(msgLen>>8), byte(msgLen), byte(typ))
+	return append(append(b, ext...), data...)
+}
+
+func type2Chunk(csid, delta uint32, data []byte) []byte {
+	var ext []byte
+	b := appendTimestamp(basicHeader(2, csid), delta, &ext)
+	return append(append(b, ext...), data...)
+}
+
+func type3Chunk(csid uint32, data []byte) []byte {
+	return append(basicHeader(3, csid), data...)
+}
+
+func uint32Payload(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func concat(chunks ...[]byte) []byte {
+	return bytes.Join(chunks, nil)
+}
+
+func TestChunkHeaderInheritance(t *testing.T) {
+	in := concat(
+		type0Chunk(4, 1000, TypeVideo, 1, 3, []byte("abc")),
+		// Another chunk stream in between keeps state of its own
+		type0Chunk(5, 7, TypeAudio, 2, 1, []byte("x")),
+		type1Chunk(4, 40, TypeAudio, 2, []byte("de")),
+		type2Chunk(4, 20, []byte("fg")),
+		type3Chunk(4, []byte("hi")),
+		type2Chunk(5, 1, []byte("y")),
+		type3Chunk(4, []byte("jk")),
+	)
+	want := []*Message{
+		{ChunkStreamId: 4, Timestamp: 1000, TypeId: TypeVideo, StreamId: 1, Payload: []byte("abc")},
+		{ChunkStreamId: 5, Timestamp: 7, TypeId: TypeAudio, StreamId: 2, Payload: []byte("x")},
+		{ChunkStreamId: 4, Timestamp: 1040, TypeId: TypeAudio, StreamId: 1, Payload: []byte("de")},
+		{ChunkStreamId: 4, Timestamp: 1060, TypeId: TypeAudio, StreamId: 1, Payload: []byte("fg")},
+		// A type 3 chunk starting a message repeats the latest delta
+		{ChunkStreamId: 4, Timestamp: 1080, TypeId: TypeAudio, StreamId: 1, Payload: []byte("hi")},
+		{ChunkStreamId: 5, Timestamp: 8, TypeId: TypeAudio, StreamId: 2, Payload: []byte("y")},
+		{ChunkStreamId: 4, Timestamp: 1100, TypeId: TypeAudio, StreamId: 1, Payload: []byte("jk")},
+	}
+	c, _ := newTestConn(in)
+	if got := readMessages(t, c, len(want)); !reflect.DeepEqual(got, want) {
+		for i := range got {
+			t.Errorf("message %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestChunkHeaderWithoutType0(t *testing.T) {
+	for _, in := range [][]byte{
+		type1Chunk(4, 40, TypeAudio, 1, []byte("a")),
+		type2Chunk(4, 40, []byte("a")),
+		type3Chunk(4, []byte("a")),
+	} {
+		c, _ := newTestConn(in)
+		if _, err := c.receiveMessage(context.Background()); err == nil {
+			t.Errorf("chunk % x without type 0 header received", in[0])
+		}
+	}
+}
+
+func TestChunkExtendedTimestamp(t *testing.T) {
+	data := bytes.Repeat([]byte("v"), 200)
+	const ts = 0x01000000
+	ext := uint32Payload(ts)
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"repeated on continuation", concat(
+			type0Chunk(4, ts, TypeVideo, 1, len(data), data[:128]),
+			type3Chunk(4, append(ext, data[128:]...)),
+		)},
+		{"not repeated on continuation", concat(
+			type0Chunk(4, ts, TypeVideo, 1, len(data), data[:128]),
+			type3Chunk(4, data[128:]),
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestConn(tt.in)
+			m := readMessages(t, c, 1)[0]
+			if m.Timestamp != ts {
+				t.Errorf("timestamp = %#x, want %#x", m.Timestamp, ts)
+			}
+			if !bytes.Equal(m.Payload, data) {
+				t.Errorf("payload = %q, want %q", m.Payload, data)
+			}
+		})
+	}
+
+	// A type 3 chunk starting a message carries the extended delta again
+	in := concat(
+		type0Chunk(4, 0, TypeAudio, 1, 1, []byte("z")),
+		type1Chunk(4, ts, TypeAudio, 1, []byte("a")),
+		type3Chunk(4, append(uint32Payload(ts), 'b')),
+	)
+	c, _ := newTestConn(in)
+	msgs := readMessages(t, c, 3)
+	for i, want := range []uint32{0, 0x01000000, 0x02000000} {
+		if msgs[i].Timestamp != want {
+			t.Errorf("message %d timestamp = %#x, want %#x", i, msgs[i].Timestamp, want)
+		}
+	}
+}
+
+func TestChunkSetChunkSizeMidMessage(t *testing.T) {
+	data := bytes.Repeat([]byte("v"), 300)
+	in := concat(
+		type0Chunk(4, 0, TypeVideo, 1, len(data), data[:128]),
+		// The new size applies to the rest of the message
+		type0Chunk(2, 0, TypeSetChunkSize, 0, 4, uint32Payload(256)),
+		type3Chunk(4, data[128:]),
+	)
+	c, _ := newTestConn(in)
+	msgs := readMessages(t, c, 2)
+	if msgs[0].TypeId != TypeSetChunkSize || c.incChunkSize != 256 {
+		t.Fatalf("chunk size = %d after %v, want 256", c.incChunkSize, msgs[0].TypeId)
+	}
+	if !bytes.Equal(msgs[1].Payload, data) {
+		t.Errorf("payload = %q, want %q", msgs[1].Payload, data)
+	}
+
+	c, _ = newTestConn(type0Chunk(2, 0, TypeSetChunkSize, 0, 4, uint32Payload(0)))
+	m, err := c.receiveMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleProtocolControlMessage(m); err == nil {
+		t.Error("chunk size 0 accepted")
+	}
+}
+
+func TestChunkAbort(t *testing.T) {
+	data := bytes.Repeat([]byte("v"), 200)
+	partial := type0Chunk(4, 0, TypeVideo, 1, len(data), data[:128])
+	next := type0Chunk(4, 40, TypeAudio, 1, 3, []byte("abc"))
+
+	c, _ := newTestConn(concat(partial, type0Chunk(2, 0, TypeAbort, 0, 4, uint32Payload(4)), next))
+	msgs := readMessages(t, c, 2)
+	if msgs[0].TypeId != TypeAbort {
+		t.Fatalf("first message %v, want abort", msgs[0].TypeId)
+	}
+	want := &Message{ChunkStreamId: 4, Timestamp: 40, TypeId: TypeAudio, StreamId: 1, Payload: []byte("abc")}
+	if !reflect.DeepEqual(msgs[1], want) {
+		t.Errorf("got %+v, want %+v", msgs[1], want)
+	}
+
+	// Without the abort a new message cannot start before the last one ends
+	c, _ = newTestConn(concat(partial, next))
+	if _, err := c.receiveMessage(context.Background()); err == nil {
+		t.Error("type 0 chunk interrupting a message received")
+	}
+}
+
+func TestChunkBasicHeader(t *testing.T) {
+	tests := []struct {
+		b      []byte
+		format chunkHeaderType
+		csid   uint32
+	}{
+		{[]byte{0x02}, type0, 2},
+		{[]byte{0xFF}, type3, 63},
+		{[]byte{0x40, 0x00}, type1, 64},
+		{[]byte{0x80, 0xFF}, type2, 319},
+		{[]byte{0x01, 0x00, 0x01}, type0, 320},
+		{[]byte{0xC1, 0xFF, 0xFF}, type3, 65599},
+		// The 3 byte form may encode ids of the 2 byte form too
+		{[]byte{0x01, 0x00, 0x00}, type0, 64},
+	}
+	for _, tt := range tests {
+		c, _ := newTestConn(tt.b)
+		h, err := c.receiveChunkBasicHeader(context.Background())
+		if err != nil {
+			t.Errorf("% x: %v", tt.b, err)
+			continue
+		}
+		if h.ChunkMessageHeaderFormat != tt.format || h.ChunkStreamId != tt.csid {
+			t.Errorf("% x: format %d csid %d, want format %d csid %d", tt.b, h.ChunkMessageHeaderFormat, h.ChunkStreamId, tt.format, tt.csid)
+		}
+	}
+}
+
+func TestChunkStreamIdRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("v"), 300)
+	for _, csid := range []uint32{3, 63, 64, 319, 320, 65599} {
+		c, tc := newTestConn(nil)
+		want := &Message{ChunkStreamId: csid, Timestamp: 5, TypeId: TypeVideo, StreamId: 1, Payload: data}
+		if err := c.writeMessage(want); err != nil {
+			t.Fatalf("csid %d: %v", csid, err)
+		}
+		if !bytes.HasPrefix(tc.w.Bytes(), basicHeader(0, csid)) {
+			t.Errorf("csid %d: basic header % x, want % x", csid, tc.w.Bytes()[:3], basicHeader(0, csid))
+		}
+		r, _ := newTestConn(tc.w.Bytes())
+		if got := readMessages(t, r, 1)[0]; !reflect.DeepEqual(got, want) {
+			t.Errorf("csid %d: got %+v", csid, got)
+		}
+	}
+
+	c, _ := newTestConn(nil)
+	for _, csid := range []uint32{1, 65600} {
+		if err := c.writeMessage(&Message{ChunkStreamId: csid, TypeId: TypeVideo}); err == nil {
+			t.Errorf("csid %d written", csid)
+		}
+	}
+}
+
+func TestChunkAcknowledgement(t *testing.T) {
+	in := concat(
+		type0Chunk(2, 0, TypeWindowAcknowledgementSize, 0, 4, uint32Payload(64)),
+		type0Chunk(4, 0, TypeAudio, 1, 100, bytes.Repeat([]byte("a"), 100)),
+	)
+	c, tc := newTestConn(in)
+	readMessages(t, c, 1)
+	if c.ackWindowSize != 64 {
+		t.Fatalf("window size = %d, want 64", c.ackWindowSize)
+	}
+	if tc.w.Len() != 0 {
+		t.Fatalf("acknowledged before the window size applied")
+	}
+	readMessages(t, c, 1)
+
+	out, _ := newTestConn(tc.w.Bytes())
+	ack := readMessages(t, out, 1)[0]
+	if ack.TypeId != TypeAcknowledgement {
+		t.Fatalf("sent %v, want acknowledgement", ack.TypeId)
+	}
+	if seq := binary.BigEndian.Uint32(ack.Payload); seq != uint32(len(in)) {
+		t.Errorf("acknowledged %d bytes, want %d", seq, len(in))
+	}
+
+	c, _ = newTestConn(type0Chunk(2, 0, TypeWindowAcknowledgementSize, 0, 4, uint32Payload(0)))
+	m, err := c.receiveMessage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleProtocolControlMessage(m); err == nil {
+		t.Error("window size 0 accepted")
+	}
+}
+
+func TestChunkSetPeerBandwidth(t *testing.T) {
+	bandwidth := func(size uint32, limitType uint8) []byte {
+		return type0Chunk(2, 0, TypeSetPeerBandwidth, 0, 5, append(uint32Payload(size), limitType))
+	}
+	in := concat(
+		bandwidth(5000, limitTypeHard),
+		// Unchanged, so not announced again
+		bandwidth(5000, limitTypeDynamic),
+		// Soft limits only lower the window
+		bandwidth(8000, limitTypeSoft),
+		bandwidth(2500, limitTypeSoft),
+	)
+	c, tc := newTestConn(in)
+	readMessages(t, c, 4)
+
+	out, _ := newTestConn(tc.w.Bytes())
+	for _, want := range []uint32{5000, 2500} {
+		m := readMessages(t, out, 1)[0]
+		if m.TypeId != TypeWindowAcknowledgementSize {
+			t.Fatalf("sent %v, want window acknowledgement size", m.TypeId)
+		}
+		if size := binary.BigEndian.Uint32(m.Payload); size != want {
+			t.Errorf("announced window %d, want %d", size, want)
+		}
+	}
+	if _, err := out.receiveMessage(context.Background()); err == nil {
+		t.Error("announced more windows")
+	}
+}
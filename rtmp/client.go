@@ -0,0 +1,462 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// clientChunkSize is the chunk size a client switches to after connecting.
+// Media is sent in far fewer chunks than with the 128 byte default.
+const clientChunkSize = 4096
+
+// clientFlashVer is the flashVer a ClientConn identifies itself with.
+const clientFlashVer = "FMLE/3.0 (compatible; rtmp-tee-server)"
+
+// A StatusError is an error reported by the peer in the info object of an
+// _error or onStatus command, e.g. NetStream.Publish.BadName.
+type StatusError struct {
+	Level       string `amf:"level"`
+	Code        string `amf:"code"`
+	Description string `amf:"description"`
+}
+
+func (e *StatusError) Error() string {
+	if e.Description == "" {
+		return "rtmp: " + e.Code
+	}
+	return "rtmp: " + e.Code + ": " + e.Description
+}
+
+// newStatusError returns the StatusError described by the info object v.
+func newStatusError(v interface{}) *StatusError {
+	e := &StatusError{}
+	if err := amf.UnmarshalValue(v, e); err != nil {
+		e.Description = err.Error()
+	}
+	if e.Code == "" {
+		e.Code = "unknown error"
+	}
+	return e
+}
+
+// A ClientConn is an RTMP connection publishing a stream to a server. It is
+// the client side of what the Server does and is created with Dial.
+type ClientConn struct {
+	c *conn
+
+	app      string
+	name     string
+	streamId uint32
+
+	// Transaction id of the next command sent
+	tId float64
+
+	cancel context.CancelFunc
+
+	// done is closed when the read loop exits and err holds the reason
+	done chan struct{}
+	err  error
+
+	closeOnce sync.Once
+}
+
+// Dial connects to the RTMP server in rawurl and starts publishing the stream
+// named by the last path element of the URL. The remaining path is the app,
+// so rtmp://localhost/live/key publishes the stream "key" to the app "live".
+// The query string of the URL, if any, is passed on with the stream name.
+// rtmps URLs connect over TLS, to port 443 unless the URL names one.
+//
+// Dial performs the handshake and sends connect, releaseStream, FCPublish,
+// createStream and publish, returning once the server has replied with
+// NetStream.Publish.Start. Errors reported by the server are returned as a
+// *StatusError. ctx bounds the whole exchange but not the returned
+// connection.
+func Dial(ctx context.Context, rawurl string) (*ClientConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: dial failed: %s", err.Error())
+	}
+	port := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("rtmp: dial failed: unsupported scheme: %q", u.Scheme)
+	}
+	app, name, err := splitStreamPath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp: dial failed: %s", err.Error())
+	}
+	if u.Scheme == "rtmps" {
+		// The TLS handshake happens on the first write, under the
+		// deadlines below
+		nc = tls.Client(nc, &tls.Config{ServerName: u.Hostname()})
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cc := &ClientConn{
+		c:      newConn(nc),
+		app:    app,
+		name:   name,
+		tId:    1,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	cc.c.ctx = cctx
+	cc.c.setupBuffers()
+
+	// Abort blocked reads and writes once ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err = cc.setup(ctx, u.Scheme+"://"+u.Host+"/"+app)
+	close(stop)
+	if err != nil {
+		cc.c.rwc.Close()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("rtmp: dial failed: %s", ctx.Err().Error())
+		}
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	cc.SetWriteTimeout(DefaultWriteTimeout)
+	go cc.readLoop()
+	return cc, nil
+}
+
+// SetWriteTimeout sets how long writing a single message may take before the
+// connection fails, DefaultWriteTimeout for connections made by Dial. Zero
+// or negative values disable the timeout.
+func (cc *ClientConn) SetWriteTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	cc.c.mu.Lock()
+	cc.c.writeTimeout = d
+	if d == 0 {
+		cc.c.rwc.SetWriteDeadline(time.Time{})
+	}
+	cc.c.mu.Unlock()
+}
+
+// splitStreamPath splits the path of an RTMP URL into app and stream name.
+func splitStreamPath(path string) (app, name string, err error) {
+	path = strings.Trim(path, "/")
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 || i == len(path)-1 {
+		return "", "", fmt.Errorf("rtmp: URL path %q must be of the form /app/stream", path)
+	}
+	return path[:i], path[i+1:], nil
+}
+
+// setup performs the handshake and the command exchange needed to start
+// publishing.
+func (cc *ClientConn) setup(ctx context.Context, tcUrl string) error {
+	if err := cc.sendHandshake(ctx); err != nil {
+		return err
+	}
+	if err := cc.c.writeSetChunkSize(clientChunkSize); err != nil {
+		return err
+	}
+
+	_, err := cc.call(ctx, "connect", amf.AMF0OrderedObject{
+		{Key: "app", Value: cc.app},
+		{Key: "type", Value: "nonprivate"},
+		{Key: "flashVer", Value: clientFlashVer},
+		{Key: "tcUrl", Value: tcUrl},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Like FFmpeg and OBS, don't wait for replies to releaseStream and
+	// FCPublish. Not every server answers them and failure is harmless.
+	if err := cc.send(0, "releaseStream", nil, cc.name); err != nil {
+		return err
+	}
+	if err := cc.send(0, "FCPublish", nil, cc.name); err != nil {
+		return err
+	}
+
+	res, err := cc.call(ctx, "createStream", nil)
+	if err != nil {
+		return err
+	}
+	streamId, ok := res[3].(float64)
+	if !ok {
+		return errors.New("rtmp: createStream result did not contain a stream id")
+	}
+	cc.streamId = uint32(streamId)
+
+	if err := cc.send(cc.streamId, "publish", nil, cc.name, "live"); err != nil {
+		return err
+	}
+	return cc.awaitStatus(ctx, "NetStream.Publish.Start")
+}
+
+// sendHandshake performs the client side of the simple handshake described
+// on receiveHandshake.
+func (cc *ClientConn) sendHandshake(ctx context.Context) error {
+	c := cc.c
+
+	// C0, C1
+	c1 := make([]byte, 1536)
+	binary.BigEndian.PutUint32(c1[0:4], getUint32MilsTimestamp())
+	if _, err := rand.Read(c1[8:]); err != nil {
+		return fmt.Errorf("rtmp: C1 random entropy error: %s", err.Error())
+	}
+	if err := c.bufw.WriteByte(0x03); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake C0 write failed: %s", err.Error())
+	}
+	if _, err := c.bufw.Write(c1); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake C1 write failed: %s", err.Error())
+	}
+	if err := c.bufw.Flush(); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake C0, C1 flush failed: %s", err.Error())
+	}
+
+	// S0, S1
+	if s0, err := c.bufr.ReadByte(); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake S0 read failed: %s", err.Error())
+	} else if s0 != 0x03 {
+		return fmt.Errorf("rtmp: sendHandshake S0 unsupported version: %d", s0)
+	}
+	s1 := make([]byte, 1536)
+	if _, err := io.ReadFull(c.bufr, s1); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake S1 read failed: %s", err.Error())
+	}
+
+	// C2 echoes S1 with the time it was received at
+	c2 := append([]byte{}, s1...)
+	binary.BigEndian.PutUint32(c2[4:8], getUint32MilsTimestamp())
+	if _, err := c.bufw.Write(c2); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake C2 write failed: %s", err.Error())
+	}
+	if err := c.bufw.Flush(); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake C2 flush failed: %s", err.Error())
+	}
+
+	// S2
+	s2 := make([]byte, 1536)
+	if _, err := io.ReadFull(c.bufr, s2); err != nil {
+		return fmt.Errorf("rtmp: sendHandshake S2 read failed: %s", err.Error())
+	}
+	if !bytes.Equal(s2[8:], c1[8:]) {
+		return errors.New("rtmp: sendHandshake S2 did not acknowledge C1 random")
+	}
+	return nil
+}
+
+// send writes the command name with the next transaction id and args to the
+// message stream streamId without waiting for a reply.
+func (cc *ClientConn) send(streamId uint32, name string, args ...interface{}) error {
+	_, err := cc.sendTransaction(streamId, name, args...)
+	return err
+}
+
+// sendTransaction is like send but returns the transaction id used.
+func (cc *ClientConn) sendTransaction(streamId uint32, name string, args ...interface{}) (float64, error) {
+	tId := cc.tId
+	cc.tId++
+	return tId, cc.c.writeAMF0Command(streamId, append([]interface{}{name, tId}, args...)...)
+}
+
+// call sends the command name on the NetConnection and waits for its _result.
+func (cc *ClientConn) call(ctx context.Context, name string, args ...interface{}) (amf.AMF0Msg, error) {
+	tId, err := cc.sendTransaction(0, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		cmd, err := cc.receiveCommand(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if t, _ := cmd[1].(float64); t != tId {
+			continue
+		}
+		switch cmd[0] {
+		case "_result":
+			return cmd, nil
+		case "_error":
+			return nil, newStatusError(cmd[3])
+		}
+	}
+}
+
+// awaitStatus waits for an onStatus command with the given code. An onStatus
+// with level error is returned as a *StatusError.
+func (cc *ClientConn) awaitStatus(ctx context.Context, code string) error {
+	for {
+		cmd, err := cc.receiveCommand(ctx)
+		if err != nil {
+			return err
+		}
+		if cmd[0] != "onStatus" {
+			continue
+		}
+		status := newStatusError(cmd[3])
+		if status.Level == "error" {
+			return status
+		}
+		if status.Code == code {
+			return nil
+		}
+	}
+}
+
+// receiveCommand reads messages until an AMF0 command arrives, applying any
+// protocol control messages on the way.
+func (cc *ClientConn) receiveCommand(ctx context.Context) (amf.AMF0Msg, error) {
+	for {
+		msg, err := cc.c.receiveMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.TypeId {
+		case TypeSetChunkSize, TypeAbort, TypeAcknowledgement, TypeUserControl, TypeWindowAcknowledgementSize, TypeSetPeerBandwidth:
+			if err := cc.c.handleProtocolControlMessage(msg); err != nil {
+				return nil, err
+			}
+		case TypeAMF0Command, TypeAMF3Command:
+			return decodeCommand(msg)
+		}
+	}
+}
+
+// readLoop keeps reading from the connection once publishing has started so
+// the server never blocks writing to us. It applies protocol control messages
+// and ends the connection when the server reports an error on our stream.
+func (cc *ClientConn) readLoop() {
+	defer close(cc.done)
+	for {
+		cmd, err := cc.receiveCommand(cc.c.ctx)
+		if err != nil {
+			cc.err = err
+			return
+		}
+		if cmd[0] == "onStatus" {
+			if status := newStatusError(cmd[3]); status.Level == "error" {
+				cc.err = status
+				cc.c.rwc.Close()
+				return
+			}
+		}
+	}
+}
+
+// StreamId returns the message stream id the server assigned to the
+// published stream.
+func (cc *ClientConn) StreamId() uint32 {
+	return cc.streamId
+}
+
+// WriteMessage publishes m. Its StreamId is replaced with the id of the
+// published stream and m itself is left unmodified. It is safe to call from
+// multiple goroutines.
+func (cc *ClientConn) WriteMessage(m *Message) error {
+	out := *m
+	out.StreamId = cc.streamId
+	out.ChunkStreamId = 0
+	return cc.c.writeMessage(&out)
+}
+
+// WriteAudio publishes an audio message, an FLV audio tag body, with
+// timestamp ts in milliseconds.
+func (cc *ClientConn) WriteAudio(ts uint32, payload []byte) error {
+	return cc.WriteMessage(&Message{Timestamp: ts, TypeId: TypeAudio, Payload: payload})
+}
+
+// WriteVideo publishes a video message, an FLV video tag body, with
+// timestamp ts in milliseconds.
+func (cc *ClientConn) WriteVideo(ts uint32, payload []byte) error {
+	return cc.WriteMessage(&Message{Timestamp: ts, TypeId: TypeVideo, Payload: payload})
+}
+
+// WriteData publishes an AMF0 data message made up of values, e.g.
+// "@setDataFrame", "onMetaData" and the metadata object.
+func (cc *ClientConn) WriteData(ts uint32, values ...interface{}) error {
+	msg := amf.AMF0Msg{}
+	for i, v := range values {
+		msg[i] = v
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return cc.WriteMessage(&Message{Timestamp: ts, TypeId: TypeAMF0Data, Payload: b})
+}
+
+// Done returns a channel that is closed when the connection to the server is
+// lost or closed.
+func (cc *ClientConn) Done() <-chan struct{} {
+	return cc.done
+}
+
+// Err returns the reason the connection ended once Done is closed.
+func (cc *ClientConn) Err() error {
+	select {
+	case <-cc.done:
+		return cc.err
+	default:
+		return nil
+	}
+}
+
+// Close stops publishing with FCUnpublish and deleteStream and closes the
+// connection. Failing to send either command does not stop the connection
+// from being closed.
+func (cc *ClientConn) Close() error {
+	var err error
+	cc.closeOnce.Do(func() {
+		select {
+		case <-cc.done:
+		default:
+			cc.SetWriteTimeout(time.Second)
+			if cc.send(0, "FCUnpublish", nil, cc.name) == nil {
+				cc.send(0, "deleteStream", nil, float64(cc.streamId))
+			}
+		}
+		cc.cancel()
+		err = cc.c.rwc.Close()
+	})
+	return err
+}
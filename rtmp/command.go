@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// maxStreamsPerConn is the number of message streams a peer may have created
+// at a time.
+const maxStreamsPerConn = 64
+
+// maxLoggedName is the length command names sent by the peer are cut to in
+// logs.
+const maxLoggedName = 64
+
+// Parameters the server negotiates with peers on connect: the window of
+// acknowledgements both ways and the chunk size of our output.
+const (
+	serverWindowSize = 2500000
+	serverChunkSize  = 4096
+)
+
+// serverFmsVer is the fmsVer the server identifies itself with. Clients check
+// it against the versions of Flash Media Server they know.
+const serverFmsVer = "FMS/3,5,7,7009"
+
+// ConnectParams are the parameters a peer connected with, taken from the
+// command object of its connect command.
+type ConnectParams struct {
+	App      string `amf:"app"`
+	TcUrl    string `amf:"tcUrl"`
+	FlashVer string `amf:"flashVer"`
+	SwfUrl   string `amf:"swfUrl"`
+	PageUrl  string `amf:"pageUrl"`
+	Type     string `amf:"type"`
+
+	// Codecs and features the peer supports, as bit fields
+	Fpad          bool    `amf:"fpad"`
+	Capabilities  float64 `amf:"capabilities"`
+	AudioCodecs   float64 `amf:"audioCodecs"`
+	VideoCodecs   float64 `amf:"videoCodecs"`
+	VideoFunction float64 `amf:"videoFunction"`
+
+	// ObjectEncoding is 0 for peers using AMF0 and 3 for AMF3.
+	ObjectEncoding float64 `amf:"objectEncoding"`
+
+	// CapsEx and FourCcList are sent by Enhanced RTMP peers, the extended
+	// capabilities and the FourCCs of the codecs they support.
+	CapsEx     float64  `amf:"capsEx"`
+	FourCcList []string `amf:"fourCcList"`
+
+	// Object is the command object as sent, including properties not
+	// listed above, and Args holds the optional arguments that follow it.
+	Object amf.AMF0Object `amf:"-"`
+	Args   []interface{}  `amf:"-"`
+}
+
+// handleCommand acts on a command message received from the peer on the
+// message stream streamId.
+//
+// A peer must connect before anything else. It then creates message streams
+// with createStream, publishes or plays on them, and tears them down with
+// closeStream, which keeps the message stream for reuse, or deleteStream.
+// FCPublish and FCUnpublish bracket publishing for encoders that send them.
+// Commands which fail are answered with _error, or with an onStatus error on
+// their message stream for publish and play.
+func (c *conn) handleCommand(streamId uint32, cmd amf.AMF0Msg) error {
+	v, ok := cmd[0]
+	if !ok {
+		c.log(LevelWarn, "command without a name", "stream", streamId)
+		return nil
+	}
+	tId, _ := cmd[1].(float64)
+	c.log(LevelDebug, "command", "name", loggedName(v), "stream", streamId)
+	if v != "connect" && c.connectParams() == nil {
+		// Only answer commands expecting a reply
+		if tId == 0 {
+			return nil
+		}
+		return c.writeAMF0Error(tId, "NetConnection.Call.Failed", "Not connected.")
+	}
+
+	switch v {
+	case "connect":
+		return c.connect(tId, cmd)
+
+	case "releaseStream":
+		return c.writeAMF0ReleaseStreamSuccess(tId)
+
+	case "FCPublish":
+		name, _ := cmd[3].(string)
+		return c.writeAMF0OnFCPublish(name)
+
+	case "FCUnpublish":
+		name, _ := cmd[3].(string)
+		for id, ls := range c.published {
+			if ls.key == streamKey(c.app, name) {
+				if err := c.unpublish(id); err != nil {
+					return err
+				}
+			}
+		}
+		return c.writeAMF0OnFCUnpublish(name)
+
+	case "createStream":
+		return c.createStream(tId)
+
+	case "deleteStream":
+		id, _ := cmd[3].(float64)
+		return c.deleteStream(uint32(id))
+
+	case "closeStream":
+		return c.closeStream(streamId)
+
+	case "publish":
+		name, _ := cmd[3].(string)
+		return c.publish(streamId, name)
+
+	case "play":
+		name, _ := cmd[3].(string)
+		return c.play(streamId, name)
+	}
+	return nil
+}
+
+// loggedName returns the command name v as it is logged: cut short if it is
+// a string, or its type if it is not, as the peer may send any value.
+func loggedName(v interface{}) string {
+	name, ok := v.(string)
+	if !ok {
+		return fmt.Sprintf("(%T)", v)
+	}
+	if len(name) > maxLoggedName {
+		return name[:maxLoggedName] + "..."
+	}
+	return name
+}
+
+// connect answers the connect command cmd. The peer is told the
+// acknowledgement windows and chunk size we use, in the order Flash Media
+// Server sends them, then the result, which carries the object encoding the
+// peer asked for.
+func (c *conn) connect(tId float64, cmd amf.AMF0Msg) error {
+	if c.connectParams() != nil {
+		return c.writeAMF0Error(tId, "NetConnection.Connect.Rejected", "Already connected.")
+	}
+	params := &ConnectParams{}
+	if err := amf.UnmarshalValue(cmd[2], params); err != nil {
+		return c.writeAMF0Error(tId, "NetConnection.Connect.Rejected", "Invalid command object: "+err.Error())
+	}
+	params.Object, _ = cmd[2].(amf.AMF0Object)
+	for i := 3; i < len(cmd); i++ {
+		params.Args = append(params.Args, cmd[i])
+	}
+	if err := c.authenticate(AuthConnect, params, ""); err != nil {
+		c.log(LevelInfo, "connect rejected", "app", params.App, "err", err)
+		if werr := c.writeAMF0Error(tId, "NetConnection.Connect.Rejected", err.Error()); werr != nil {
+			return werr
+		}
+		return fmt.Errorf("rtmp: connect rejected: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	c.params = params
+	c.mu.Unlock()
+	c.app = params.App
+	c.log(LevelInfo, "connect", "app", c.app, "flashVer", params.FlashVer)
+
+	if err := c.writeWindowSizeAcknowledgementChunk(serverWindowSize); err != nil {
+		return err
+	}
+	if err := c.writeSetPeerBandwidthChunk(serverWindowSize, limitTypeDynamic); err != nil {
+		return err
+	}
+	if err := c.writeSetChunkSize(serverChunkSize); err != nil {
+		return err
+	}
+	return c.writeAMF0NetConnectionConnectSuccess(tId, params)
+}
+
+// connectParams returns the parameters the peer connected with, or nil if it
+// has not connected yet.
+func (c *conn) connectParams() *ConnectParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.params
+}
+
+// createStream allocates a message stream and answers createStream with its
+// id. Ids start at 1, as message stream 0 is the NetConnection itself.
+func (c *conn) createStream(tId float64) error {
+	if len(c.streams) >= maxStreamsPerConn {
+		return c.writeAMF0Error(tId, "NetConnection.Call.Failed", "Too many streams.")
+	}
+	for {
+		c.nextStreamId++
+		if c.nextStreamId != 0 && !c.streams[c.nextStreamId] {
+			break
+		}
+	}
+	c.streams[c.nextStreamId] = true
+	if err := c.writeAMF0CreateStreamSuccess(tId, c.nextStreamId); err != nil {
+		return err
+	}
+	// The new message stream is functional right away
+	return c.writeStreamBegin(c.nextStreamId)
+}
+
+// closeStream stops publishing or playing on the message stream streamId,
+// which stays allocated.
+func (c *conn) closeStream(streamId uint32) error {
+	c.stopPlaying(streamId)
+	return c.unpublish(streamId)
+}
+
+// deleteStream closes the message stream streamId and frees it.
+func (c *conn) deleteStream(streamId uint32) error {
+	if !c.streams[streamId] {
+		return nil
+	}
+	err := c.closeStream(streamId)
+	delete(c.streams, streamId)
+	delete(c.bufferLengths, streamId)
+	return err
+}
@@ -0,0 +1,29 @@
+package rtmp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+func TestLoggedName(t *testing.T) {
+	self := amf.AMF0Object{}
+	self["a"] = self
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{"connect", "connect"},
+		{strings.Repeat("a", maxLoggedName), strings.Repeat("a", maxLoggedName)},
+		{strings.Repeat("a", maxLoggedName+1), strings.Repeat("a", maxLoggedName) + "..."},
+		{1.0, "(float64)"},
+		{nil, "(<nil>)"},
+		{self, "(amf.AMF0Object)"},
+	}
+	for _, tt := range tests {
+		if got := loggedName(tt.in); got != tt.want {
+			t.Errorf("loggedName(%T) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
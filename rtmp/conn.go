@@ -6,10 +6,12 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,8 +19,31 @@ type chunk struct {
 }
 
 type conn struct {
+	// rtt is the round trip time to the peer last measured with a ping, as a
+	// time.Duration. It is accessed atomically so it comes first for 64 bit
+	// alignment.
+	rtt int64
+
 	server *Server
 	rwc    net.Conn
+	id     uint64 // unique to the server, for logging
+
+	// ctx is the context of the connection, canceled when serve returns
+	ctx context.Context
+
+	// Timeouts of the connection, as configured on the server, 0 for none
+	handshakeTimeout time.Duration
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	publishTimeout   time.Duration
+
+	// lastMedia is when the peer last sent media on a published stream.
+	// Only accessed by the read loop.
+	lastMedia time.Time
+
+	// closing is set, atomically, once the server asks the connection to
+	// close
+	closing int32
 
 	// Input and output buffers on the connection
 	bufr *bufio.Reader
@@ -27,13 +52,13 @@ type conn struct {
 	// epoch 0 time
 	startTime *time.Time
 
-	// Stateful information about the previous incoming message
-	prvIncMsgTime   *time.Time // Actual time it came in
-	prvIncMsgTs     *uint32    // Timestamp on the message
-	prvIncMsgTsD    *uint32    // Timestamp delta
-	prvIncMsgLen    *uint32    // Message length
-	prvIncMsgTypId  *uint8     // Message type ID
-	prvIncMsgStrmId *uint32    // Message stream ID
+	// Incoming chunk streams by chunk stream id and the maximum chunk size
+	// the peer will send
+	chunkStreams map[uint32]*chunkStream
+	incChunkSize uint32
+
+	// Maximum chunk size used when writing messages to the peer
+	outChunkSize uint32
 
 	// Stateful information about the previous outgoing message
 	prvOutgMsgTime   *time.Time // Actual time it went out
@@ -43,10 +68,49 @@ type conn struct {
 	prvOutgMsgTypId  *uint8     // Message type ID
 	prvOutgMsgStrmId *uint32    // Message stream ID
 
-	// Stateful information about bytes received since acknowledgement
+	// app is the application the peer connected to. params holds all the
+	// parameters it connected with, nil until then, and is guarded by mu.
+	app    string
+	params *ConnectParams
+
+	// Message streams created by the peer and the id last handed out
+	streams      map[uint32]bool
+	nextStreamId uint32
+
+	// Buffer lengths in milliseconds the peer set with SetBufferLength, by
+	// message stream id. Only accessed by the read loop.
+	bufferLengths map[uint32]uint32
+
+	// Live streams the peer is publishing and playing, by message stream id.
+	// Players remove themselves once their stream ends, so playing is
+	// guarded by playingMu.
+	published map[uint32]*liveStream
+	playingMu sync.Mutex
+	playing   map[uint32]*player
+
+	// Bytes received from the peer, the count last acknowledged to it and the
+	// window size it asked to be acknowledged at. Only accessed by the read
+	// loop. Like RTMP sequence numbers, counts wrap around.
+	bytesIn       uint32
 	sequenceNum   uint32
 	ackWindowSize uint32
 
+	// Bytes sent to the peer, the output window the peer limited us to with
+	// Set Peer Bandwidth and its limit type, the window size we last
+	// announced to the peer with Window Acknowledgement Size, and the count of
+	// our output the peer last acknowledged. Guarded by mu.
+	bytesOut           uint32
+	peerBandwidth      uint32
+	peerBandwidthLimit uint8
+	outAckWindowSize   uint32
+	peerAckedSeq       uint32
+
+	// peerAcking is set once the peer acknowledges our output. ackCh, if
+	// non-nil, is closed at the next acknowledgement. Guarded by mu.
+	peerAcking bool
+	ackCh      chan struct{}
+
+	// mu guards bufw so whole messages are written to the peer atomically
 	mu sync.Mutex
 }
 
@@ -65,76 +129,71 @@ type conn struct {
 // <- C2 [S1 timestamp: 4 bytes] (an echo of the timestamp send in S1)
 //       [timestamp: 4 bytes]    (the epoch timestamp S1 received at)
 //       [S1 random: 1528 bytes] (an echo of the random sent in S1)
+//
+// Flash Player and some servers pulling streams use the complex handshake
+// instead, which signs C1 and S1 with HMAC-SHA256 digests where the zeroes
+// are a version; see complexHandshake. Clients whose C1 carries no valid
+// digest get the simple handshake.
 func (c *conn) receiveHandshake(ctx context.Context) error {
-	// FIXME: set timeouts
 	// FIXME: use pools for byte slices
 
 	// The handshake begins with the client sending the C0 and C1 chunks.
 
 	// CO, C1
 	// Read c0
-	fmt.Println("Read c0, c1")
-	if c0, err := c.bufr.ReadByte(); c0 != 0x03 || err != nil {
+	c.log(LevelDebug, "handshake: reading C0 and C1")
+	c0, err := c.bufr.ReadByte()
+	if err != nil {
 		return fmt.Errorf("rtmp: receiveHandshake C0 read version byte failed: %s", err.Error())
 	}
+	// A TLS client hello, 0x16, is a peer speaking RTMPS to the plain port
+	if c0 != 0x03 {
+		return fmt.Errorf("rtmp: receiveHandshake C0 unsupported version: %#x", c0)
+	}
 	// Read and store c1
-	c1 := make([]byte, 1536)
-	if c1Len, err := io.ReadFull(c.bufr, c1); c1Len != 1536 || err != nil {
+	c1 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(c.bufr, c1); err != nil {
 		return fmt.Errorf("rtmp: receiveHandshake C1 read failed: %s", err.Error())
 	}
 
 	// The server MUST wait until C0 has been received before sending S0 and S1, and MAY wait until after C1 as well
 
+	// Answer a C1 signed with a digest with the complex handshake, and
+	// anything else with the simple one
+	s1, s2, err := complexHandshake(c1)
+	if err != nil {
+		return err
+	}
+	complex := s1 != nil
+	if !complex {
+		// Timestamp and zeroes, then random bytes
+		s1 = make([]byte, handshakeSize)
+		if _, err := rand.Read(s1[8:]); err != nil {
+			return fmt.Errorf("rtmp: S1 random entropy error: %s", err.Error())
+		}
+		// S2 echoes C1 whole. The spec has us put the time we read C1 at
+		// in place of its zeroes, but librtmp clients such as OBS then
+		// warn that S2 does not match C1, and nobody checks that time.
+		s2 = c1
+	}
+
 	// S0, S1
-	// Write s0
-	fmt.Println("Write s0, s1")
+	c.log(LevelDebug, "handshake: writing S0 and S1", "complex", complex)
 	if err := c.bufw.WriteByte(0x03); err != nil {
 		return fmt.Errorf("rtmp: receiveHandshake S0 write failed: %s", err.Error())
 	}
-	// Write s1 timestamp
-	s1Timestamp := make([]byte, 4)
-	binary.BigEndian.PutUint32(s1Timestamp, 0)
-	if s1TSLen, err := c.bufw.Write(s1Timestamp); s1TSLen != 4 || err != nil {
-		return fmt.Errorf("rtmp: receiveHandshake S1 timestamp write failed: %s", err.Error())
-	}
-	// Write s1 zeroes
-	if s1ZLen, err := c.bufw.Write([]byte{0, 0, 0, 0}); s1ZLen != 4 || err != nil {
-		return fmt.Errorf("rtmp: receiveHandshake S1 zeroes write failed: %s", err.Error())
-	}
-	// Write s1 random bytes
-	s1Random := make([]byte, 1528)
-	if s1RandLen, err := rand.Read(s1Random); s1RandLen != 1528 || err != nil {
-		return fmt.Errorf("rtmp: S1 random entropy error: %s", err.Error())
-	}
-	if s1RandLen, err := c.bufw.Write(s1Random); s1RandLen != 1528 || err != nil {
-		return fmt.Errorf("rtmp: receiveHandshake S1 random write failed: %s", err.Error())
+	if _, err := c.bufw.Write(s1); err != nil {
+		return fmt.Errorf("rtmp: receiveHandshake S1 write failed: %s", err.Error())
 	}
 	// Flush s0 and s1 to network
 	if err := c.bufw.Flush(); err != nil {
 		return fmt.Errorf("rtmp: receiveHandshake S0, S1 flush failed: %s", err.Error())
 	}
 
-	// TODO: figure out what to do with this.
-	// OBS thinks this is incorrect. The RTMP spec says it's correct.
-	// // S2
-	// // Write s2 client timestamp
-	// if s2CTSLen, err := c.bufw.Write(c1[:4]); s2CTSLen != 4 || err != nil {
-	//   return fmt.Errorf("rtmp: receiveHandshake S2 client timestamp write failed: %s", err.Error())
-	// }
-	// // Write s2 server timestamp
-	// s2STimestamp := make([]byte, 4)
-	// binary.BigEndian.PutUint32(s2STimestamp, getUint32MilsTimestamp())
-	// if s2STSLen, err := c.bufw.Write(s2STimestamp); s2STSLen != 4 || err != nil {
-	//   return fmt.Errorf("rtmp: receiveHandshake S2 server timestamp write failed: %s", err.Error())
-	// }
-	// // Write s2 ack client random
-	// if s2RandLen, err := c.bufw.Write(c1[8:]); s2RandLen != 1528 || err != nil {
-	//   return fmt.Errorf("rtmp: receiveHandshake S2 acknowledge client random write failed: %s", err.Error())
-	// }
-	fmt.Println("Write s2")
-	// FIXME: this is wrong. Obs likes it, but it's wrong.
-	if s2, err := c.bufw.Write(c1); s2 != 1536 || err != nil {
-		return fmt.Errorf("rtmp: receiveHandshake s2 write failed: %s", err.Error())
+	// S2
+	c.log(LevelDebug, "handshake: writing S2")
+	if _, err := c.bufw.Write(s2); err != nil {
+		return fmt.Errorf("rtmp: receiveHandshake S2 write failed: %s", err.Error())
 	}
 	// Flush s2 to network
 	if err := c.bufw.Flush(); err != nil {
@@ -142,14 +201,16 @@ func (c *conn) receiveHandshake(ctx context.Context) error {
 	}
 
 	// C2
-	fmt.Println("Read c2")
-	c2 := make([]byte, 1536)
-	if c1Len, err := c.bufr.Read(c2); c1Len != 1536 || err != nil {
+	c.log(LevelDebug, "handshake: reading C2")
+	c2 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(c.bufr, c2); err != nil {
 		return fmt.Errorf("rtmp: receiveHandshake C2 read failed: %s", err.Error())
 	}
 
-	// Verify C2 acknowledged S1 Random block
-	if bytes.Compare(c2[8:], s1Random) != 0 {
+	// Verify C2 acknowledged S1 Random block. In the complex handshake C2 is
+	// random bytes signed with a key derived from our S1 digest instead,
+	// which, like other servers, we do not check.
+	if !complex && !bytes.Equal(c2[8:], s1[8:]) {
 		return fmt.Errorf("rtmp: receiveHandshake C2 did not acknowledge S2 random")
 	}
 
@@ -162,23 +223,413 @@ func (c *conn) receiveHandshake(ctx context.Context) error {
 // based on incoming chunks. It also manages the lifecycle of the
 // RTMP connection.
 func (c *conn) serve(ctx context.Context) {
-	c.bufr = bufio.NewReader(c.rwc) // TODO: add size here? // TODO: make a sync pool
-	c.bufw = bufio.NewWriter(c.rwc) // TODO: add size here? // TODO: make a sync pool
+	c.setupBuffers()
 
 	ctx, cancelCtx := context.WithCancel(ctx)
 	defer cancelCtx()
+	c.ctx = ctx
+	defer c.setState(StateClosed)
 
-	if c.receiveHandshake(ctx) != nil {
+	if c.handshakeTimeout > 0 {
+		c.rwc.SetDeadline(time.Now().Add(c.handshakeTimeout))
+	}
+	if err := c.receiveHandshake(ctx); err != nil {
+		c.log(LevelDebug, "handshake failed", "err", err)
 		c.rwc.Close()
+		return
 	}
-	//i := 0
+	c.log(LevelDebug, "handshake done")
+	c.rwc.SetDeadline(time.Time{})
+	c.setState(StateActive)
+	defer c.unpublishAll()
+	defer c.stopPlayingAll()
+	go c.pingLoop()
 	for {
-		if _, err := c.receiveChunk(ctx); err != nil {
-			//if i > 2 {
-			c.rwc.Close()
+		if err := c.setReadDeadline(); err != nil {
+			c.close(err)
 			break
-			//}
-			//i += 1
 		}
+		msg, err := c.receiveMessage(ctx)
+		if err != nil {
+			c.close(err)
+			break
+		}
+		if err := c.handleMessage(ctx, msg); err != nil {
+			c.close(err)
+			break
+		}
+		if c.server.Handler != nil {
+			c.server.Handler.ServeRTMP(c, msg)
+		}
+	}
+}
+
+// setState records that the connection entered state, tracking it for
+// Shutdown and calling the server's ConnState hook.
+func (c *conn) setState(state ConnState) {
+	srv := c.server
+	switch state {
+	case StateNew:
+		srv.trackConn(c, true)
+	case StateClosed:
+		srv.trackConn(c, false)
+	}
+	if hook := srv.ConnState; hook != nil {
+		hook(c.rwc, state)
+	}
+}
+
+// shutdown asks the read loop to close the connection, waking it up with a
+// deadline in the past.
+func (c *conn) shutdown() {
+	atomic.StoreInt32(&c.closing, 1)
+	c.rwc.SetReadDeadline(time.Unix(1, 0))
+}
+
+// close closes the connection because of err, first telling the peer if the
+// server asked for it.
+func (c *conn) close(err error) {
+	if atomic.LoadInt32(&c.closing) != 0 {
+		c.goodbye()
+	}
+	c.rwc.Close()
+	c.log(LevelInfo, "connection closed", "app", c.app, "err", err)
+}
+
+// goodbye tells the peer the server is closing the connection: its published
+// streams are unpublished, its players stopped and its NetConnection closed.
+func (c *conn) goodbye() {
+	for streamId := range c.published {
+		if err := c.unpublish(streamId); err != nil {
+			return
+		}
+	}
+	for _, streamId := range c.playingStreams() {
+		if !c.stopPlaying(streamId) {
+			continue
+		}
+		if err := c.writeAMF0OnStatus(streamId, "status", "NetStream.Play.Stop", "Server is shutting down."); err != nil {
+			return
+		}
+		if err := c.writeStreamEOF(streamId); err != nil {
+			return
+		}
+	}
+	c.writeAMF0OnStatus(0, "status", "NetConnection.Connect.Closed", "Server is shutting down.")
+}
+
+// setReadDeadline sets the deadline for receiving the next message: the read
+// timeout from now, or sooner if the media of a publisher is due first. It
+// fails once a publisher has sent no media for the publish timeout.
+func (c *conn) setReadDeadline() error {
+	now := time.Now()
+	var deadline time.Time
+	if c.readTimeout > 0 {
+		deadline = now.Add(c.readTimeout)
+	}
+	if c.publishTimeout > 0 && len(c.published) > 0 {
+		due := c.lastMedia.Add(c.publishTimeout)
+		if !now.Before(due) {
+			return fmt.Errorf("rtmp: publisher sent no media for %s", c.publishTimeout)
+		}
+		if deadline.IsZero() || due.Before(deadline) {
+			deadline = due
+		}
+	}
+	if err := c.rwc.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	// Checked after setting the deadline, which may have replaced the one
+	// set by shutdown
+	if atomic.LoadInt32(&c.closing) != 0 {
+		return errors.New("rtmp: server shutting down")
+	}
+	return nil
+}
+
+// WriteMessage implements ResponseWriter.
+func (c *conn) WriteMessage(m *Message) error {
+	return c.writeMessage(m)
+}
+
+// Context implements ResponseWriter.
+func (c *conn) Context() context.Context {
+	return c.ctx
+}
+
+// RemoteAddr implements ResponseWriter.
+func (c *conn) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+// LocalAddr implements ResponseWriter.
+func (c *conn) LocalAddr() net.Addr {
+	return c.rwc.LocalAddr()
+}
+
+// ConnectParams implements ResponseWriter.
+func (c *conn) ConnectParams() *ConnectParams {
+	return c.connectParams()
+}
+
+// RTT implements ResponseWriter.
+func (c *conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// handleProtocolControlMessage applies a protocol control message received
+// from the peer to the connection. It is shared by server and client
+// connections.
+func (c *conn) handleProtocolControlMessage(msg *Message) error {
+	if msg.TypeId == TypeUserControl {
+		return c.handleUserControl(msg)
+	}
+	if len(msg.Payload) < 4 {
+		return fmt.Errorf("rtmp: protocol control message type %d too short", msg.TypeId)
+	}
+	v := binary.BigEndian.Uint32(msg.Payload[:4])
+
+	switch msg.TypeId {
+	case TypeSetChunkSize:
+		// The most significant bit must be zero
+		size := v &^ 0x80000000
+		if size == 0 {
+			return errors.New("rtmp: set chunk size of 0 is invalid")
+		}
+		c.incChunkSize = size
+
+	case TypeAbort:
+		// Drop the partially received message of the chunk stream
+		if cs, ok := c.chunkStreams[v]; ok {
+			cs.buf = nil
+		}
+
+	case TypeAcknowledgement:
+		c.mu.Lock()
+		c.peerAckedSeq = v
+		c.peerAcking = true
+		if c.ackCh != nil {
+			close(c.ackCh)
+			c.ackCh = nil
+		}
+		c.mu.Unlock()
+
+	case TypeWindowAcknowledgementSize:
+		if v == 0 {
+			return errors.New("rtmp: window acknowledgement size of 0 is invalid")
+		}
+		c.ackWindowSize = v
+
+	case TypeSetPeerBandwidth:
+		if len(msg.Payload) < 5 {
+			return errors.New("rtmp: set peer bandwidth message too short")
+		}
+		return c.setPeerBandwidth(v, msg.Payload[4])
+	}
+	return nil
+}
+
+// Limit types of Set Peer Bandwidth
+const (
+	limitTypeHard    uint8 = 0 // limit output to the window size
+	limitTypeSoft    uint8 = 1 // limit output to the window size or the current limit, whichever is smaller
+	limitTypeDynamic uint8 = 2 // hard if the current limit is hard, ignored otherwise
+)
+
+// setPeerBandwidth applies a Set Peer Bandwidth message limiting our output to
+// size bytes per acknowledgement. As the spec requires, the peer is sent our
+// new Window Acknowledgement Size if the window changed from the one last
+// announced to it.
+func (c *conn) setPeerBandwidth(size uint32, limitType uint8) error {
+	c.mu.Lock()
+	switch limitType {
+	case limitTypeDynamic:
+		if c.peerBandwidthLimit != limitTypeHard || c.peerBandwidth == 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		limitType = limitTypeHard
+		fallthrough
+	case limitTypeHard:
+		c.peerBandwidth = size
+	case limitTypeSoft:
+		if c.peerBandwidth != 0 && c.peerBandwidth < size {
+			size = c.peerBandwidth
+		}
+		c.peerBandwidth = size
+	default:
+		c.mu.Unlock()
+		return fmt.Errorf("rtmp: unknown set peer bandwidth limit type: %d", limitType)
+	}
+	c.peerBandwidthLimit = limitType
+	announce := size != c.outAckWindowSize
+	c.mu.Unlock()
+
+	if announce {
+		return c.writeWindowSizeAcknowledgementChunk(size)
+	}
+	return nil
+}
+
+// handleMessage acts on a single message received from the peer.
+func (c *conn) handleMessage(ctx context.Context, msg *Message) error {
+	if msg.TypeId != TypeAudio && msg.TypeId != TypeVideo {
+		c.log(LevelDebug, "message", "type", msg.TypeId, "stream", msg.StreamId, "size", len(msg.Payload))
+	}
+	switch msg.TypeId {
+	case TypeSetChunkSize, TypeAbort, TypeAcknowledgement, TypeUserControl, TypeWindowAcknowledgementSize, TypeSetPeerBandwidth:
+		return c.handleProtocolControlMessage(msg)
+
+	case TypeAudio, TypeVideo, TypeAMF0Data, TypeAMF3Data:
+		if ls, ok := c.published[msg.StreamId]; ok {
+			c.lastMedia = time.Now()
+			ls.broadcast(amf0Data(msg))
+		}
+
+	case TypeAMF0Command, TypeAMF3Command:
+		cmd, err := decodeCommand(msg)
+		if err != nil {
+			return err
+		}
+		return c.handleCommand(msg.StreamId, cmd)
+	}
+	return nil
+}
+
+// publish starts publishing the message stream streamId under name and
+// starts any tee outputs and recording configured for it.
+func (c *conn) publish(streamId uint32, name string) error {
+	var reason string
+	switch {
+	case !c.streams[streamId]:
+		reason = "Stream was not created."
+	case c.published[streamId] != nil || c.isPlaying(streamId):
+		reason = "Stream is already in use."
+	case name == "":
+		reason = "Missing stream name."
+	}
+	if reason != "" {
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Publish.BadName", reason)
+	}
+	if err := c.authenticate(AuthPublish, c.connectParams(), name); err != nil {
+		c.log(LevelInfo, "publish rejected", "app", c.app, "key", streamKey(c.app, name), "err", err)
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Publish.BadName", err.Error())
+	}
+
+	ls, err := c.server.streams().publish(c.app, name)
+	if err != nil {
+		c.log(LevelInfo, "publish failed", "app", c.app, "key", streamKey(c.app, name), "err", err)
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Publish.BadName", err.Error())
+	}
+	c.log(LevelInfo, "publish", "app", c.app, "key", ls.key, "stream", streamId)
+	c.published[streamId] = ls
+	c.lastMedia = time.Now()
+	c.server.startTee(ls)
+	c.server.startRecording(ls)
+	if err := c.writeStreamBegin(streamId); err != nil {
+		return err
+	}
+	return c.writeAMF0PublishSuccess(streamId, ls.name)
+}
+
+// unpublish stops publishing the message stream streamId, if it is published,
+// and tells the peer.
+func (c *conn) unpublish(streamId uint32) error {
+	ls, ok := c.published[streamId]
+	if !ok {
+		return nil
+	}
+	c.server.streams().unpublish(ls)
+	delete(c.published, streamId)
+	c.log(LevelInfo, "unpublish", "app", c.app, "key", ls.key, "stream", streamId)
+	return c.writeAMF0UnpublishSuccess(streamId, ls.name)
+}
+
+// unpublishAll stops publishing every stream the peer is publishing.
+func (c *conn) unpublishAll() {
+	for streamId, ls := range c.published {
+		c.server.streams().unpublish(ls)
+		delete(c.published, streamId)
+		c.log(LevelInfo, "unpublish", "app", c.app, "key", ls.key, "stream", streamId)
+	}
+}
+
+// ackStallWindows is the number of acknowledgement windows of our output a
+// peer may leave unacknowledged before it is considered stalled.
+const ackStallWindows = 2
+
+// ackWait returns nil while the peer keeps acknowledging our output, and
+// otherwise a channel closed once it next sends an acknowledgement. Writers of
+// media hold off while the peer is stalled, letting their queues drop frames
+// instead of piling unacknowledged data onto the connection. Peers which never
+// acknowledge at all are not held to the window, as many clients do not.
+func (c *conn) ackWait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.peerAcking || c.outAckWindowSize == 0 {
+		return nil
+	}
+	if int64(int32(c.bytesOut-c.peerAckedSeq)) <= int64(ackStallWindows)*int64(c.outAckWindowSize) {
+		return nil
+	}
+	if c.ackCh == nil {
+		c.ackCh = make(chan struct{})
+	}
+	return c.ackCh
+}
+
+// acknowledge sends the peer an Acknowledgement once it has sent us a window's
+// worth of bytes since the last one. It is called from the read loop.
+func (c *conn) acknowledge() error {
+	if c.ackWindowSize == 0 || c.bytesIn-c.sequenceNum < c.ackWindowSize {
+		return nil
+	}
+	c.sequenceNum = c.bytesIn
+	return c.writeAcknowledgement(c.sequenceNum)
+}
+
+// setupBuffers creates the buffered reader and writer of the connection,
+// counting the bytes that go through them for acknowledgements.
+func (c *conn) setupBuffers() {
+	c.bufr = bufio.NewReader(countingReader{r: c.rwc, n: &c.bytesIn})
+	c.bufw = bufio.NewWriter(countingWriter{w: c.rwc, n: &c.bytesOut})
+}
+
+// countingReader adds the number of bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *uint32
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	*r.n += uint32(n)
+	return n, err
+}
+
+// countingWriter adds the number of bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *uint32
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	*w.n += uint32(n)
+	return n, err
+}
+
+// newConn returns a conn for rwc with the default chunk sizes. The buffered
+// reader and writer are set up once the connection is served or dialed.
+func newConn(rwc net.Conn) *conn {
+	return &conn{
+		rwc:           rwc,
+		chunkStreams:  make(map[uint32]*chunkStream),
+		incChunkSize:  defaultChunkSize,
+		outChunkSize:  defaultChunkSize,
+		streams:       make(map[uint32]bool),
+		bufferLengths: make(map[uint32]uint32),
+		published:     make(map[uint32]*liveStream),
+		playing:       make(map[uint32]*player),
 	}
 }
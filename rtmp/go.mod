@@ -1,7 +1,13 @@
 module github.com/iotv/rtmp-tee-server/rtmp
 
-require github.com/iotv/rtmp-tee-server/amf v0.0.0
+require (
+	github.com/iotv/rtmp-tee-server/amf v0.0.0
+	github.com/iotv/rtmp-tee-server/flv v0.0.0
+)
 
-replace github.com/iotv/rtmp-tee-server/amf => ./../amf
+replace (
+	github.com/iotv/rtmp-tee-server/amf => ./../amf
+	github.com/iotv/rtmp-tee-server/flv => ./../flv
+)
 
 go 1.12
@@ -0,0 +1,116 @@
+package rtmp
+
+import (
+	"time"
+)
+
+const (
+	// DefaultGOPCacheMaxBytes is the maximum size of the media payloads
+	// cached per published stream when Server.GOPCacheMaxBytes is 0.
+	DefaultGOPCacheMaxBytes = 16 << 20
+
+	// DefaultGOPCacheMaxDuration is the maximum duration of media cached per
+	// published stream when Server.GOPCacheMaxDuration is 0.
+	DefaultGOPCacheMaxDuration = 10 * time.Second
+)
+
+// gopCache keeps what a subscriber joining a live stream needs to start
+// decoding immediately: the latest metadata, the audio and video sequence
+// headers, and every frame since the last video keyframe. For streams without
+// video the most recent audio is kept instead.
+//
+// The frames are bounded by maxBytes and maxDuration. A group of pictures
+// growing past either bound is dropped as a whole, as a partial one cannot be
+// decoded, and caching resumes at the next keyframe.
+type gopCache struct {
+	maxBytes    int
+	maxDuration uint32 // milliseconds
+
+	metadata    *Message
+	audioHeader *Message
+	videoHeader *Message
+	hasVideo    bool
+
+	frames []*Message
+	size   int
+}
+
+func newGOPCache(maxBytes int, maxDuration time.Duration) *gopCache {
+	if maxBytes <= 0 {
+		maxBytes = DefaultGOPCacheMaxBytes
+	}
+	if maxDuration <= 0 {
+		maxDuration = DefaultGOPCacheMaxDuration
+	}
+	return &gopCache{
+		maxBytes:    maxBytes,
+		maxDuration: uint32(maxDuration / time.Millisecond),
+	}
+}
+
+// add records m in the cache.
+func (g *gopCache) add(m *Message) {
+	switch {
+	case isMetadata(m):
+		g.metadata = m
+		return
+	case isSequenceHeader(m) && m.TypeId == TypeAudio:
+		g.audioHeader = m
+		return
+	case isSequenceHeader(m) && m.TypeId == TypeVideo:
+		g.videoHeader = m
+		return
+	case m.TypeId != TypeAudio && m.TypeId != TypeVideo:
+		return
+	}
+
+	if m.TypeId == TypeVideo && !g.hasVideo {
+		// Audio cached while the stream looked audio only does not start on
+		// a keyframe
+		g.hasVideo = true
+		g.reset()
+	}
+
+	if g.hasVideo {
+		if isKeyframe(m) {
+			g.reset()
+		} else if len(g.frames) == 0 {
+			return // waiting for a keyframe
+		}
+	}
+
+	g.frames = append(g.frames, m)
+	g.size += len(m.Payload)
+
+	if g.hasVideo {
+		if g.size > g.maxBytes || m.Timestamp-g.frames[0].Timestamp > g.maxDuration {
+			g.reset()
+		}
+		return
+	}
+	// Audio frames decode on their own, so only the oldest are dropped
+	for len(g.frames) > 1 && (g.size > g.maxBytes || m.Timestamp-g.frames[0].Timestamp > g.maxDuration) {
+		g.size -= len(g.frames[0].Payload)
+		g.frames[0] = nil
+		g.frames = g.frames[1:]
+	}
+}
+
+// reset drops the cached frames.
+func (g *gopCache) reset() {
+	g.frames = nil
+	g.size = 0
+}
+
+// snapshot returns the messages to replay to a new subscriber, headers first.
+// needKeyframe reports whether the subscriber must skip live messages up to
+// the next keyframe because no decodable group of pictures was cached.
+func (g *gopCache) snapshot() (msgs []*Message, needKeyframe bool) {
+	for _, m := range []*Message{g.metadata, g.videoHeader, g.audioHeader} {
+		if m != nil {
+			msgs = append(msgs, m)
+		}
+	}
+	msgs = append(msgs, g.frames...)
+	return msgs, g.hasVideo && len(g.frames) == 0
+}
@@ -0,0 +1,109 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// timestamps returns the timestamps of the audio and video frames of msgs,
+// leaving out headers and metadata.
+func timestamps(msgs []*Message) []uint32 {
+	var ts []uint32
+	for _, m := range msgs {
+		if !isMetadata(m) && !isSequenceHeader(m) {
+			ts = append(ts, m.Timestamp)
+		}
+	}
+	return ts
+}
+
+func TestGOPCache(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxBytes         int
+		maxDuration      time.Duration
+		in               []*Message
+		want             []uint32
+		wantNeedKeyframe bool
+	}{
+		{
+			name: "keyframe starts a new group",
+			in:   []*Message{keyframeMsg(0), interframeMsg(40), audioMsg(50), keyframeMsg(80), interframeMsg(120)},
+			want: []uint32{80, 120},
+		},
+		{
+			name:             "waits for a keyframe",
+			in:               []*Message{interframeMsg(0), audioMsg(10)},
+			wantNeedKeyframe: true,
+		},
+		{
+			name: "audio before video is dropped",
+			in:   []*Message{audioMsg(0), audioMsg(23), interframeMsg(40), keyframeMsg(80), audioMsg(90)},
+			want: []uint32{80, 90},
+		},
+		{
+			// Each frame is 5 bytes, so the fourth overflows the group
+			name:             "group over maxBytes",
+			maxBytes:         15,
+			in:               []*Message{keyframeMsg(0), interframeMsg(40), interframeMsg(80), interframeMsg(120)},
+			wantNeedKeyframe: true,
+		},
+		{
+			name:             "group over maxDuration",
+			maxDuration:      100 * time.Millisecond,
+			in:               []*Message{keyframeMsg(0), interframeMsg(40), interframeMsg(101)},
+			wantNeedKeyframe: true,
+		},
+		{
+			name:        "caching resumes at the next keyframe",
+			maxDuration: 100 * time.Millisecond,
+			in:          []*Message{keyframeMsg(0), interframeMsg(101), interframeMsg(140), keyframeMsg(180)},
+			want:        []uint32{180},
+		},
+		{
+			// Each frame is 3 bytes
+			name:     "audio only over maxBytes",
+			maxBytes: 7,
+			in:       []*Message{audioMsg(0), audioMsg(23), audioMsg(46)},
+			want:     []uint32{23, 46},
+		},
+		{
+			name:        "audio only over maxDuration",
+			maxDuration: 50 * time.Millisecond,
+			in:          []*Message{audioMsg(0), audioMsg(23), audioMsg(46), audioMsg(69)},
+			want:        []uint32{23, 46, 69},
+		},
+	}
+	for _, tt := range tests {
+		g := newGOPCache(tt.maxBytes, tt.maxDuration)
+		for _, m := range tt.in {
+			g.add(m)
+		}
+		msgs, needKeyframe := g.snapshot()
+		if got := timestamps(msgs); !reflect.DeepEqual(got, tt.want) || needKeyframe != tt.wantNeedKeyframe {
+			t.Errorf("%s: cached %v, needKeyframe %t, want %v, %t", tt.name, got, needKeyframe, tt.want, tt.wantNeedKeyframe)
+		}
+	}
+}
+
+func TestGOPCacheHeaders(t *testing.T) {
+	g := newGOPCache(0, 0)
+	metadata, video, audio := metadataMsg(), videoHeaderMsg(), audioHeaderMsg()
+	for _, m := range []*Message{audio, keyframeMsg(0), metadata, video, {TypeId: TypeAMF0Command}} {
+		g.add(m)
+	}
+	// Headers survive the group they came with and come first, in the order
+	// decoders need them
+	newVideo := videoHeaderMsg()
+	g.add(newVideo)
+	g.add(keyframeMsg(80))
+	msgs, needKeyframe := g.snapshot()
+	want := []*Message{metadata, newVideo, audio, keyframeMsg(80)}
+	if !reflect.DeepEqual(msgs, want) || needKeyframe {
+		t.Errorf("got %d messages, needKeyframe %t, want %d", len(msgs), needKeyframe, len(want))
+	}
+	if msgs[1] != newVideo {
+		t.Error("old video sequence header replayed")
+	}
+}
@@ -0,0 +1,104 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Sizes of the handshake packets C1, C2, S1 and S2, and of their digests
+const (
+	handshakeSize = 1536
+	digestSize    = sha256.Size
+)
+
+// The keys of the complex handshake. Clients sign C1 with the first 30 bytes
+// of genuineFPKey, servers sign S1 with the first 36 bytes of genuineFMSKey,
+// and the whole keys sign C2 and S2.
+var (
+	genuineKeySuffix = []byte{
+		0xF0, 0xEE, 0xC2, 0x4A, 0x80, 0x68, 0xBE, 0xE8,
+		0x2E, 0x00, 0xD0, 0xD1, 0x02, 0x9E, 0x7E, 0x57,
+		0x6E, 0xEC, 0x5D, 0x2D, 0x29, 0x80, 0x6F, 0xAB,
+		0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
+	}
+	genuineFPKey  = append([]byte("Genuine Adobe Flash Player 001"), genuineKeySuffix...)
+	genuineFMSKey = append([]byte("Genuine Adobe Flash Media Server 001"), genuineKeySuffix...)
+)
+
+// serverHandshakeVersion is the version S1 carries in complex handshakes, in
+// place of the zeroes of the simple handshake. Clients only check that it is
+// not zero.
+var serverHandshakeVersion = []byte{0x04, 0x05, 0x00, 0x01}
+
+// digestOffset returns the offset of the digest in the C1 or S1 packet b laid
+// out in scheme 0 or 1.
+//
+// Past the time and version, a complex C1 or S1 holds two blocks of 764
+// bytes, a key block and a digest block, in that order for scheme 1 and the
+// other way around for scheme 0. The first 4 bytes of the digest block sum up
+// to where in the rest of the block the digest is.
+func digestOffset(b []byte, scheme int) int {
+	block := 8
+	if scheme == 1 {
+		block += 764
+	}
+	sum := int(b[block]) + int(b[block+1]) + int(b[block+2]) + int(b[block+3])
+	return block + 4 + sum%(764-4-digestSize)
+}
+
+// digest returns the HMAC-SHA256 with key of b without the digest at pos, or
+// of the whole of b if pos is negative.
+func digest(b []byte, pos int, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	if pos < 0 {
+		mac.Write(b)
+	} else {
+		mac.Write(b[:pos])
+		mac.Write(b[pos+digestSize:])
+	}
+	return mac.Sum(nil)
+}
+
+// complexHandshake returns the S1 and S2 answering the complex handshake C1,
+// or nils if c1 is not signed with a digest of either scheme, as in the
+// simple handshake.
+//
+// S1 is signed in the scheme of C1. S2 is random but for its last 32 bytes,
+// a digest of the rest keyed with a digest of the client's C1 digest.
+func complexHandshake(c1 []byte) (s1, s2 []byte, err error) {
+	// Simple handshakes have zeroes where the version is
+	if binary.BigEndian.Uint32(c1[4:8]) == 0 {
+		return nil, nil, nil
+	}
+	scheme, pos := -1, 0
+	for s := 0; s < 2 && scheme < 0; s++ {
+		pos = digestOffset(c1, s)
+		if hmac.Equal(c1[pos:pos+digestSize], digest(c1, pos, genuineFPKey[:30])) {
+			scheme = s
+		}
+	}
+	if scheme < 0 {
+		return nil, nil, nil
+	}
+	clientDigest := c1[pos : pos+digestSize]
+
+	s1 = make([]byte, handshakeSize)
+	binary.BigEndian.PutUint32(s1[0:4], getUint32MilsTimestamp())
+	copy(s1[4:8], serverHandshakeVersion)
+	if _, err := rand.Read(s1[8:]); err != nil {
+		return nil, nil, fmt.Errorf("rtmp: S1 random entropy error: %s", err.Error())
+	}
+	pos = digestOffset(s1, scheme)
+	copy(s1[pos:], digest(s1, pos, genuineFMSKey[:36]))
+
+	s2 = make([]byte, handshakeSize)
+	if _, err := rand.Read(s2); err != nil {
+		return nil, nil, fmt.Errorf("rtmp: S2 random entropy error: %s", err.Error())
+	}
+	key := digest(clientDigest, -1, genuineFMSKey)
+	copy(s2[handshakeSize-digestSize:], digest(s2[:handshakeSize-digestSize], -1, key))
+	return s1, s2, nil
+}
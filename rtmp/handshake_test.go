@@ -0,0 +1,208 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+// testC1 returns a C1 of known bytes with a version, so signed with neither
+// scheme.
+func testC1() []byte {
+	c1 := make([]byte, handshakeSize)
+	for i := range c1 {
+		c1[i] = byte(i * 7)
+	}
+	copy(c1[0:8], []byte{0, 0, 0, 0, 0x80, 0x00, 0x07, 0x02})
+	return c1
+}
+
+// signC1 signs c1 in scheme as a Flash Player does, returning the digest.
+func signC1(c1 []byte, scheme int) []byte {
+	pos := digestOffset(c1, scheme)
+	mac := hmac.New(sha256.New, []byte("Genuine Adobe Flash Player 001"))
+	mac.Write(c1[:pos])
+	mac.Write(c1[pos+digestSize:])
+	copy(c1[pos:], mac.Sum(nil))
+	return c1[pos : pos+digestSize]
+}
+
+func TestDigestKnownAnswer(t *testing.T) {
+	// Computed independently of this package
+	tests := []struct {
+		scheme int
+		offset int
+		digest string
+	}{
+		{0, 278, "a2aa8a9abee4f6d698256b602611f06fc4f152cf0255add445c3371249165e67"},
+		{1, 930, "d8c257827bb5c84c3421f9d1b6a9d50be02d177026f88ee2a8fcfadb136fc362"},
+	}
+	for _, tt := range tests {
+		c1 := testC1()
+		pos := digestOffset(c1, tt.scheme)
+		if pos != tt.offset {
+			t.Errorf("scheme %d: digest offset %d, want %d", tt.scheme, pos, tt.offset)
+			continue
+		}
+		if got := hex.EncodeToString(digest(c1, pos, genuineFPKey[:30])); got != tt.digest {
+			t.Errorf("scheme %d: digest %s, want %s", tt.scheme, got, tt.digest)
+		}
+	}
+}
+
+func TestDigestOffsetRange(t *testing.T) {
+	// The offset bytes sum up to anywhere from 0 to 1020, which wraps so the
+	// digest stays inside its block
+	for _, b := range []byte{0x00, 0xFF} {
+		c1 := bytes.Repeat([]byte{b}, handshakeSize)
+		for scheme, block := range []int{8, 8 + 764} {
+			pos := digestOffset(c1, scheme)
+			if pos < block+4 || pos+digestSize > block+764 {
+				t.Errorf("scheme %d, bytes %#x: digest at %d outside block at %d", scheme, b, pos, block)
+			}
+		}
+	}
+}
+
+func TestComplexHandshake(t *testing.T) {
+	for scheme := 0; scheme < 2; scheme++ {
+		c1 := testC1()
+		clientDigest := append([]byte(nil), signC1(c1, scheme)...)
+
+		s1, s2, err := complexHandshake(c1)
+		if err != nil {
+			t.Fatalf("scheme %d: %v", scheme, err)
+		}
+		if s1 == nil {
+			t.Fatalf("scheme %d: signed C1 got the simple handshake", scheme)
+		}
+		if !bytes.Equal(s1[4:8], serverHandshakeVersion) {
+			t.Errorf("scheme %d: S1 version % x", scheme, s1[4:8])
+		}
+
+		// S1 is signed in the scheme of C1
+		pos := digestOffset(s1, scheme)
+		mac := hmac.New(sha256.New, []byte("Genuine Adobe Flash Media Server 001"))
+		mac.Write(s1[:pos])
+		mac.Write(s1[pos+digestSize:])
+		if !hmac.Equal(s1[pos:pos+digestSize], mac.Sum(nil)) {
+			t.Errorf("scheme %d: S1 digest does not validate", scheme)
+		}
+
+		// S2 is signed with a key derived from the C1 digest
+		mac = hmac.New(sha256.New, genuineFMSKey)
+		mac.Write(clientDigest)
+		mac = hmac.New(sha256.New, mac.Sum(nil))
+		mac.Write(s2[:handshakeSize-digestSize])
+		if !hmac.Equal(s2[handshakeSize-digestSize:], mac.Sum(nil)) {
+			t.Errorf("scheme %d: S2 digest does not validate", scheme)
+		}
+	}
+}
+
+func TestComplexHandshakeFallback(t *testing.T) {
+	zeroVersion := testC1()
+	signC1(zeroVersion, 0)
+	copy(zeroVersion[4:8], []byte{0, 0, 0, 0})
+
+	tampered := testC1()
+	signC1(tampered, 1)
+	tampered[digestOffset(tampered, 1)] ^= 0xFF
+
+	wrongKey := testC1()
+	pos := digestOffset(wrongKey, 0)
+	copy(wrongKey[pos:], digest(wrongKey, pos, genuineFMSKey[:36]))
+
+	tests := []struct {
+		name string
+		c1   []byte
+	}{
+		{"unsigned", testC1()},
+		{"zero version", zeroVersion},
+		{"tampered digest", tampered},
+		{"server key", wrongKey},
+	}
+	for _, tt := range tests {
+		s1, s2, err := complexHandshake(tt.c1)
+		if err != nil || s1 != nil || s2 != nil {
+			t.Errorf("%s: got S1 %t, S2 %t, err %v, want the simple handshake", tt.name, s1 != nil, s2 != nil, err)
+		}
+	}
+}
+
+// clientHandshake runs the client side of a handshake sending c1 over nc,
+// answering S1 with C2 as c2 returns, and returns S1 and S2.
+func clientHandshake(t *testing.T, nc net.Conn, c1 []byte, c2 func(s1 []byte) []byte) (s1, s2 []byte) {
+	t.Helper()
+	if _, err := nc.Write(append([]byte{0x03}, c1...)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(nc, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0x03 {
+		t.Fatalf("S0 %#x", b[0])
+	}
+	s1, s2 = b[1:1+handshakeSize], b[1+handshakeSize:]
+	if _, err := nc.Write(c2(s1)); err != nil {
+		t.Fatal(err)
+	}
+	return s1, s2
+}
+
+func TestReceiveHandshake(t *testing.T) {
+	echo := func(s1 []byte) []byte { return s1 }
+	random := func(s1 []byte) []byte { return make([]byte, handshakeSize) }
+
+	tests := []struct {
+		name    string
+		scheme  int // -1 to leave C1 unsigned
+		c2      func(s1 []byte) []byte
+		wantErr bool
+	}{
+		{"simple", -1, echo, false},
+		{"simple C2 not echoing S1", -1, random, true},
+		{"complex scheme 0", 0, random, false},
+		{"complex scheme 1", 1, random, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := newConn(server)
+			c.setupBuffers()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- c.receiveHandshake(context.Background())
+				server.Close()
+			}()
+
+			c1 := testC1()
+			if tt.scheme >= 0 {
+				signC1(c1, tt.scheme)
+			}
+			s1, s2 := clientHandshake(t, client, c1, tt.c2)
+			if err := <-errc; (err != nil) != tt.wantErr {
+				t.Fatalf("receiveHandshake: %v", err)
+			}
+
+			complex := tt.scheme >= 0
+			if complex != bytes.Equal(s1[4:8], serverHandshakeVersion) {
+				t.Errorf("S1 version % x", s1[4:8])
+			}
+			// The simple handshake echoes C1 in S2
+			if !complex && !bytes.Equal(s2, c1) {
+				t.Error("S2 does not echo C1")
+			}
+			if complex && bytes.Equal(s2, c1) {
+				t.Error("S2 echoes C1 in the complex handshake")
+			}
+		})
+	}
+}
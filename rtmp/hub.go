@@ -0,0 +1,168 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A subscriber receives the messages of a live stream. deliver is called from
+// the publisher's read loop and must not block.
+type subscriber interface {
+	deliver(m *Message)
+}
+
+// liveStream is a stream currently being published on the server along with
+// the subscribers its messages are relayed to.
+type liveStream struct {
+	key  string
+	app  string
+	name string // stream name without query string
+
+	// ctx is canceled once the stream is unpublished
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	subs  map[subscriber]struct{}
+	cache *gopCache
+}
+
+// subscribe adds s to the subscribers of the stream and returns the cached
+// messages s must be sent before anything delivered to it, so it can start
+// decoding right away. If needKeyframe is set the cache held no decodable
+// frames and s must skip delivered messages up to the next keyframe.
+func (ls *liveStream) subscribe(s subscriber) (cached []*Message, needKeyframe bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.subs[s] = struct{}{}
+	return ls.cache.snapshot()
+}
+
+// unsubscribe removes s from the subscribers of the stream.
+func (ls *liveStream) unsubscribe(s subscriber) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	delete(ls.subs, s)
+}
+
+// broadcast delivers m to every subscriber of the stream. Subscribers share m
+// and must not modify it.
+func (ls *liveStream) broadcast(m *Message) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.cache.add(m)
+	for s := range ls.subs {
+		s.deliver(m)
+	}
+}
+
+// streamHub tracks the streams being published on a server by stream key.
+type streamHub struct {
+	mu      sync.Mutex
+	streams map[string]*liveStream
+
+	// Bounds of the GOP cache of each stream
+	cacheMaxBytes    int
+	cacheMaxDuration time.Duration
+}
+
+func newStreamHub(cacheMaxBytes int, cacheMaxDuration time.Duration) *streamHub {
+	return &streamHub{
+		streams:          make(map[string]*liveStream),
+		cacheMaxBytes:    cacheMaxBytes,
+		cacheMaxDuration: cacheMaxDuration,
+	}
+}
+
+// publish registers a new live stream for the stream name in app. Only one
+// publisher may publish a stream key at a time.
+func (h *streamHub) publish(app, name string) (*liveStream, error) {
+	key := streamKey(app, name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.streams[key]; ok {
+		return nil, fmt.Errorf("rtmp: stream %q is already being published", key)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ls := &liveStream{
+		key:    key,
+		app:    app,
+		name:   key[len(app)+1:],
+		ctx:    ctx,
+		cancel: cancel,
+		subs:   make(map[subscriber]struct{}),
+		cache:  newGOPCache(h.cacheMaxBytes, h.cacheMaxDuration),
+	}
+	h.streams[key] = ls
+	return ls, nil
+}
+
+// lookup returns the live stream published under key, if any.
+func (h *streamHub) lookup(key string) (*liveStream, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ls, ok := h.streams[key]
+	return ls, ok
+}
+
+// unpublish removes ls from the hub and cancels its context.
+func (h *streamHub) unpublish(ls *liveStream) {
+	h.mu.Lock()
+	if h.streams[ls.key] == ls {
+		delete(h.streams, ls.key)
+	}
+	h.mu.Unlock()
+	ls.cancel()
+}
+
+// streamKey returns the key a stream is published under in the hub, which is
+// the app and the stream name without its query string.
+func streamKey(app, name string) string {
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name = name[:i]
+	}
+	return app + "/" + name
+}
+
+// messageQueue is a bounded queue of messages from a live stream to a single
+// subscriber. Pushing never blocks. When the queue is full the message is
+// dropped along with every following message up to the next video keyframe,
+// since frames referencing a dropped one cannot be decoded anyway.
+type messageQueue struct {
+	ch chan *Message
+
+	// Only accessed by push, on the publisher's read loop
+	waitKeyframe bool
+	hasVideo     bool
+}
+
+func newMessageQueue(size int) *messageQueue {
+	return &messageQueue{ch: make(chan *Message, size)}
+}
+
+// deliver implements subscriber by pushing m.
+func (q *messageQueue) deliver(m *Message) {
+	q.push(m)
+}
+
+// push queues m without blocking.
+func (q *messageQueue) push(m *Message) {
+	if m.TypeId == TypeVideo {
+		q.hasVideo = true
+	}
+	if q.waitKeyframe && q.hasVideo && !isKeyframe(m) && !isSequenceHeader(m) && !isMetadata(m) {
+		return
+	}
+	select {
+	case q.ch <- m:
+		// Headers and metadata let through while waiting do not end the wait
+		if isKeyframe(m) || !q.hasVideo {
+			q.waitKeyframe = false
+		}
+	default:
+		q.waitKeyframe = true
+	}
+}
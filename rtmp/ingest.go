@@ -0,0 +1,147 @@
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/flv"
+)
+
+// PublishFile publishes the FLV file at path as the stream name in app, as if
+// a peer had published it, so it is played, teed and recorded like any other
+// stream. Tags are sent in real time, paced by their timestamps. If loop is set
+// the file is replayed from the start whenever it ends, with timestamps
+// carrying on from the previous pass.
+//
+// PublishFile blocks until the file ends, ctx is done or reading the file
+// fails, and unpublishes the stream before returning.
+func (srv *Server) PublishFile(ctx context.Context, path, app, name string, loop bool) error {
+	ls, err := srv.streams().publish(app, name)
+	if err != nil {
+		return err
+	}
+	defer srv.streams().unpublish(ls)
+	srv.startTee(ls)
+	srv.startRecording(ls)
+
+	p := &filePublisher{ls: ls, start: time.Now()}
+	for {
+		if err := p.publish(ctx, path); err != nil {
+			return err
+		}
+		if !loop {
+			return nil
+		}
+	}
+}
+
+// maxTagInterval caps the interval between tags, in milliseconds, that the
+// next pass of a looped file starts after the last tag, should the file have
+// gaps.
+const maxTagInterval = 1000
+
+// filePublisher broadcasts the tags of an FLV file to a live stream.
+type filePublisher struct {
+	ls    *liveStream
+	start time.Time // when the stream timestamp was 0
+
+	// Stream timestamps of the start of the current pass and of the latest
+	// tag, and the latest interval between tags
+	offset uint32
+	last   uint32
+	delta  uint32
+}
+
+// publish makes one pass over the file at path.
+func (p *filePublisher) publish(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("rtmp: publish file: %s", err.Error())
+	}
+	defer f.Close()
+
+	r := flv.NewReader(bufio.NewReader(f))
+	if _, err := r.ReadHeader(); err != nil {
+		return err
+	}
+
+	var base uint32
+	tags := 0
+	for {
+		tagType, ts, data, err := r.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch MessageType(tagType) {
+		case TypeAudio, TypeVideo, TypeAMF0Data:
+		default:
+			continue
+		}
+		if tags == 0 {
+			base = ts
+		}
+		tags++
+
+		// Tags from before the first, as when audio and video are slightly
+		// out of order, are sent at the start of the pass
+		rel := ts - base
+		if int32(rel) < 0 {
+			rel = 0
+		}
+		m := &Message{
+			Timestamp: p.offset + rel,
+			TypeId:    MessageType(tagType),
+			Payload:   data,
+		}
+		if err := p.wait(ctx, m.Timestamp); err != nil {
+			return err
+		}
+		// Tags going back in time, as in files joined together, neither
+		// move the latest timestamp back nor count as an interval
+		d := int32(m.Timestamp - p.last)
+		if tags > 1 && d > 0 {
+			p.delta = uint32(d)
+			if p.delta > maxTagInterval {
+				p.delta = maxTagInterval
+			}
+		}
+		if tags == 1 || d > 0 {
+			p.last = m.Timestamp
+		}
+		p.ls.broadcast(m)
+	}
+	if tags == 0 {
+		return errors.New("rtmp: publish file: no audio, video or script data in " + path)
+	}
+
+	// The next pass starts one frame interval after the last tag
+	if p.delta == 0 {
+		p.delta = 1
+	}
+	p.offset = p.last + p.delta
+	return nil
+}
+
+// wait sleeps until the stream timestamp ts is due.
+func (p *filePublisher) wait(ctx context.Context, ts uint32) error {
+	d := time.Until(p.start.Add(time.Duration(ts) * time.Millisecond))
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
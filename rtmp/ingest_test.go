@@ -0,0 +1,122 @@
+package rtmp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/flv"
+)
+
+// writeFLV writes msgs as the tags of the FLV file path.
+func writeFLV(t *testing.T, path string, msgs ...*Message) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := flv.NewWriter(f)
+	if err := w.WriteHeader(flv.FlagAudio | flv.FlagVideo); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if err := w.WriteTag(uint8(m.TypeId), m.Timestamp, m.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "in.flv")
+	metadata := metadataMsg()
+	metadata.Timestamp = 1000
+	writeFLV(t, path,
+		metadata,
+		keyframeMsg(1000),
+		audioMsg(990), // before the first tag
+		&Message{Timestamp: 1010, TypeId: 7, Payload: []byte{0}}, // not media, skipped
+		interframeMsg(1040),
+	)
+
+	hub := newStreamHub(0, 0)
+	ls, _ := hub.publish("live", "abc")
+	defer hub.unpublish(ls)
+	q := newMessageQueue(16)
+	ls.subscribe(q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p := &filePublisher{ls: ls, start: time.Now()}
+	for pass := 0; pass < 2; pass++ {
+		if err := p.publish(ctx, path); err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+	}
+	// Each pass takes as long as its tags span, 40ms
+	if elapsed := time.Since(p.start); elapsed < 80*time.Millisecond {
+		t.Errorf("two passes took %s", elapsed)
+	}
+
+	var types []MessageType
+	var timestamps []uint32
+	for len(q.ch) > 0 {
+		m := <-q.ch
+		types = append(types, m.TypeId)
+		timestamps = append(timestamps, m.Timestamp)
+	}
+	// The second pass starts one tag interval after the first ends
+	wantTypes := []MessageType{TypeAMF0Data, TypeVideo, TypeAudio, TypeVideo, TypeAMF0Data, TypeVideo, TypeAudio, TypeVideo}
+	wantTimestamps := []uint32{0, 0, 0, 40, 80, 80, 80, 120}
+	if !reflect.DeepEqual(types, wantTypes) || !reflect.DeepEqual(timestamps, wantTimestamps) {
+		t.Errorf("got %v at %v, want %v at %v", types, timestamps, wantTypes, wantTimestamps)
+	}
+
+	// Publishing stops with ctx
+	cancel()
+	if err := p.publish(ctx, path); err != context.Canceled {
+		t.Errorf("publish after cancel: %v", err)
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.flv")
+	writeFLV(t, empty)
+	valid := filepath.Join(dir, "valid.flv")
+	writeFLV(t, valid, keyframeMsg(0))
+
+	srv := &Server{Logger: discardLogger}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"missing", filepath.Join(dir, "missing.flv"), true},
+		{"no tags", empty, true},
+		{"valid", valid, false},
+	}
+	for _, tt := range tests {
+		err := srv.PublishFile(context.Background(), tt.path, "live", "abc", false)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		// The stream is unpublished when publishing ends
+		if _, ok := srv.streams().lookup("live/abc"); ok {
+			t.Errorf("%s: stream still published", tt.name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Level is the importance of a log entry. Levels have the values of the
+// log/slog levels, so Loggers passing entries on to slog may convert them
+// with slog.Level(level).
+type Level int
+
+const (
+	LevelDebug Level = -4 // tracing, such as the steps of handshakes
+	LevelInfo  Level = 0  // connections, publishing and playing
+	LevelWarn  Level = 4  // failures the server recovers from
+	LevelError Level = 8  // failures stopping the server from working
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "Level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// A Logger records what a Server does.
+//
+// Log is called with a message followed by alternating keys and values, in
+// the manner of log/slog: keys are strings and values anything fmt formats.
+// Entries about a connection start with "conn", an id unique to the server,
+// and "remote", the address of the peer, and carry "app", "key", the stream
+// key, and "type", the message type, where they apply. Log may be called from
+// many goroutines at once.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// The LoggerFunc type is an adapter to allow the use of ordinary functions
+// as Loggers. For example, to log to the *slog.Logger logger:
+//
+//	rtmp.LoggerFunc(func(level rtmp.Level, msg string, keyvals ...interface{}) {
+//		logger.Log(context.Background(), slog.Level(level), msg, keyvals...)
+//	})
+type LoggerFunc func(level Level, msg string, keyvals ...interface{})
+
+// Log calls f(level, msg, keyvals...).
+func (f LoggerFunc) Log(level Level, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// NewStdLogger returns a Logger writing entries at level min and above to l,
+// or to the standard logger if l is nil, as lines of key=value pairs such as
+//
+//	level=INFO msg=publish conn=3 remote=10.0.0.7:51234 app=live key=live/abc
+func NewStdLogger(l *log.Logger, min Level) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+func (s *stdLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < s.min {
+		return
+	}
+	b := append([]byte("level="), level.String()...)
+	b = append(b, " msg="...)
+	b = appendLogValue(b, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		// A key without a value is logged as the value of !BADKEY, as
+		// slog does
+		key, v := "!BADKEY", keyvals[i]
+		if i+1 < len(keyvals) {
+			key, v = fmt.Sprint(keyvals[i]), keyvals[i+1]
+		}
+		b = append(b, ' ')
+		b = append(b, key...)
+		b = append(b, '=')
+		b = appendLogValue(b, v)
+	}
+	if s.l != nil {
+		s.l.Output(2, string(b))
+	} else {
+		log.Output(2, string(b))
+	}
+}
+
+// appendLogValue appends v to b, quoted if it would not read back as a single
+// value otherwise.
+func appendLogValue(b []byte, v interface{}) []byte {
+	s := fmt.Sprint(v)
+	quote := s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || !unicode.IsPrint(r)
+	}) >= 0
+	if quote {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+// defaultLogger is the Logger of servers whose Logger is nil.
+var defaultLogger = NewStdLogger(nil, LevelInfo)
+
+// logger returns the Logger of srv.
+func (srv *Server) logger() Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return defaultLogger
+}
+
+// log records an entry about the connection. Client connections log nothing.
+func (c *conn) log(level Level, msg string, keyvals ...interface{}) {
+	if c.server == nil {
+		return
+	}
+	kv := append([]interface{}{"conn", c.id, "remote", c.rwc.RemoteAddr()}, keyvals...)
+	c.server.logger().Log(level, msg, kv...)
+}
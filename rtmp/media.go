@@ -0,0 +1,61 @@
+package rtmp
+
+import (
+	"bytes"
+)
+
+// isKeyframe reports whether m is a video message carrying a keyframe. The
+// frame type is held in bits 4-6 of the first byte for both legacy FLV video
+// tags and enhanced RTMP, where bit 7 marks the extended header. Sequence
+// headers are flagged as keyframes too but carry no frame, so they are not.
+func isKeyframe(m *Message) bool {
+	return m.TypeId == TypeVideo && len(m.Payload) > 0 && (m.Payload[0]>>4)&0x07 == 1 && !isSequenceHeader(m)
+}
+
+// isSequenceHeader reports whether m is an audio or video message carrying a
+// decoder configuration record, such as an AVC sequence header or AAC audio
+// specific config, which decoders need before any other frame.
+func isSequenceHeader(m *Message) bool {
+	if len(m.Payload) < 2 {
+		return false
+	}
+	switch m.TypeId {
+	case TypeVideo:
+		if m.Payload[0]&0x80 != 0 { // Enhanced RTMP, packet type 0 is SequenceStart
+			return m.Payload[0]&0x0F == 0
+		}
+		codec := m.Payload[0] & 0x0F
+		return (codec == 7 || codec == 12) && m.Payload[1] == 0 // AVC or HEVC sequence header
+	case TypeAudio:
+		return m.Payload[0]>>4 == 10 && m.Payload[1] == 0 // AAC sequence header
+	}
+	return false
+}
+
+// setDataFrame is the AMF0 encoding of the "@setDataFrame" string publishers
+// prefix stream metadata with.
+var setDataFrame = []byte("\x02\x00\x0d@setDataFrame")
+
+// onMetaData is the AMF0 encoding of the "onMetaData" string.
+var onMetaData = []byte("\x02\x00\x0aonMetaData")
+
+// isMetadata reports whether m is an AMF0 data message setting the stream
+// metadata, either as sent by a publisher with @setDataFrame or as onMetaData.
+func isMetadata(m *Message) bool {
+	if m.TypeId != TypeAMF0Data {
+		return false
+	}
+	return bytes.HasPrefix(m.Payload, setDataFrame) || bytes.HasPrefix(m.Payload, onMetaData)
+}
+
+// stripSetDataFrame returns m with the @setDataFrame prefix publishers add to
+// metadata removed, leaving onMetaData and the metadata itself, which is what
+// players and FLV files expect. Any other message is returned as is.
+func stripSetDataFrame(m *Message) *Message {
+	if m.TypeId != TypeAMF0Data || !bytes.HasPrefix(m.Payload, setDataFrame) {
+		return m
+	}
+	out := *m
+	out.Payload = m.Payload[len(setDataFrame):]
+	return &out
+}
@@ -0,0 +1,141 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// MessageType is the type id of an RTMP message.
+type MessageType uint8
+
+// Message type ids defined by the RTMP specification. Types 1 through 6 are
+// protocol control messages and are only sent on message stream 0 and chunk
+// stream 2.
+const (
+	TypeSetChunkSize              MessageType = 1
+	TypeAbort                     MessageType = 2
+	TypeAcknowledgement           MessageType = 3
+	TypeUserControl               MessageType = 4
+	TypeWindowAcknowledgementSize MessageType = 5
+	TypeSetPeerBandwidth          MessageType = 6
+	TypeAudio                     MessageType = 8
+	TypeVideo                     MessageType = 9
+	TypeAMF3Data                  MessageType = 15
+	TypeAMF3SharedObject          MessageType = 16
+	TypeAMF3Command               MessageType = 17
+	TypeAMF0Data                  MessageType = 18
+	TypeAMF0SharedObject          MessageType = 19
+	TypeAMF0Command               MessageType = 20
+	TypeAggregate                 MessageType = 22
+)
+
+var messageTypeName = map[MessageType]string{
+	TypeSetChunkSize:              "SetChunkSize",
+	TypeAbort:                     "Abort",
+	TypeAcknowledgement:           "Acknowledgement",
+	TypeUserControl:               "UserControl",
+	TypeWindowAcknowledgementSize: "WindowAcknowledgementSize",
+	TypeSetPeerBandwidth:          "SetPeerBandwidth",
+	TypeAudio:                     "Audio",
+	TypeVideo:                     "Video",
+	TypeAMF3Data:                  "AMF3Data",
+	TypeAMF3SharedObject:          "AMF3SharedObject",
+	TypeAMF3Command:               "AMF3Command",
+	TypeAMF0Data:                  "AMF0Data",
+	TypeAMF0SharedObject:          "AMF0SharedObject",
+	TypeAMF0Command:               "AMF0Command",
+	TypeAggregate:                 "Aggregate",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeName[t]; ok {
+		return name
+	}
+	return "MessageType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Message is a single RTMP message reassembled from one or more chunks.
+type Message struct {
+	// Timestamp of the message in milliseconds. RTMP timestamps are 32 bit
+	// and wrap around.
+	Timestamp uint32
+
+	// TypeId identifies the kind of payload the message carries.
+	TypeId MessageType
+
+	// StreamId is the message stream the message belongs to. Message stream 0
+	// is the NetConnection, other ids are NetStreams created with createStream.
+	StreamId uint32
+
+	// ChunkStreamId is the chunk stream the message arrived on. When writing
+	// a message it may be left 0 to use the conventional chunk stream for the
+	// message type.
+	ChunkStreamId uint32
+
+	Payload []byte
+}
+
+// defaultChunkStreamId returns the chunk stream id messages of type t are
+// conventionally sent on. These are the ids FFmpeg and librtmp use.
+func defaultChunkStreamId(t MessageType) uint32 {
+	switch t {
+	case TypeSetChunkSize, TypeAbort, TypeAcknowledgement, TypeUserControl, TypeWindowAcknowledgementSize, TypeSetPeerBandwidth:
+		return 2
+	case TypeAudio:
+		return 4
+	case TypeVideo:
+		return 6
+	case TypeAMF0Data, TypeAMF3Data:
+		return 5
+	default: // commands and shared objects
+		return 3
+	}
+}
+
+// decodeCommand decodes the command name, transaction id and arguments of an
+// AMF0 or AMF3 command message. AMF3 command messages start with a format
+// byte, 0 for the AMF0 encoding all clients use, after which values are AMF0
+// with AMF3 values behind AVM+ markers. Those are unwrapped so commands read
+// the same whichever way they were sent.
+func decodeCommand(msg *Message) (amf.AMF0Msg, error) {
+	payload := msg.Payload
+	if msg.TypeId == TypeAMF3Command {
+		if len(payload) == 0 || payload[0] != 0 {
+			return nil, errors.New("rtmp: unsupported AMF3 command message format")
+		}
+		payload = payload[1:]
+	}
+	cmd := amf.AMF0Msg{}
+	d := amf.NewDecoder(bytes.NewReader(payload))
+	for k := 0; ; k++ {
+		v, err := d.Decode()
+		if err == io.EOF {
+			return cmd, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if avm, ok := v.(amf.AMF0AVMPlus); ok {
+			v = avm.Value
+		}
+		cmd[k] = v
+	}
+}
+
+// amf0Data returns msg as an AMF0 data message. AMF3 data messages carrying
+// AMF0 values after a 0 format byte, as sent by Flash Player, are converted so
+// players and recordings only ever see AMF0 data. Other messages are returned
+// as is.
+func amf0Data(msg *Message) *Message {
+	if msg.TypeId != TypeAMF3Data || len(msg.Payload) == 0 || msg.Payload[0] != 0 {
+		return msg
+	}
+	out := *msg
+	out.TypeId = TypeAMF0Data
+	out.Payload = msg.Payload[1:]
+	return &out
+}
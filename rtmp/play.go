@@ -0,0 +1,226 @@
+package rtmp
+
+import (
+	"sync"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// playerQueueSize is the number of messages buffered for a player before it is
+// considered too slow and frames are dropped.
+const playerQueueSize = 1024
+
+// player relays a live stream to a peer that asked for it with play.
+type player struct {
+	c        *conn
+	streamId uint32
+	ls       *liveStream
+	queue    *messageQueue
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// close stops the player. It is safe to call more than once.
+func (p *player) close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// run writes the cached messages, then the live stream, to the peer until the
+// player is stopped, the connection closes or the stream is unpublished, and
+// then frees the message stream for the next play or publish.
+func (p *player) run(cached []*Message, needKeyframe bool) {
+	defer p.c.removePlayer(p)
+	defer p.ls.unsubscribe(p.queue)
+
+	for _, m := range cached {
+		if err := p.write(m); err != nil {
+			return
+		}
+	}
+
+	synced := !needKeyframe
+	for {
+		// Leave messages queued while the peer is not acknowledging
+		queue, ack := p.queue.ch, p.c.ackWait()
+		if ack != nil {
+			queue = nil
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-p.c.ctx.Done():
+			return
+		case <-p.ls.ctx.Done():
+			p.c.writeAMF0OnStatus(p.streamId, "status", "NetStream.Play.UnpublishNotify", p.ls.key+" is now unpublished.")
+			p.c.writeStreamEOF(p.streamId)
+			return
+		case <-ack:
+		case m := <-queue:
+			if !synced {
+				if !isKeyframe(m) && !isSequenceHeader(m) && !isMetadata(m) {
+					continue
+				}
+				synced = isKeyframe(m)
+			}
+			if err := p.write(m); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends m to the peer on the player's message stream. Metadata set by
+// the publisher with @setDataFrame is sent as plain onMetaData, which is what
+// players expect.
+func (p *player) write(m *Message) error {
+	out := *stripSetDataFrame(m)
+	out.StreamId = p.streamId
+	out.ChunkStreamId = 0
+	return p.c.writeMessage(&out)
+}
+
+// play starts playing the live stream name on the message stream streamId.
+func (c *conn) play(streamId uint32, name string) error {
+	switch {
+	case !c.streams[streamId]:
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Play.Failed", "Stream was not created.")
+	case c.published[streamId] != nil:
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Play.Failed", "Stream is already in use.")
+	}
+	if err := c.authenticate(AuthPlay, c.connectParams(), name); err != nil {
+		c.log(LevelInfo, "play rejected", "app", c.app, "key", streamKey(c.app, name), "err", err)
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Play.Failed", err.Error())
+	}
+	ls, ok := c.server.streams().lookup(streamKey(c.app, name))
+	if !ok {
+		return c.writeAMF0OnStatus(streamId, "error", "NetStream.Play.StreamNotFound", name+" is not being published.")
+	}
+	c.stopPlaying(streamId)
+
+	if err := c.writeStreamBegin(streamId); err != nil {
+		return err
+	}
+	if err := c.writeAMF0OnStatus(streamId, "status", "NetStream.Play.Reset", "Playing and resetting "+name+"."); err != nil {
+		return err
+	}
+	if err := c.writeAMF0OnStatus(streamId, "status", "NetStream.Play.Start", "Started playing "+name+"."); err != nil {
+		return err
+	}
+	if err := c.writeAMF0Data(streamId, "|RtmpSampleAccess", true, true); err != nil {
+		return err
+	}
+
+	p := &player{
+		c:        c,
+		streamId: streamId,
+		ls:       ls,
+		queue:    newMessageQueue(playerQueueSize),
+		stop:     make(chan struct{}),
+	}
+	c.playingMu.Lock()
+	c.playing[streamId] = p
+	c.playingMu.Unlock()
+	c.log(LevelInfo, "play", "app", c.app, "key", ls.key, "stream", streamId)
+	cached, needKeyframe := ls.subscribe(p.queue)
+	if bufferLength, ok := c.bufferLengths[streamId]; ok {
+		cached, needKeyframe = replayFor(cached, needKeyframe, bufferLength)
+	}
+	go p.run(cached, needKeyframe)
+	return nil
+}
+
+// replayFor returns the part of the cached messages of a live stream, as
+// returned by liveStream.subscribe, to send a player buffering bufferLength
+// milliseconds, as it would otherwise play that far behind the live stream.
+// Headers are always kept. A group of pictures spanning more than the buffer
+// is left out as a whole, so the player starts at the next keyframe, while
+// audio only streams lose their oldest frames.
+func replayFor(cached []*Message, needKeyframe bool, bufferLength uint32) ([]*Message, bool) {
+	i := 0
+	for i < len(cached) && (isMetadata(cached[i]) || isSequenceHeader(cached[i])) {
+		i++
+	}
+	headers, frames := cached[:i], cached[i:]
+	if len(frames) == 0 {
+		return cached, needKeyframe
+	}
+	last := frames[len(frames)-1].Timestamp
+	if frames[0].TypeId == TypeVideo {
+		if last-frames[0].Timestamp <= bufferLength {
+			return cached, needKeyframe
+		}
+		return headers, true
+	}
+	for len(frames) > 0 && last-frames[0].Timestamp > bufferLength {
+		frames = frames[1:]
+	}
+	return append(headers[:i:i], frames...), needKeyframe
+}
+
+// stopPlaying stops the player of the message stream streamId, if any, and
+// reports whether there was one.
+func (c *conn) stopPlaying(streamId uint32) bool {
+	c.playingMu.Lock()
+	p, ok := c.playing[streamId]
+	delete(c.playing, streamId)
+	c.playingMu.Unlock()
+	if ok {
+		p.close()
+	}
+	return ok
+}
+
+// stopPlayingAll stops every player of the connection.
+func (c *conn) stopPlayingAll() {
+	c.playingMu.Lock()
+	defer c.playingMu.Unlock()
+	for streamId, p := range c.playing {
+		p.close()
+		delete(c.playing, streamId)
+	}
+}
+
+// removePlayer removes p from the players of the connection, unless another
+// player has taken its message stream since.
+func (c *conn) removePlayer(p *player) {
+	c.playingMu.Lock()
+	if c.playing[p.streamId] == p {
+		delete(c.playing, p.streamId)
+	}
+	c.playingMu.Unlock()
+}
+
+// isPlaying reports whether a player is playing on the message stream
+// streamId.
+func (c *conn) isPlaying(streamId uint32) bool {
+	c.playingMu.Lock()
+	defer c.playingMu.Unlock()
+	return c.playing[streamId] != nil
+}
+
+// playingStreams returns the message stream ids of the players of the
+// connection.
+func (c *conn) playingStreams() []uint32 {
+	c.playingMu.Lock()
+	defer c.playingMu.Unlock()
+	ids := make([]uint32, 0, len(c.playing))
+	for streamId := range c.playing {
+		ids = append(ids, streamId)
+	}
+	return ids
+}
+
+// writeAMF0Data writes an AMF0 data message made up of values to the message
+// stream streamId.
+func (c *conn) writeAMF0Data(streamId uint32, values ...interface{}) error {
+	msg := amf.AMF0Msg{}
+	for i, v := range values {
+		msg[i] = v
+	}
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(&Message{TypeId: TypeAMF0Data, StreamId: streamId, Payload: b})
+}
@@ -0,0 +1,190 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// dialPlay connects to the server at addr and plays the stream name in app
+// on a message stream of its own, returning once playing has started.
+func dialPlay(t *testing.T, addr, app, name string) *ClientConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	cc := &ClientConn{c: newConn(nc), app: app, name: name, tId: 1, cancel: func() {}, done: make(chan struct{})}
+	cc.c.ctx = context.Background()
+	cc.c.setupBuffers()
+
+	ctx := context.Background()
+	if err := cc.sendHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.call(ctx, "connect", amf.AMF0Object{"app": app, "tcUrl": "rtmp://" + addr + "/" + app}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := cc.call(ctx, "createStream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamId, _ := res[3].(float64)
+	cc.streamId = uint32(streamId)
+	if err := cc.send(cc.streamId, "play", nil, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.awaitStatus(ctx, "NetStream.Play.Start"); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// receiveMedia reads messages from cc until an audio or video message
+// arrives, applying protocol control messages on the way.
+func receiveMedia(t *testing.T, cc *ClientConn) *Message {
+	t.Helper()
+	for {
+		m, err := cc.c.receiveMessage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m.TypeId {
+		case TypeAudio, TypeVideo:
+			return m
+		case TypeSetChunkSize, TypeAbort, TypeAcknowledgement, TypeUserControl, TypeWindowAcknowledgementSize, TypeSetPeerBandwidth:
+			if err := cc.c.handleProtocolControlMessage(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPlay(t *testing.T) {
+	srv := &Server{Logger: discardLogger}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pub, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	for _, m := range []*Message{videoHeaderMsg(), keyframeMsg(0), interframeMsg(40)} {
+		if err := pub.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the stream to be cached", func() bool {
+		ls, ok := srv.streams().lookup("live/abc")
+		if !ok {
+			return false
+		}
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		return len(ls.cache.frames) == 2
+	})
+
+	player := dialPlay(t, addr, "live", "abc")
+	defer player.c.rwc.Close()
+
+	// The player starts with the cached group of pictures, then gets the
+	// live stream
+	want := []*Message{videoHeaderMsg(), keyframeMsg(0), interframeMsg(40), interframeMsg(80)}
+	for i, w := range want {
+		if i == 3 {
+			if err := pub.WriteMessage(w); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := receiveMedia(t, player)
+		if m.StreamId != player.streamId || m.Timestamp != w.Timestamp || !bytes.Equal(m.Payload, w.Payload) {
+			t.Errorf("message %d: got stream %d at %d % x, want stream %d at %d % x",
+				i, m.StreamId, m.Timestamp, m.Payload, player.streamId, w.Timestamp, w.Payload)
+		}
+	}
+
+	// Once the stream is unpublished the player ends and frees its message
+	// stream, which can then be published on
+	pub.Close()
+	if err := player.awaitStatus(context.Background(), "NetStream.Play.UnpublishNotify"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the player to end", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		for c := range srv.activeConn {
+			if len(c.playingStreams()) != 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if err := player.send(player.streamId, "publish", nil, "xyz", "live"); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.awaitStatus(context.Background(), "NetStream.Publish.Start"); err != nil {
+		t.Errorf("publish on the freed stream: %v", err)
+	}
+}
+
+func TestPlayNotPublished(t *testing.T) {
+	srv := &Server{Logger: discardLogger}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	cc := &ClientConn{c: newConn(nc), tId: 1}
+	cc.c.ctx = context.Background()
+	cc.c.setupBuffers()
+	ctx := context.Background()
+	if err := cc.sendHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.call(ctx, "connect", amf.AMF0Object{"app": "live"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.send(1, "play", nil, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	err = cc.awaitStatus(ctx, "NetStream.Play.Start")
+	if status, ok := err.(*StatusError); !ok || status.Code != "NetStream.Play.Failed" {
+		t.Errorf("play before createStream: %v", err)
+	}
+	res, err := cc.call(ctx, "createStream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamId, _ := res[3].(float64)
+	if err := cc.send(uint32(streamId), "play", nil, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	err = cc.awaitStatus(ctx, "NetStream.Play.Start")
+	if status, ok := err.(*StatusError); !ok || status.Code != "NetStream.Play.StreamNotFound" {
+		t.Errorf("play of a stream not published: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/flv"
+)
+
+const (
+	// DefaultRecordPath is the file name template used when RecordConfig.Path
+	// is empty.
+	DefaultRecordPath = `{{.App}}/{{.Stream}}-{{.Start.Format "20060102-150405"}}.flv`
+
+	// recordQueueSize is the number of messages buffered for a recording
+	// while it waits on the disk.
+	recordQueueSize = 4096
+)
+
+// A RecordConfig configures the archiving of published streams to FLV
+// files. Every file starts with the stream metadata, the sequence headers and
+// a keyframe, and has its timestamps start at 0.
+type RecordConfig struct {
+	// Path is a text/template for the name of each recording file, executed
+	// with a RecordFile. Directories are created as needed. DefaultRecordPath
+	// is used if empty.
+	Path string
+
+	// MaxSize and MaxDuration, when non-zero, start a new file once the
+	// current one has grown past either. The new file starts at the next
+	// keyframe, or the next audio frame for streams without video.
+	MaxSize     int64
+	MaxDuration time.Duration
+}
+
+// RecordFile describes a recording file. RecordConfig.Path is executed with
+// it to name the file. Streams whose App or Stream holds a path separator,
+// ".." or NUL are not recorded, as publishers choose them.
+type RecordFile struct {
+	App    string
+	Stream string // stream name without query string
+	Start  time.Time
+}
+
+// startRecording starts recording ls if srv.Record is set. The recording
+// stops when ls is unpublished.
+func (srv *Server) startRecording(ls *liveStream) {
+	if srv.Record == nil {
+		return
+	}
+	path := srv.Record.Path
+	if path == "" {
+		path = DefaultRecordPath
+	}
+	tmpl, err := template.New("record").Parse(path)
+	if err != nil {
+		srv.logger().Log(LevelError, "record path invalid", "key", ls.key, "err", err)
+		return
+	}
+	if err := checkRecordName(ls.app); err != nil {
+		srv.logger().Log(LevelWarn, "not recording", "key", ls.key, "err", err)
+		return
+	}
+	if err := checkRecordName(ls.name); err != nil {
+		srv.logger().Log(LevelWarn, "not recording", "key", ls.key, "err", err)
+		return
+	}
+	r := &recorder{
+		cfg:   *srv.Record,
+		tmpl:  tmpl,
+		root:  recordRoot(path),
+		ls:    ls,
+		queue: newMessageQueue(recordQueueSize),
+		log:   srv.logger(),
+	}
+	cached, needKeyframe := ls.subscribe(r.queue)
+	srv.streamWork.Add(1)
+	go func() {
+		defer srv.streamWork.Done()
+		r.run(cached, needKeyframe)
+	}()
+}
+
+// recorder writes a live stream to a series of FLV files.
+type recorder struct {
+	cfg   RecordConfig
+	tmpl  *template.Template
+	root  string // directory every file must be in, see recordRoot
+	ls    *liveStream
+	queue *messageQueue
+	log   Logger
+
+	// The file being written, nil between files
+	f    *os.File
+	bufw *bufio.Writer
+	fw   *flv.Writer
+	size int64
+	base uint32 // timestamp of the first frame in the file
+
+	// The latest headers of the stream, written at the start of every file
+	hasAudio    bool
+	hasVideo    bool
+	metadata    *Message
+	audioHeader *Message
+	videoHeader *Message
+}
+
+// run records the cached messages and then the live stream until it is
+// unpublished or writing fails.
+func (r *recorder) run(cached []*Message, needKeyframe bool) {
+	defer r.ls.unsubscribe(r.queue)
+	defer r.closeFile()
+
+	for _, m := range cached {
+		if err := r.write(m); err != nil {
+			r.log.Log(LevelWarn, "recording failed", "key", r.ls.key, "err", err)
+			return
+		}
+	}
+
+	synced := !needKeyframe
+	for {
+		var m *Message
+		select {
+		case m = <-r.queue.ch:
+		case <-r.ls.ctx.Done():
+			// Record whatever is still queued before finishing the file
+			for {
+				select {
+				case m := <-r.queue.ch:
+					if err := r.write(m); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+		if !synced {
+			if !isKeyframe(m) && !isSequenceHeader(m) && !isMetadata(m) {
+				continue
+			}
+			synced = isKeyframe(m)
+		}
+		if err := r.write(m); err != nil {
+			r.log.Log(LevelWarn, "recording failed", "key", r.ls.key, "err", err)
+			return
+		}
+	}
+}
+
+// write records m, opening and rotating files as needed.
+func (r *recorder) write(m *Message) error {
+	switch {
+	case isMetadata(m):
+		r.metadata = stripSetDataFrame(m)
+		return r.writeTag(r.metadata)
+	case isSequenceHeader(m) && m.TypeId == TypeAudio:
+		r.audioHeader = m
+		r.hasAudio = true
+		return r.writeTag(m)
+	case isSequenceHeader(m) && m.TypeId == TypeVideo:
+		r.videoHeader = m
+		r.hasVideo = true
+		return r.writeTag(m)
+	case m.TypeId == TypeAudio:
+		r.hasAudio = true
+	case m.TypeId == TypeVideo:
+		r.hasVideo = true
+	default:
+		return nil
+	}
+
+	// Files only start, and so rotate, where decoding can start
+	startable := isKeyframe(m) || (!r.hasVideo && m.TypeId == TypeAudio)
+	if r.fw != nil && startable && r.full(m) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.fw == nil {
+		if !startable {
+			return nil
+		}
+		if err := r.openFile(m.Timestamp); err != nil {
+			return err
+		}
+	}
+	if err := r.writeTag(m); err != nil {
+		return err
+	}
+	if isKeyframe(m) {
+		return r.bufw.Flush()
+	}
+	return nil
+}
+
+// full reports whether the current file has reached its maximum size or
+// duration at message m.
+func (r *recorder) full(m *Message) bool {
+	if r.cfg.MaxSize > 0 && r.size >= r.cfg.MaxSize {
+		return true
+	}
+	return r.cfg.MaxDuration > 0 && time.Duration(r.relativeTimestamp(m))*time.Millisecond >= r.cfg.MaxDuration
+}
+
+// relativeTimestamp returns the timestamp of m in the current file.
+// Messages from before the first frame of the file, such as headers, are at
+// 0.
+func (r *recorder) relativeTimestamp(m *Message) uint32 {
+	ts := m.Timestamp - r.base
+	if int32(ts) < 0 {
+		return 0
+	}
+	return ts
+}
+
+// writeTag writes m as a tag to the current file, if there is one.
+func (r *recorder) writeTag(m *Message) error {
+	if r.fw == nil {
+		return nil
+	}
+	if err := r.fw.WriteTag(uint8(m.TypeId), r.relativeTimestamp(m), m.Payload); err != nil {
+		return err
+	}
+	r.size += int64(15 + len(m.Payload)) // tag header and trailer
+	return nil
+}
+
+// openFile starts a new file whose timestamps start at base and writes the
+// FLV header, metadata and sequence headers to it.
+func (r *recorder) openFile(base uint32) error {
+	var name bytes.Buffer
+	err := r.tmpl.Execute(&name, RecordFile{
+		App:    r.ls.app,
+		Stream: r.ls.name,
+		Start:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("rtmp: record file name: %s", err.Error())
+	}
+	path := filepath.Clean(name.String())
+	if rel, err := filepath.Rel(r.root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("rtmp: record file %s is outside of %s", path, r.root)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("rtmp: record: %s", err.Error())
+		}
+	}
+	f, err := createUnique(path)
+	if err != nil {
+		return fmt.Errorf("rtmp: record: %s", err.Error())
+	}
+
+	r.log.Log(LevelInfo, "recording", "key", r.ls.key, "file", f.Name())
+	r.f = f
+	r.bufw = bufio.NewWriter(f)
+	r.fw = flv.NewWriter(r.bufw)
+	r.size = 0
+	r.base = base
+
+	var flags uint8
+	if r.hasAudio {
+		flags |= flv.FlagAudio
+	}
+	if r.hasVideo {
+		flags |= flv.FlagVideo
+	}
+	if err := r.fw.WriteHeader(flags); err != nil {
+		return err
+	}
+	for _, m := range []*Message{r.metadata, r.videoHeader, r.audioHeader} {
+		if m == nil {
+			continue
+		}
+		if err := r.writeTag(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFile flushes and closes the current file, if there is one.
+func (r *recorder) closeFile() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.bufw.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.bufw, r.fw = nil, nil, nil
+	return err
+}
+
+// checkRecordName checks the app or stream name s is safe to name recording
+// files with, holding nothing that could lead outside the directory of the
+// path template.
+func checkRecordName(s string) error {
+	if s == "" || strings.ContainsAny(s, "/\\\x00") || strings.Contains(s, "..") {
+		return fmt.Errorf("rtmp: record: unsafe name %q", s)
+	}
+	return nil
+}
+
+// recordRoot returns the directory of the static start of the path template
+// tmpl, up to its first action, which recording files must stay under.
+func recordRoot(tmpl string) string {
+	if i := strings.Index(tmpl, "{{"); i >= 0 {
+		tmpl = tmpl[:i]
+	}
+	return filepath.Dir(tmpl + "x")
+}
+
+// createUnique creates the file name, adding a numeric suffix before the
+// extension when a file of that name already exists, so a recording never
+// overwrites an earlier one.
+func createUnique(name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) || i > 100 {
+			return f, err
+		}
+		name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
@@ -0,0 +1,203 @@
+package rtmp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/flv"
+)
+
+// discardLogger logs nothing, for tests which provoke warnings.
+var discardLogger = LoggerFunc(func(Level, string, ...interface{}) {})
+
+// Media messages as a publisher sends them.
+func metadataMsg() *Message {
+	payload := append(append([]byte(nil), setDataFrame...), onMetaData...)
+	return &Message{TypeId: TypeAMF0Data, Payload: append(payload, 0x05)} // null
+}
+
+func videoHeaderMsg() *Message {
+	return &Message{TypeId: TypeVideo, Payload: []byte{0x17, 0x00, 0, 0, 0}}
+}
+
+func audioHeaderMsg() *Message {
+	return &Message{TypeId: TypeAudio, Payload: []byte{0xAF, 0x00, 0x12, 0x10}}
+}
+
+func keyframeMsg(ts uint32) *Message {
+	return &Message{Timestamp: ts, TypeId: TypeVideo, Payload: []byte{0x17, 0x01, 0, 0, 0}}
+}
+
+func interframeMsg(ts uint32) *Message {
+	return &Message{Timestamp: ts, TypeId: TypeVideo, Payload: []byte{0x27, 0x01, 0, 0, 0}}
+}
+
+func audioMsg(ts uint32) *Message {
+	return &Message{Timestamp: ts, TypeId: TypeAudio, Payload: []byte{0xAF, 0x01, 0x21}}
+}
+
+// readFLV returns the types and timestamps of the tags of the FLV file path.
+func readFLV(t *testing.T, path string) (types []uint8, timestamps []uint32) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := flv.NewReader(f)
+	if _, err := r.ReadHeader(); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	for {
+		typ, ts, _, err := r.ReadTag()
+		if err == io.EOF {
+			return types, timestamps
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		types = append(types, typ)
+		timestamps = append(timestamps, ts)
+	}
+}
+
+func TestCheckRecordName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"abc", true},
+		{"abc.def", true},
+		{"", false},
+		{"..", false},
+		{"../abc", false},
+		{"abc/..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a\x00b", false},
+	}
+	for _, tt := range tests {
+		if err := checkRecordName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkRecordName(%q) = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRecordRoot(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{DefaultRecordPath, "."},
+		{"/var/rec/{{.App}}/{{.Stream}}.flv", "/var/rec"},
+		{"/var/rec/live-{{.Stream}}.flv", "/var/rec"},
+		{"/var/rec/", "/var/rec"},
+		{"rec.flv", "."},
+	}
+	for _, tt := range tests {
+		if got := recordRoot(tt.tmpl); got != tt.want {
+			t.Errorf("recordRoot(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestRecordUnsafeName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := &Server{
+		Record: &RecordConfig{Path: filepath.Join(dir, "rec", "{{.App}}", "{{.Stream}}.flv")},
+		Logger: discardLogger,
+	}
+	hub := newStreamHub(0, 0)
+	for _, name := range []string{"../abc", "..", "../../etc/abc", `..\abc`} {
+		ls, err := hub.publish("live", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.startRecording(ls)
+		if len(ls.subs) != 0 {
+			t.Errorf("%q recorded", name)
+		}
+		hub.unpublish(ls)
+	}
+	srv.streamWork.Wait()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("files created: %v", files)
+	}
+
+	// Templates leading out of their own directory are caught when the file
+	// is named
+	path := dir + "/rec/{{.App}}/../../../{{.Stream}}.flv"
+	ls, _ := hub.publish("live", "abc")
+	defer hub.unpublish(ls)
+	r := &recorder{tmpl: template.Must(template.New("record").Parse(path)), root: recordRoot(path), ls: ls, log: discardLogger}
+	if err := r.openFile(0); err == nil {
+		r.closeFile()
+		t.Error("file outside of the template directory opened")
+	}
+}
+
+func TestRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "{{.App}}", "{{.Stream}}.flv")
+	hub := newStreamHub(0, 0)
+	ls, _ := hub.publish("live", "abc")
+	defer hub.unpublish(ls)
+	r := &recorder{
+		cfg:  RecordConfig{Path: path, MaxDuration: time.Second},
+		tmpl: template.Must(template.New("record").Parse(path)),
+		root: recordRoot(path),
+		ls:   ls,
+		log:  discardLogger,
+	}
+	for _, m := range []*Message{
+		metadataMsg(),
+		videoHeaderMsg(),
+		audioHeaderMsg(),
+		audioMsg(990),     // before the first keyframe, dropped
+		keyframeMsg(1000), // opens abc.flv
+		interframeMsg(1040),
+		audioMsg(1050),
+		interframeMsg(2040), // full, but cannot start a file
+		keyframeMsg(2080),   // opens abc-1.flv
+		interframeMsg(2120),
+	} {
+		if err := r.write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, video, audio := uint8(flv.TagScriptData), uint8(flv.TagVideo), uint8(flv.TagAudio)
+	tests := []struct {
+		name       string
+		types      []uint8
+		timestamps []uint32
+	}{
+		{"abc.flv", []uint8{data, video, audio, video, video, audio, video}, []uint32{0, 0, 0, 0, 40, 50, 1040}},
+		{"abc-1.flv", []uint8{data, video, audio, video, video}, []uint32{0, 0, 0, 0, 40}},
+	}
+	for _, tt := range tests {
+		types, timestamps := readFLV(t, filepath.Join(dir, "live", tt.name))
+		if !reflect.DeepEqual(types, tt.types) || !reflect.DeepEqual(timestamps, tt.timestamps) {
+			t.Errorf("%s: tags %v at %v, want %v at %v", tt.name, types, timestamps, tt.types, tt.timestamps)
+		}
+	}
+}
@@ -14,7 +14,8 @@ type contextKey struct {
 // time.Nanosecond should be 1, making this a trivial function so long as
 // the uint32 cast is done after converting a int64 to milliseconds, however
 // it is advised to multiply by the constant in the event that golang increases
-// time resolution.
+// time resolution. RTMP timestamps are 32 bit and wrap around, so the
+// conversion simply truncates.
 func getUint32MilsTimestamp() uint32 {
-	return uint32(((time.Now().UnixNano() * int64(time.Nanosecond)) / int64(time.Millisecond)) % int64(^uint32(0)))
+	return uint32((time.Now().UnixNano() * int64(time.Nanosecond)) / int64(time.Millisecond))
 }
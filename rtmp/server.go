@@ -2,7 +2,11 @@ package rtmp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,22 +43,166 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
+const (
+	// DefaultHandshakeTimeout is the Server.HandshakeTimeout used when it is 0.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// DefaultReadTimeout is the Server.ReadTimeout used when it is 0.
+	DefaultReadTimeout = 2 * time.Minute
+
+	// DefaultWriteTimeout is the Server.WriteTimeout used when it is 0.
+	DefaultWriteTimeout = 30 * time.Second
+
+	// DefaultPublishTimeout is the Server.PublishTimeout used when it is 0.
+	DefaultPublishTimeout = 30 * time.Second
+)
+
 type Server struct {
-	Addr    string
-	Handler Handler
+	Addr    string  // TCP address to listen on, ":1935" if empty
+	Handler Handler // handler to invoke for every message, may be nil
+
+	// Timeouts of connections. Unlike those of net/http, zero values do not
+	// disable them but use the defaults, so that a Server is protected
+	// from stalled peers without configuration; negative values disable
+	// them.
+
+	// HandshakeTimeout bounds the handshake, including that of TLS. If
+	// zero, DefaultHandshakeTimeout is used; if negative, there is none.
+	HandshakeTimeout time.Duration
 
-	ReadTimeout  time.Duration
+	// ReadTimeout is how long a connection may go without receiving
+	// anything once the handshake is done; peers are pinged at least every
+	// half of it, so idle players answering pings are kept. If zero,
+	// DefaultReadTimeout is used; if negative, there is none.
+	ReadTimeout time.Duration
+
+	// WriteTimeout bounds every write of a message, to peers and to tee
+	// outputs. If zero, DefaultWriteTimeout is used; if negative, there is
+	// none.
 	WriteTimeout time.Duration
+
+	// PublishTimeout is how long a publisher may go without sending audio,
+	// video or data before its connection is closed, releasing the stream.
+	// If zero, DefaultPublishTimeout is used; if negative, there is none.
+	PublishTimeout time.Duration
+
+	// TLSConfig optionally provides a TLS configuration for use by ServeTLS
+	// and ListenAndServeTLS. It is cloned, so modifying it after they are
+	// called has no effect. Certificates may be selected by server name with
+	// its Certificates or GetCertificate, e.g. that of a CertificateReloader.
+	TLSConfig *tls.Config
+
+	// GOPCacheMaxBytes and GOPCacheMaxDuration bound the media cached per
+	// published stream so new subscribers can start on a keyframe. Zero
+	// values use DefaultGOPCacheMaxBytes and DefaultGOPCacheMaxDuration.
+	GOPCacheMaxBytes    int
+	GOPCacheMaxDuration time.Duration
+
+	// Tee maps stream keys of the form "app/stream" to the outputs a stream
+	// is relayed to while it is being published.
+	Tee map[string][]TeeOutput
+
+	// Record, if non-nil, archives every published stream to FLV files.
+	Record *RecordConfig
+
+	// Authenticator, if non-nil, decides whether peers may connect, publish
+	// and play. Streams published with PublishFile are not authenticated.
+	Authenticator Authenticator
+
+	// Logger, if non-nil, records connections, streams and failures. If nil,
+	// entries at LevelInfo and above go to the standard logger.
+	Logger Logger
+
+	// ConnState, if non-nil, is called when a connection changes state.
+	// See the ConnState type for the states.
+	ConnState func(net.Conn, ConnState)
+
+	inShutdown int32 // accessed atomically, set once shutting down
+
+	mu         sync.Mutex
+	hub        *streamHub
+	listeners  map[*net.Listener]struct{}
+	activeConn map[*conn]struct{}
+	nextConnId uint64
+
+	// streamWork counts the recorders and tee outputs still running, which
+	// Shutdown waits for
+	streamWork sync.WaitGroup
+}
+
+// ErrServerClosed is returned by the Server's Serve, ServeTLS,
+// ListenAndServe and ListenAndServeTLS methods after a call to Shutdown or
+// Close.
+var ErrServerClosed = errors.New("rtmp: Server closed")
+
+// A ConnState represents the state of a connection to a server. It is used by
+// the optional Server.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew is a connection just accepted, which has yet to complete
+	// the handshake.
+	StateNew ConnState = iota
+
+	// StateActive is a connection which completed the handshake and
+	// exchanges messages.
+	StateActive
+
+	// StateClosed is a closed connection. It is terminal.
+	StateClosed
+)
+
+var stateName = map[ConnState]string{
+	StateNew:    "new",
+	StateActive: "active",
+	StateClosed: "closed",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
 }
 
+// A Handler responds to RTMP messages.
+//
+// ServeRTMP is called with every message received on a connection, in the
+// order they arrive, after the server has applied any protocol control or
+// command handling of its own. It is called from the connection's read loop,
+// so a handler that blocks stops the connection from reading. Handlers may
+// retain m after returning.
 type Handler interface {
-	ServeRTMP()
+	ServeRTMP(w ResponseWriter, m *Message)
 }
 
-type HandlerFunc func()
+// The HandlerFunc type is an adapter to allow the use of ordinary functions
+// as RTMP handlers.
+type HandlerFunc func(ResponseWriter, *Message)
 
-func (f HandlerFunc) ServeRTMP() {
-	f()
+// ServeRTMP calls f(w, m).
+func (f HandlerFunc) ServeRTMP(w ResponseWriter, m *Message) {
+	f(w, m)
+}
+
+// A ResponseWriter is used by a Handler to talk back to the peer of the
+// connection a message arrived on.
+type ResponseWriter interface {
+	// WriteMessage sends m to the peer. It is safe to call from multiple
+	// goroutines and may be called after ServeRTMP has returned.
+	WriteMessage(m *Message) error
+
+	// Context returns the context of the connection. It is canceled when the
+	// connection is closed.
+	Context() context.Context
+
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+
+	// ConnectParams returns the parameters the peer connected with, or nil
+	// if it has not sent connect yet. They must not be modified.
+	ConnectParams() *ConnectParams
+
+	// RTT returns the round trip time to the peer last measured with a
+	// ping, or 0 until the peer first answers one.
+	RTT() time.Duration
 }
 
 func ListenAndServe(addr string, handler Handler) error {
@@ -76,18 +224,68 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
 }
 
+func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler) error {
+	server := &Server{Addr: addr, Handler: handler}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeTLS is like ListenAndServe but serves RTMPS, RTMP over TLS,
+// on srv.Addr, ":443" if empty, as RTMPS services commonly use the HTTPS
+// port. See ServeTLS for certFile and keyFile.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config))
+}
+
+// ServeTLS accepts connections on l and serves RTMPS on them. certFile and
+// keyFile name the PEM encoded certificate, followed by any intermediate
+// certificates, and its private key. They are read again when they change,
+// and may be empty if srv.TLSConfig provides certificates. If both are set,
+// a certificate of srv.TLSConfig is only served to clients asking for a
+// server name it is valid for.
+//
+// If l is a *net.TCPListener, accepted connections have TCP keep-alives
+// enabled, as with ListenAndServeTLS.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := srv.tlsConfig(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		l = tcpKeepAliveListener{tl}
+	}
+	return srv.Serve(tls.NewListener(l, config))
+}
+
 var testHookServerServe func(*Server, net.Listener) // used if non-nil
 
+// Serve accepts connections on l, serving each with a new goroutine, until
+// l fails or the server is shut down. Serve always closes l and returns a
+// non-nil error, ErrServerClosed after Shutdown or Close.
 func (srv *Server) Serve(l net.Listener) error {
-	defer func() {
-		err := l.Close()
-		if err != nil {
-			panic(err)
-		}
-	}()
+	defer l.Close()
 	if fn := testHookServerServe; fn != nil {
 		fn(srv, l)
 	}
+	if !srv.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(&l, false)
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	baseCtx := context.Background()
@@ -106,23 +304,174 @@ func (srv *Server) Serve(l net.Listener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				// FIXME: log
+				srv.logger().Log(LevelWarn, "accept failed", "err", e, "retry", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return e
 		}
 		tempDelay = 0
 		c := srv.newConn(rw)
-		//c.setState(c.rwc, StateNew) // before Serve can return
+		c.setState(StateNew) // before Serve can return
 		go c.serve(ctx)
 	}
 }
 
 func (srv *Server) newConn(rwc net.Conn) *conn {
-	c := &conn{
-		server: srv,
-		rwc:    rwc,
-	}
+	c := newConn(rwc)
+	c.server = srv
+	srv.mu.Lock()
+	srv.nextConnId++
+	c.id = srv.nextConnId
+	srv.mu.Unlock()
+	c.handshakeTimeout = timeout(srv.HandshakeTimeout, DefaultHandshakeTimeout)
+	c.readTimeout = timeout(srv.ReadTimeout, DefaultReadTimeout)
+	c.writeTimeout = timeout(srv.WriteTimeout, DefaultWriteTimeout)
+	c.publishTimeout = timeout(srv.PublishTimeout, DefaultPublishTimeout)
 	return c
 }
+
+// shutdownPollInterval is how often Shutdown checks whether connections
+// have closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server. It closes all listeners, then
+// asks every connection to close: publishers are sent
+// NetStream.Unpublish.Success for their streams and players
+// NetStream.Play.Stop, then every peer NetConnection.Connect.Closed, and the
+// connection is closed. Shutdown waits for all connections to close, and
+// then for the recordings and tee outputs of their streams to be flushed and
+// closed, or for ctx to be done, returning ctx's error in that case, after
+// which Close may be called to close the remaining connections.
+//
+// Streams published with PublishFile are left to their contexts, which should
+// be canceled first for Shutdown to return before ctx is done.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	err := srv.closeListenersLocked()
+	for c := range srv.activeConn {
+		c.shutdown()
+	}
+	srv.mu.Unlock()
+
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
+	for {
+		srv.mu.Lock()
+		n := len(srv.activeConn)
+		srv.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.streamWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and connections, without telling
+// peers. It returns the error of closing the listeners, if any.
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.closeListenersLocked()
+	for c := range srv.activeConn {
+		c.rwc.Close()
+	}
+	return err
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// trackListener adds or removes l from the listeners closed on shutdown. It
+// reports false when adding l to a server shutting down.
+func (srv *Server) trackListener(l *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+// closeListenersLocked closes all listeners. srv.mu must be held.
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for l := range srv.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// trackConn adds or removes c from the connections Shutdown waits for. A
+// connection added while shutting down is asked to close right away.
+func (srv *Server) trackConn(c *conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.activeConn == nil {
+		srv.activeConn = make(map[*conn]struct{})
+	}
+	if add {
+		srv.activeConn[c] = struct{}{}
+		if srv.shuttingDown() {
+			c.shutdown()
+		}
+	} else {
+		delete(srv.activeConn, c)
+	}
+}
+
+// timeout returns the timeout configured as d, def if d is 0, and 0 for none
+// if d is negative.
+func timeout(d, def time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0:
+		return def
+	}
+	return d
+}
+
+// streams returns the hub of streams being published on srv.
+func (srv *Server) streams() *streamHub {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.hub == nil {
+		srv.hub = newStreamHub(srv.GOPCacheMaxBytes, srv.GOPCacheMaxDuration)
+	}
+	return srv.hub
+}
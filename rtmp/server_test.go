@@ -0,0 +1,321 @@
+package rtmp
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+func TestServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name string
+		in   time.Duration
+		want [4]time.Duration
+	}{
+		{"zero uses the defaults", 0, [4]time.Duration{DefaultHandshakeTimeout, DefaultReadTimeout, DefaultWriteTimeout, DefaultPublishTimeout}},
+		{"negative disables", -1, [4]time.Duration{}},
+		{"positive", time.Second, [4]time.Duration{time.Second, time.Second, time.Second, time.Second}},
+	}
+	for _, tt := range tests {
+		srv := &Server{HandshakeTimeout: tt.in, ReadTimeout: tt.in, WriteTimeout: tt.in, PublishTimeout: tt.in}
+		c := srv.newConn(nil)
+		got := [4]time.Duration{c.handshakeTimeout, c.readTimeout, c.writeTimeout, c.publishTimeout}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wantClosed bool
+	}{
+		{"short", 50 * time.Millisecond, true},
+		{"none", -1, false},
+	}
+	for _, tt := range tests {
+		srv := &Server{HandshakeTimeout: tt.timeout, Logger: discardLogger}
+		addr := serve(t, srv)
+		nc, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A peer which never sends C0 is dropped once the timeout passes
+		wait := 300 * time.Millisecond
+		if tt.wantClosed {
+			wait = 5 * time.Second
+		}
+		nc.SetReadDeadline(time.Now().Add(wait))
+		_, err = nc.Read(make([]byte, 1))
+		ne, timedOut := err.(net.Error)
+		if closed := !(timedOut && ne.Timeout()); closed != tt.wantClosed {
+			t.Errorf("%s: read from an idle connection: %v", tt.name, err)
+		}
+		nc.Close()
+		srv.Close()
+	}
+}
+
+func TestPublishTimeout(t *testing.T) {
+	srv := &Server{PublishTimeout: 200 * time.Millisecond, Logger: discardLogger}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// Media keeps the publisher alive past the timeout
+	for ts := uint32(0); ts < 400; ts += 40 {
+		if err := cc.WriteMessage(interframeMsg(ts)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	select {
+	case <-cc.Done():
+		t.Fatalf("publisher sending media closed: %v", cc.Err())
+	default:
+	}
+
+	// Going silent gets it closed and the stream released
+	select {
+	case <-cc.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent publisher not closed")
+	}
+	waitFor(t, "the stream to be unpublished", func() bool {
+		_, ok := srv.streams().lookup("live/abc")
+		return !ok
+	})
+}
+
+func TestPublishTimeoutDisabled(t *testing.T) {
+	// Pings keep the connection within the read timeout
+	srv := &Server{PublishTimeout: -1, ReadTimeout: 100 * time.Millisecond, Logger: discardLogger}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	select {
+	case <-cc.Done():
+		t.Fatalf("silent publisher closed: %v", cc.Err())
+	case <-time.After(400 * time.Millisecond):
+	}
+	if _, ok := srv.streams().lookup("live/abc"); !ok {
+		t.Error("stream unpublished")
+	}
+}
+
+// connStates records the states a server's connections go through.
+type connStates struct {
+	mu     sync.Mutex
+	states map[net.Conn][]ConnState
+}
+
+func (cs *connStates) hook(nc net.Conn, state ConnState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.states == nil {
+		cs.states = make(map[net.Conn][]ConnState)
+	}
+	cs.states[nc] = append(cs.states[nc], state)
+}
+
+// closed returns the states of the connections which have closed.
+func (cs *connStates) closed() [][]ConnState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var closed [][]ConnState
+	for _, s := range cs.states {
+		if s[len(s)-1] == StateClosed {
+			closed = append(closed, append([]ConnState(nil), s...))
+		}
+	}
+	return closed
+}
+
+func TestConnState(t *testing.T) {
+	var cs connStates
+	srv := &Server{ConnState: cs.hook, Logger: discardLogger}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	tests := []struct {
+		name string
+		dial func()
+		want []ConnState
+	}{
+		{
+			"handshake failed",
+			func() {
+				nc, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nc.Write([]byte{0xFF}) // not RTMP
+				nc.Close()
+			},
+			[]ConnState{StateNew, StateClosed},
+		},
+		{
+			"published",
+			func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				cc, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cc.Close()
+			},
+			[]ConnState{StateNew, StateActive, StateClosed},
+		},
+	}
+	for _, tt := range tests {
+		cs.mu.Lock()
+		cs.states = nil
+		cs.mu.Unlock()
+		tt.dial()
+		waitFor(t, tt.name+" connection to close", func() bool { return len(cs.closed()) == 1 })
+		if got := cs.closed()[0]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: went through %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var cs connStates
+	srv := &Server{ConnState: cs.hook, Logger: discardLogger}
+	defer srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	addr := ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pub, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.WriteMessage(keyframeMsg(0)); err != nil {
+		t.Fatal(err)
+	}
+	player := dialPlay(t, addr, "live", "abc")
+	defer player.c.rwc.Close()
+
+	// Stands in for a recorder or tee output still flushing
+	srv.streamWork.Add(1)
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	// Peers are told why they are closed
+	if err := player.awaitStatus(ctx, "NetStream.Play.Stop"); err != nil {
+		t.Fatalf("player: %v", err)
+	}
+	if err := player.awaitStatus(ctx, "NetConnection.Connect.Closed"); err != nil {
+		t.Fatalf("player: %v", err)
+	}
+	select {
+	case <-pub.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher not closed")
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve: %v", err)
+	}
+	waitFor(t, "connections to close", func() bool { return len(cs.closed()) == 2 })
+
+	// Shutdown waits for the stream work once connections are closed
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before stream work was done: %v", err)
+	case <-time.After(2 * shutdownPollInterval):
+	}
+	srv.streamWork.Done()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+
+	// New connections are refused
+	if nc, err := net.Dial("tcp", addr); err == nil {
+		nc.Close()
+		t.Error("connection accepted after Shutdown")
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	// A handler which does not return keeps its connection open
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, m *Message) { <-release }),
+		Logger:  discardLogger,
+	}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	cc := &ClientConn{c: newConn(nc), tId: 1}
+	cc.c.ctx = context.Background()
+	cc.c.setupBuffers()
+	if err := cc.sendHandshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.call(context.Background(), "connect", amf.AMF0Object{"app": "live"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with a connection open: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Once the connection is closed, the stream work is waited for
+	close(release)
+	waitFor(t, "the connection to close", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.activeConn) == 0
+	})
+	srv.streamWork.Add(1)
+	defer srv.streamWork.Done()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := srv.Shutdown(ctx); err != context.Canceled {
+		t.Errorf("Shutdown with stream work pending: %v, want %v", err, context.Canceled)
+	}
+}
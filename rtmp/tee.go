@@ -0,0 +1,172 @@
+package rtmp
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultTeeQueueSize is the number of messages buffered for a tee
+	// output when TeeOutput.QueueSize is 0.
+	DefaultTeeQueueSize = 1024
+
+	// DefaultTeeReconnectDelay is how long a tee output waits before
+	// reconnecting when TeeOutput.ReconnectDelay is 0.
+	DefaultTeeReconnectDelay = 5 * time.Second
+)
+
+// A TeeOutput is a downstream RTMP endpoint a published stream is relayed to.
+//
+// Every output has its own connection, reconnect loop and bounded queue, so a
+// slow or unreachable output never stalls the publisher or the other outputs
+// of the same stream. When an output falls behind and its queue fills up,
+// messages are dropped until the next video keyframe. Every connection to an
+// output starts with the stream's cached metadata, sequence headers and
+// current group of pictures.
+type TeeOutput struct {
+	// URL to publish to, e.g. rtmp://a.rtmp.youtube.com/live2/<stream key>.
+	// The last path element is the stream name and the rest the app.
+	// rtmps URLs, such as those of Facebook Live, are published over TLS.
+	URL string
+
+	// QueueSize is the number of messages buffered for the output.
+	QueueSize int
+
+	// ReconnectDelay is how long to wait before reconnecting after the
+	// connection to the output fails.
+	ReconnectDelay time.Duration
+}
+
+// teeCloseGrace is how long a tee output may take to close its connection
+// after the stream is unpublished before the connection is aborted.
+const teeCloseGrace = time.Second
+
+// startTee starts relaying ls to every output configured for it in srv.Tee.
+// The outputs stop when ls is unpublished.
+func (srv *Server) startTee(ls *liveStream) {
+	for _, out := range srv.Tee[ls.key] {
+		o := newTeeOutput(out, ls, srv.logger())
+		o.writeTimeout = timeout(srv.WriteTimeout, DefaultWriteTimeout)
+		srv.streamWork.Add(1)
+		go func() {
+			defer srv.streamWork.Done()
+			o.run(ls.ctx)
+		}()
+	}
+}
+
+// teeOutput relays the messages of a live stream to a TeeOutput.
+type teeOutput struct {
+	out TeeOutput
+	ls  *liveStream
+	log Logger
+
+	// writeTimeout bounds every write to the output, 0 for none
+	writeTimeout time.Duration
+}
+
+func newTeeOutput(out TeeOutput, ls *liveStream, log Logger) *teeOutput {
+	if out.QueueSize <= 0 {
+		out.QueueSize = DefaultTeeQueueSize
+	}
+	if out.ReconnectDelay <= 0 {
+		out.ReconnectDelay = DefaultTeeReconnectDelay
+	}
+	return &teeOutput{
+		out: out,
+		ls:  ls,
+		log: log,
+	}
+}
+
+// run connects to the output and relays the stream until ctx is canceled,
+// reconnecting whenever the connection fails.
+func (o *teeOutput) run(ctx context.Context) {
+	for {
+		if err := o.relay(ctx); err != nil && ctx.Err() == nil {
+			o.log.Log(LevelWarn, "tee output failed", "key", o.ls.key, "host", o.host(), "err", err, "retry", o.out.ReconnectDelay)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(o.out.ReconnectDelay):
+		}
+	}
+}
+
+// relay makes a single connection to the output and relays the stream to it
+// until either the connection fails or ctx is canceled. The stream is only
+// subscribed to while connected, and every connection starts with the GOP
+// cache of the stream so the output can decode from the first frame.
+func (o *teeOutput) relay(ctx context.Context) error {
+	cc, err := Dial(ctx, o.out.URL)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	cc.SetWriteTimeout(o.writeTimeout)
+	o.log.Log(LevelInfo, "tee output connected", "key", o.ls.key, "host", o.host())
+
+	// Once ctx is canceled, give the relay a moment to close the connection
+	// properly, then abort it in case a write to a stalled output blocks
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		select {
+		case <-time.After(teeCloseGrace):
+			cc.c.rwc.Close()
+		case <-stop:
+		}
+	}()
+
+	queue := newMessageQueue(o.out.QueueSize)
+	cached, needKeyframe := o.ls.subscribe(queue)
+	defer o.ls.unsubscribe(queue)
+	for _, m := range cached {
+		if err := cc.WriteMessage(m); err != nil {
+			return err
+		}
+	}
+
+	synced := !needKeyframe
+	for {
+		// Leave messages queued while the server is not acknowledging
+		ch, ack := queue.ch, cc.c.ackWait()
+		if ack != nil {
+			ch = nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-cc.Done():
+			return cc.Err()
+		case <-ack:
+		case m := <-ch:
+			if !synced {
+				if !isKeyframe(m) && !isSequenceHeader(m) && !isMetadata(m) {
+					continue
+				}
+				synced = isKeyframe(m)
+			}
+			if err := cc.WriteMessage(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// host returns the host of the output's URL for logging, as unlike the URL it
+// holds no stream key.
+func (o *teeOutput) host() string {
+	u, err := url.Parse(o.out.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
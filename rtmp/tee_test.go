@@ -0,0 +1,159 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serve starts srv on a loopback listener and returns its address. The
+// caller must close srv.
+func serve(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	return ln.Addr().String()
+}
+
+// mediaHandler returns a Handler passing the audio and video messages it is
+// called with to the returned channel, dropping them once it is full.
+func mediaHandler() (Handler, <-chan *Message) {
+	ch := make(chan *Message, 64)
+	return HandlerFunc(func(w ResponseWriter, m *Message) {
+		if m.TypeId != TypeAudio && m.TypeId != TypeVideo {
+			return
+		}
+		select {
+		case ch <- m:
+		default:
+		}
+	}), ch
+}
+
+// receive returns the next message from ch, failing after a while.
+func receive(t *testing.T, ch <-chan *Message) *Message {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestTee(t *testing.T) {
+	// The output is down at first, so the tee has to reconnect to it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outAddr := ln.Addr().String()
+	ln.Close()
+
+	handler, received := mediaHandler()
+	out := &Server{Handler: handler, Logger: discardLogger}
+	defer out.Close()
+	srv := &Server{
+		Tee: map[string][]TeeOutput{
+			"live/abc": {{URL: "rtmp://" + outAddr + "/out/xyz", ReconnectDelay: 50 * time.Millisecond}},
+		},
+		Logger: discardLogger,
+	}
+	defer srv.Close()
+	addr := serve(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := Dial(ctx, "rtmp://"+addr+"/live/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	for _, m := range []*Message{videoHeaderMsg(), keyframeMsg(0), interframeMsg(40)} {
+		if err := cc.WriteMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	ln, err = net.Listen("tcp", outAddr)
+	if err != nil {
+		t.Skipf("output address taken: %v", err)
+	}
+	go out.Serve(ln)
+
+	// The output starts with the cached group of pictures, then gets the
+	// live stream
+	want := []*Message{videoHeaderMsg(), keyframeMsg(0), interframeMsg(40), interframeMsg(80)}
+	for i, w := range want {
+		if i == 3 {
+			if err := cc.WriteMessage(w); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := receive(t, received)
+		if m.TypeId != w.TypeId || m.Timestamp != w.Timestamp || !bytes.Equal(m.Payload, w.Payload) {
+			t.Errorf("message %d: got %v at %d % x, want %v at %d % x", i, m.TypeId, m.Timestamp, m.Payload, w.TypeId, w.Timestamp, w.Payload)
+		}
+	}
+	if _, ok := out.streams().lookup("out/xyz"); !ok {
+		t.Error("stream not published on the output")
+	}
+
+	// The output is unpublished along with the stream
+	cc.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := out.streams().lookup("out/xyz"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream still published on the output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestMessageQueue(t *testing.T) {
+	q := newMessageQueue(2)
+	var got []*Message
+	drain := func() {
+		for len(q.ch) > 0 {
+			got = append(got, <-q.ch)
+		}
+	}
+	q.push(keyframeMsg(0))
+	q.push(interframeMsg(40))
+	q.push(interframeMsg(80)) // full, dropped
+	drain()
+	q.push(audioMsg(90))       // dropped up to the next keyframe
+	q.push(videoHeaderMsg())   // kept, decoders need it
+	q.push(interframeMsg(120)) // still dropped
+	q.push(keyframeMsg(160))
+	q.push(interframeMsg(200)) // full again
+	drain()
+	q.push(interframeMsg(240))
+
+	want := []*Message{keyframeMsg(0), interframeMsg(40), videoHeaderMsg(), keyframeMsg(160)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d messages, want %d", len(got), len(want))
+		for _, m := range got {
+			t.Logf("%v at %d", m.TypeId, m.Timestamp)
+		}
+	}
+	if len(q.ch) != 0 {
+		t.Error("interframe queued after a drop")
+	}
+}
@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A CertificateReloader serves certificates loaded from PEM files, reading
+// them again whenever they change so renewed certificates are picked up
+// without restarting the server. Its GetCertificate method is meant to be
+// used as the GetCertificate of a tls.Config.
+//
+// Certificates are chosen by the server name the client asks for (SNI): the
+// first pair added whose certificate is valid for the name is served, the
+// first pair added if none is.
+type CertificateReloader struct {
+	// Logger, if non-nil, is told of files which fail to load again.
+	Logger Logger
+
+	mu    sync.Mutex
+	pairs []*certPair
+}
+
+// certPair is a certificate and its key, as last read from their files.
+type certPair struct {
+	certFile, keyFile string
+
+	certMod, keyMod time.Time
+	cert            *tls.Certificate
+}
+
+// Add adds the certificate in certFile with the key in keyFile, reading them
+// once to report errors early.
+func (r *CertificateReloader) Add(certFile, keyFile string) error {
+	p := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := p.load(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.pairs = append(r.pairs, p)
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the certificate to serve to the client sending
+// hello. Pairs whose files fail to load again keep serving the certificate
+// read last.
+func (r *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pairs) == 0 {
+		return nil, errors.New("rtmp: no certificates")
+	}
+	for _, p := range r.pairs {
+		if err := p.load(); err != nil && r.Logger != nil {
+			r.Logger.Log(LevelWarn, "certificate reload failed", "err", err)
+		}
+	}
+	if hello.ServerName != "" {
+		for _, p := range r.pairs {
+			if validFor(p.cert, hello.ServerName) {
+				return p.cert, nil
+			}
+		}
+	}
+	return r.pairs[0].cert, nil
+}
+
+// load reads the pair again if either file changed since it was last read.
+func (p *certPair) load() error {
+	cfi, err := os.Stat(p.certFile)
+	if err != nil {
+		return fmt.Errorf("rtmp: certificate: %s", err.Error())
+	}
+	kfi, err := os.Stat(p.keyFile)
+	if err != nil {
+		return fmt.Errorf("rtmp: certificate: %s", err.Error())
+	}
+	if p.cert != nil && cfi.ModTime().Equal(p.certMod) && kfi.ModTime().Equal(p.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("rtmp: certificate: %s", err.Error())
+	}
+	// Parse the leaf once here rather than on every handshake
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("rtmp: certificate: %s", err.Error())
+	}
+	p.cert, p.certMod, p.keyMod = &cert, cfi.ModTime(), kfi.ModTime()
+	return nil
+}
+
+// validFor reports whether cert is valid for the server name, going by the
+// names of its leaf certificate only, unlike
+// tls.ClientHelloInfo.SupportsCertificate, which needs Go 1.14.
+func validFor(cert *tls.Certificate, name string) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return false
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false
+		}
+	}
+	return leaf.VerifyHostname(name) == nil
+}
+
+// tlsConfig returns the TLS configuration for ServeTLS: a copy of
+// srv.TLSConfig, serving the certificate in certFile and keyFile too if set.
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		r := &CertificateReloader{Logger: srv.logger()}
+		if err := r.Add(certFile, keyFile); err != nil {
+			return nil, err
+		}
+		// Go only asks GetCertificate without SNI when there are no
+		// Certificates, so pick among those here to make the files the
+		// fallback either way
+		getCertificate, certs := config.GetCertificate, config.Certificates
+		config.Certificates = nil
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if getCertificate != nil {
+				if cert, err := getCertificate(hello); cert != nil || err != nil {
+					return cert, err
+				}
+			}
+			if hello.ServerName != "" {
+				for i := range certs {
+					if validFor(&certs[i], hello.ServerName) {
+						return &certs[i], nil
+					}
+				}
+			}
+			return r.GetCertificate(hello)
+		}
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("rtmp: no certificates for TLS")
+	}
+	return config, nil
+}
@@ -0,0 +1,218 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iotv/rtmp-tee-server/amf"
+)
+
+// testSerial numbers the certificates made by writeCert.
+var testSerial int64
+
+// writeCert writes a new self-signed certificate for host, and its key, to
+// name.crt and name.key in dir, returning the files and the certificate.
+func writeCert(t *testing.T, dir, name, host string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(atomic.AddInt64(&testSerial, 1)),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile, cert
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Modification times may be too coarse to tell rewrites apart
+	later := time.Now().Add(time.Duration(atomic.AddInt64(&testSerial, 1)) * time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aCert, aKey, a := writeCert(t, dir, "a", "a.example")
+	bCert, bKey, b := writeCert(t, dir, "b", "b.example")
+
+	var warnings int32
+	r := &CertificateReloader{Logger: LoggerFunc(func(level Level, msg string, keyvals ...interface{}) {
+		atomic.AddInt32(&warnings, 1)
+	})}
+	if _, err := r.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("certificate served without any added")
+	}
+	if err := r.Add(filepath.Join(dir, "missing.crt"), aKey); err == nil {
+		t.Error("missing certificate added")
+	}
+	if err := r.Add(aCert, aKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(bCert, bKey); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(serverName string, want *x509.Certificate) {
+		t.Helper()
+		cert, err := r.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("%q: %v", serverName, err)
+		}
+		if !bytes.Equal(cert.Certificate[0], want.Raw) {
+			t.Errorf("%q: served the certificate for %s, want %s", serverName, cert.Leaf.Subject.CommonName, want.Subject.CommonName)
+		}
+	}
+	// Certificates are picked by SNI, falling back to the first
+	check("a.example", a)
+	check("b.example", b)
+	check("c.example", a)
+	check("", a)
+
+	// Renewed certificates are served once written
+	_, _, b2 := writeCert(t, dir, "b", "b.example")
+	check("b.example", b2)
+
+	// Certificates which fail to load keep the last one
+	writePEM(t, bCert, "CERTIFICATE", []byte("garbage"))
+	check("b.example", b2)
+	if atomic.LoadInt32(&warnings) == 0 {
+		t.Error("reload failure not logged")
+	}
+}
+
+// dialTLS connects to the RTMPS server at addr asking for serverName,
+// trusting roots, and returns the connection and the certificate served.
+func dialTLS(t *testing.T, addr, serverName string, roots ...*x509.Certificate) (*tls.Conn, *x509.Certificate) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	tc, err := tls.DialWithDialer(d, "tcp", addr, &tls.Config{ServerName: serverName, RootCAs: pool})
+	if err != nil {
+		t.Fatalf("%q: %v", serverName, err)
+	}
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	return tc, tc.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aCert, aKey, a := writeCert(t, dir, "a", "a.example")
+	bCert, bKey, b := writeCert(t, dir, "b", "b.example")
+	bPair, err := tls.LoadX509KeyPair(bCert, bKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are the fallback to the certificates of TLSConfig
+	srv := &Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{bPair}}, Logger: discardLogger}
+	defer srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServeTLS(ln, aCert, aKey) }()
+	addr := ln.Addr().String()
+
+	tests := []struct {
+		serverName string
+		want       *x509.Certificate
+	}{
+		{"a.example", a},
+		{"b.example", b},
+	}
+	for _, tt := range tests {
+		tc, cert := dialTLS(t, addr, tt.serverName, a, b)
+		tc.Close()
+		if !cert.Equal(tt.want) {
+			t.Errorf("%q: served the certificate for %s", tt.serverName, cert.Subject.CommonName)
+		}
+	}
+
+	// Renewing the files takes effect on the next connection
+	_, _, a2 := writeCert(t, dir, "a", "a.example")
+	tc, cert := dialTLS(t, addr, "a.example", a2)
+	defer tc.Close()
+	if !cert.Equal(a2) {
+		t.Error("renewed certificate not served")
+	}
+
+	// RTMP runs over the TLS connection as usual
+	s1, s2 := clientHandshake(t, tc, testC1(), func(s1 []byte) []byte { return s1 })
+	if !bytes.Equal(s2, testC1()) {
+		t.Error("S2 does not echo C1")
+	}
+	if len(s1) != handshakeSize {
+		t.Errorf("S1 of %d bytes", len(s1))
+	}
+	c := newConn(tc)
+	c.setupBuffers()
+	c.ctx = context.Background()
+	cc := &ClientConn{c: c, tId: 1}
+	if _, err := cc.call(context.Background(), "connect", amf.AMF0Object{"app": "live"}); err != nil {
+		t.Errorf("connect over TLS: %v", err)
+	}
+
+	srv.Close()
+	if err := <-errc; err != ErrServerClosed {
+		t.Errorf("ServeTLS: %v", err)
+	}
+
+	if err := (&Server{}).ServeTLS(ln, "", ""); err == nil {
+		t.Error("ServeTLS without certificates succeeded")
+	}
+}
@@ -0,0 +1,156 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// userControlEvent is the event type of a User Control message.
+type userControlEvent uint16
+
+// User Control event types
+const (
+	eventStreamBegin      userControlEvent = 0 // a message stream became functional
+	eventStreamEOF        userControlEvent = 1 // playback of a message stream is over
+	eventStreamDry        userControlEvent = 2 // no more data on a message stream for now
+	eventSetBufferLength  userControlEvent = 3 // the client's buffer length for a message stream
+	eventStreamIsRecorded userControlEvent = 4 // a message stream is recorded
+	eventPingRequest      userControlEvent = 6 // the server probing the client
+	eventPingResponse     userControlEvent = 7 // the client answering a ping request
+)
+
+// pingInterval is how often peers are sent a PingRequest to measure the round
+// trip time.
+const pingInterval = 30 * time.Second
+
+// userControl is a decoded User Control message. Which of the fields are used
+// depends on the event type.
+type userControl struct {
+	event userControlEvent
+
+	streamId     uint32 // all events but PingRequest and PingResponse
+	bufferLength uint32 // SetBufferLength, in milliseconds
+	timestamp    uint32 // PingRequest and PingResponse, in milliseconds
+}
+
+// parseUserControl decodes the payload of a User Control message. Events of
+// unknown types are returned with only their type set.
+func parseUserControl(b []byte) (*userControl, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("rtmp: user control message too short: %d", len(b))
+	}
+	u := &userControl{event: userControlEvent(binary.BigEndian.Uint16(b[0:2]))}
+	b = b[2:]
+
+	var need int
+	switch u.event {
+	case eventStreamBegin, eventStreamEOF, eventStreamDry, eventStreamIsRecorded, eventPingRequest, eventPingResponse:
+		need = 4
+	case eventSetBufferLength:
+		need = 8
+	default:
+		return u, nil
+	}
+	if len(b) < need {
+		return nil, fmt.Errorf("rtmp: user control event %d too short: %d", u.event, len(b))
+	}
+
+	switch u.event {
+	case eventPingRequest, eventPingResponse:
+		u.timestamp = binary.BigEndian.Uint32(b[0:4])
+	case eventSetBufferLength:
+		u.streamId = binary.BigEndian.Uint32(b[0:4])
+		u.bufferLength = binary.BigEndian.Uint32(b[4:8])
+	default:
+		u.streamId = binary.BigEndian.Uint32(b[0:4])
+	}
+	return u, nil
+}
+
+// marshal encodes u as the payload of a User Control message.
+func (u *userControl) marshal() []byte {
+	var b []byte
+	switch u.event {
+	case eventSetBufferLength:
+		b = make([]byte, 10)
+		binary.BigEndian.PutUint32(b[2:6], u.streamId)
+		binary.BigEndian.PutUint32(b[6:10], u.bufferLength)
+	case eventPingRequest, eventPingResponse:
+		b = make([]byte, 6)
+		binary.BigEndian.PutUint32(b[2:6], u.timestamp)
+	default:
+		b = make([]byte, 6)
+		binary.BigEndian.PutUint32(b[2:6], u.streamId)
+	}
+	binary.BigEndian.PutUint16(b[0:2], uint16(u.event))
+	return b
+}
+
+// writeUserControl writes u to the peer.
+func (c *conn) writeUserControl(u *userControl) error {
+	return c.writeMessage(&Message{TypeId: TypeUserControl, Payload: u.marshal()})
+}
+
+// writeStreamBegin tells the peer the message stream streamId has become
+// functional.
+func (c *conn) writeStreamBegin(streamId uint32) error {
+	return c.writeUserControl(&userControl{event: eventStreamBegin, streamId: streamId})
+}
+
+// writeStreamEOF tells the peer playback of the message stream streamId is
+// over.
+func (c *conn) writeStreamEOF(streamId uint32) error {
+	return c.writeUserControl(&userControl{event: eventStreamEOF, streamId: streamId})
+}
+
+// writePingRequest asks the peer to echo the current timestamp back so the
+// round trip time can be measured.
+func (c *conn) writePingRequest() error {
+	return c.writeUserControl(&userControl{event: eventPingRequest, timestamp: getUint32MilsTimestamp()})
+}
+
+// handleUserControl acts on a User Control message from the peer. The buffer
+// length a player sets for a message stream bounds the cached media it is
+// sent when it next plays on it, see replayFor.
+func (c *conn) handleUserControl(msg *Message) error {
+	u, err := parseUserControl(msg.Payload)
+	if err != nil {
+		return err
+	}
+	switch u.event {
+	case eventPingRequest:
+		return c.writeUserControl(&userControl{event: eventPingResponse, timestamp: u.timestamp})
+	case eventPingResponse:
+		// Timestamps are truncated milliseconds, which wrap around together
+		rtt := time.Duration(getUint32MilsTimestamp()-u.timestamp) * time.Millisecond
+		atomic.StoreInt64(&c.rtt, int64(rtt))
+		c.log(LevelDebug, "ping", "rtt", rtt)
+	case eventSetBufferLength:
+		c.bufferLengths[u.streamId] = u.bufferLength
+	}
+	return nil
+}
+
+// pingLoop sends the peer a PingRequest every pingInterval, or half the read
+// timeout if that is shorter so idle peers keep answering in time, until the
+// connection's context is done.
+func (c *conn) pingLoop() {
+	interval := pingInterval
+	if c.readTimeout > 0 && c.readTimeout/2 < interval {
+		interval = c.readTimeout / 2
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+			if err := c.writePingRequest(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUserControl(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want *userControl // nil for an error
+	}{
+		{"StreamBegin", []byte{0, 0, 0, 0, 0, 1}, &userControl{event: eventStreamBegin, streamId: 1}},
+		{"StreamEOF", []byte{0, 1, 0, 0, 0, 2}, &userControl{event: eventStreamEOF, streamId: 2}},
+		{"StreamDry", []byte{0, 2, 0, 0, 0, 3}, &userControl{event: eventStreamDry, streamId: 3}},
+		{"SetBufferLength", []byte{0, 3, 0, 0, 0, 1, 0, 0, 0x0B, 0xB8}, &userControl{event: eventSetBufferLength, streamId: 1, bufferLength: 3000}},
+		{"StreamIsRecorded", []byte{0, 4, 0, 0, 0, 1}, &userControl{event: eventStreamIsRecorded, streamId: 1}},
+		{"PingRequest", []byte{0, 6, 0x12, 0x34, 0x56, 0x78}, &userControl{event: eventPingRequest, timestamp: 0x12345678}},
+		{"PingResponse", []byte{0, 7, 0x12, 0x34, 0x56, 0x78}, &userControl{event: eventPingResponse, timestamp: 0x12345678}},
+		{"unknown event", []byte{0, 0x1F, 1, 2}, &userControl{event: 0x1F}},
+		{"trailing bytes", []byte{0, 0, 0, 0, 0, 1, 0xFF}, &userControl{event: eventStreamBegin, streamId: 1}},
+		{"empty", nil, nil},
+		{"event only", []byte{0}, nil},
+		{"StreamBegin short", []byte{0, 0, 0, 0, 1}, nil},
+		{"SetBufferLength short", []byte{0, 3, 0, 0, 0, 1, 0, 0, 0x0B}, nil},
+		{"PingRequest short", []byte{0, 6}, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseUserControl(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %+v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		// Known events encode back as they were sent
+		if tt.want.event != 0x1F && !bytes.HasPrefix(tt.in, got.marshal()) {
+			t.Errorf("%s: marshaled % x, want % x", tt.name, got.marshal(), tt.in)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, tc := newTestConn(nil)
+	if c.RTT() != 0 {
+		t.Errorf("RTT before any ping: %s", c.RTT())
+	}
+
+	// Ping requests from the peer are echoed
+	req := &userControl{event: eventPingRequest, timestamp: 12345}
+	if err := c.handleUserControl(&Message{TypeId: TypeUserControl, Payload: req.marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := newTestConn(tc.w.Bytes())
+	m := readMessages(t, r, 1)[0]
+	u, err := parseUserControl(m.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TypeId != TypeUserControl || *u != (userControl{event: eventPingResponse, timestamp: 12345}) {
+		t.Errorf("answered with %v %+v", m.TypeId, u)
+	}
+
+	// Our own ping requests, answered by the peer, give the round trip time
+	tc.w.Reset()
+	if err := c.writePingRequest(); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = newTestConn(tc.w.Bytes())
+	m = readMessages(t, r, 1)[0]
+	if u, err = parseUserControl(m.Payload); err != nil || u.event != eventPingRequest {
+		t.Fatalf("sent %+v, %v", u, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	resp := &userControl{event: eventPingResponse, timestamp: u.timestamp}
+	if err := c.handleUserControl(&Message{TypeId: TypeUserControl, Payload: resp.marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := c.RTT(); rtt < 20*time.Millisecond || rtt > time.Second {
+		t.Errorf("RTT %s after 20ms", rtt)
+	}
+}
+
+func TestSetBufferLength(t *testing.T) {
+	c, _ := newTestConn(nil)
+	u := &userControl{event: eventSetBufferLength, streamId: 1, bufferLength: 500}
+	if err := c.handleUserControl(&Message{TypeId: TypeUserControl, Payload: u.marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.bufferLengths[1]; got != 500 {
+		t.Errorf("buffer length %d, want 500", got)
+	}
+	c.streams[1] = true
+	c.deleteStream(1)
+	if _, ok := c.bufferLengths[1]; ok {
+		t.Error("buffer length kept after deleteStream")
+	}
+}
+
+func TestReplayFor(t *testing.T) {
+	headers := []*Message{metadataMsg(), videoHeaderMsg(), audioHeaderMsg()}
+	gop := append(headers[:3:3], keyframeMsg(1000), audioMsg(1010), interframeMsg(1040), interframeMsg(1080))
+	audioOnly := []*Message{audioHeaderMsg(), audioMsg(1000), audioMsg(1023), audioMsg(1046), audioMsg(1069)}
+
+	tests := []struct {
+		name             string
+		cached           []*Message
+		bufferLength     uint32
+		want             []*Message
+		wantNeedKeyframe bool
+	}{
+		{"group fits", gop, 80, gop, false},
+		{"group too long", gop, 79, headers, true},
+		{"headers only", headers, 0, headers, false},
+		{"audio fits", audioOnly, 100, audioOnly, false},
+		{"audio trimmed", audioOnly, 30, []*Message{audioOnly[0], audioOnly[3], audioOnly[4]}, false},
+		{"no buffer", audioOnly, 0, []*Message{audioOnly[0], audioOnly[4]}, false},
+	}
+	for _, tt := range tests {
+		got, needKeyframe := replayFor(tt.cached, false, tt.bufferLength)
+		if !reflect.DeepEqual(got, tt.want) || needKeyframe != tt.wantNeedKeyframe {
+			t.Errorf("%s: got %d messages, needKeyframe %t, want %d, %t", tt.name, len(got), needKeyframe, len(tt.want), tt.wantNeedKeyframe)
+		}
+	}
+}